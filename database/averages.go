@@ -0,0 +1,496 @@
+package nmea2mongo
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"../Error"
+	"../nmea"
+)
+
+// Earlier versions stored the index of the period, timestamp / interval,
+// instead of its start. Such indices are far below any timestamp since 2001.
+const legacyTimestampLimit int64 = 1000000000
+
+type watermarkKey struct {
+	dataType string
+	interval int64
+}
+
+// The aggregates of a type and interval are complete up to their watermark,
+// each run of the average routine only computes the periods after it. Records
+// written behind a watermark, e.g. replayed from the spool, lower it to the
+// start of their period, so that period and all after it are computed again.
+
+// averageRoutine is counted in averages by its caller, so Stop cannot miss it
+func (run *Engine) averageRoutine() {
+	defer run.averages.Done()
+	minuteTicker := time.NewTicker(time.Minute)
+	defer minuteTicker.Stop()
+	run.averageWorkDispatcher()
+
+	for {
+		select {
+		case <-minuteTicker.C:
+			run.goAverage()
+		case <-run.stopChan:
+			return
+		}
+	}
+}
+
+func (run *Engine) goAverage() {
+	run.averages.Add(1)
+	go func() {
+		defer run.averages.Done()
+		run.averageWorkDispatcher()
+	}()
+}
+
+func (run *Engine) averageWorkDispatcher() {
+	if err := run.pingAsError(); err != nil {
+		run.errorChan <- err
+		return
+	}
+
+	nmeaTypes, err := run.aggregateTypes()
+	if err != nil {
+		run.errorChan <- Error.Err(Error.Debug, err, mongoFlag)
+		return
+	}
+
+	run.averageLock.Lock()
+	defer run.averageLock.Unlock()
+	if err = run.dropLegacyAggregates(nmeaTypes); err != nil {
+		run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+		return
+	}
+	for _, nmeaType := range nmeaTypes {
+		if run.isStopping() {
+			return
+		}
+		run.averageWorker(nmeaType)
+	}
+}
+
+// dropLegacyAggregates drops all aggregates once if any of them still carries
+// the index of its period, they are computed again from the records. The
+// caller holds averageLock.
+func (run *Engine) dropLegacyAggregates(nmeaTypes []string) error {
+	if run.legacyChecked {
+		return nil
+	}
+	for _, nmeaType := range nmeaTypes {
+		for _, iv := range run.config.intervals {
+			_, last, ok, err := run.storage.Bounds(nmeaType, iv.seconds)
+			if err != nil {
+				return err
+			}
+			if !ok || last >= legacyTimestampLimit {
+				continue
+			}
+
+			run.watermarkLock.Lock()
+			err = run.storage.DropAggregates()
+			run.watermarks = make(map[watermarkKey]int64)
+			run.watermarkLock.Unlock()
+			if err != nil {
+				return err
+			}
+			run.errorChan <- Error.New(Error.Info,
+				"dropped aggregates of an earlier version, they are computed again",
+				mongoFlag)
+			run.legacyChecked = true
+			return nil
+		}
+	}
+	run.legacyChecked = true
+	return nil
+}
+
+func (run *Engine) averageWorker(nmeaType string) {
+	startTime := time.Now()
+	periods := 0
+	for _, iv := range run.config.intervals {
+		count, err := run.aggregate(nmeaType, iv)
+		periods += count
+		if err != nil {
+			run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+			return
+		}
+	}
+
+	if periods > 0 {
+		run.errorChan <- Error.New(Error.Debug,
+			"aggregated "+strconv.Itoa(periods)+" periods of "+nmeaType+
+				" in "+strconv.FormatFloat(time.Since(startTime).Seconds(), 'f', 3, 64)+"s",
+			mongoFlag)
+	}
+}
+
+// aggregateTypes lists the types of which aggregates are computed
+func (run *Engine) aggregateTypes() ([]string, error) {
+	typeList, err := run.storage.ListTypes()
+	if err != nil {
+		return nil, err
+	}
+	nmeaTypes := make([]string, 0, len(typeList))
+	for _, nmeaType := range typeList {
+		if nmeaType != nmea.TypeOutage {
+			nmeaTypes = append(nmeaTypes, nmeaType)
+		}
+	}
+	return nmeaTypes, nil
+}
+
+// aggregate computes the periods between the watermark and the period of the
+// last record, which is still open, and moves the watermark past them. Merged
+// aggregates only reach up to the watermark of their source. It returns the
+// number of aggregates written.
+func (run *Engine) aggregate(nmeaType string, iv *aggregateInterval) (int, error) {
+	key := watermarkKey{dataType: nmeaType, interval: iv.seconds}
+	run.watermarkLock.Lock()
+	watermark, ok, err := run.loadWatermark(nmeaType, iv)
+	run.watermarkLock.Unlock()
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	_, last, ok, err := run.storage.Bounds(nmeaType, 0)
+	if err != nil || !ok {
+		return 0, err
+	}
+	to := iv.start(last)
+	if source := run.sourceInterval(iv); source != nil {
+		run.watermarkLock.Lock()
+		sourceWatermark, ok, err := run.loadWatermark(nmeaType, source)
+		run.watermarkLock.Unlock()
+		if err != nil || !ok {
+			return 0, err
+		}
+		if limit := iv.start(sourceWatermark); limit < to {
+			to = limit
+		}
+	}
+	// a watermark set with another timezone is not a period start
+	from := iv.start(watermark)
+	if to <= from {
+		return 0, nil
+	}
+
+	done, count, err := run.computeRange(nmeaType, iv, from, to)
+	run.advanceWatermark(key, watermark, done)
+	return count, err
+}
+
+// loadWatermark returns the cached watermark, the stored one or, for types
+// aggregated before watermarks existed, the end of the last aggregate. A type
+// without aggregates starts at its first record. ok is false if there are no
+// records. The caller holds watermarkLock.
+func (run *Engine) loadWatermark(nmeaType string, iv *aggregateInterval) (int64, bool, error) {
+	key := watermarkKey{dataType: nmeaType, interval: iv.seconds}
+	if watermark, ok := run.watermarks[key]; ok {
+		return watermark, true, nil
+	}
+
+	watermark, ok, err := run.storage.Watermark(nmeaType, iv.seconds)
+	if err != nil {
+		return 0, false, err
+	}
+	if !ok {
+		_, last, found, err := run.storage.Bounds(nmeaType, iv.seconds)
+		if err != nil {
+			return 0, false, err
+		}
+		if found {
+			watermark = iv.next(last)
+		} else {
+			first, _, found, err := run.storage.Bounds(nmeaType, 0)
+			if err != nil || !found {
+				return 0, false, err
+			}
+			watermark = iv.start(first)
+		}
+	}
+	run.watermarks[key] = watermark
+	return watermark, true, nil
+}
+
+// advanceWatermark moves the watermark from from to to, unless records behind
+// it were written meanwhile and lowered it
+func (run *Engine) advanceWatermark(key watermarkKey, from int64, to int64) {
+	run.watermarkLock.Lock()
+	defer run.watermarkLock.Unlock()
+	if current, ok := run.watermarks[key]; !ok || current != from || to <= from {
+		return
+	}
+	run.watermarks[key] = to
+	if err := run.storage.SetWatermark(key.dataType, key.interval, to); err != nil {
+		run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+	}
+}
+
+// lowerWatermarks moves the watermarks of a type back to the period of the
+// oldest written record
+func (run *Engine) lowerWatermarks(nmeaType string, records []*nmea.Data) {
+	if len(records) == 0 {
+		return
+	}
+	oldest := records[0].Timestamp
+	for _, data := range records {
+		if data.Timestamp < oldest {
+			oldest = data.Timestamp
+		}
+	}
+
+	run.watermarkLock.Lock()
+	defer run.watermarkLock.Unlock()
+	for _, iv := range run.config.intervals {
+		watermark, ok, err := run.loadWatermark(nmeaType, iv)
+		if err != nil {
+			run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+			continue
+		}
+		if !ok || oldest >= watermark {
+			continue
+		}
+		key := watermarkKey{dataType: nmeaType, interval: iv.seconds}
+		run.watermarks[key] = iv.start(oldest)
+		if err = run.storage.SetWatermark(nmeaType, iv.seconds, run.watermarks[key]); err != nil {
+			run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+		}
+	}
+}
+
+// sourceInterval returns the coarsest configured interval whose periods make
+// up those of iv, the aggregates of iv are merged from it. It returns nil if
+// they are computed from the raw records.
+func (run *Engine) sourceInterval(iv *aggregateInterval) *aggregateInterval {
+	var source *aggregateInterval
+	for _, finer := range run.config.intervals {
+		if finer.nestsIn(iv) {
+			source = finer
+		}
+	}
+	return source
+}
+
+// computeRange writes the aggregates of the periods between from and to,
+// both period starts. The finest aggregates are computed from the raw
+// records, all others are merged from the aggregates of their source
+// interval. Sources are read in chunks of about an hour of records or a
+// thousand aggregates. It returns how far it got, which is less than to if
+// it was stopped or failed, and the number of aggregates written.
+func (run *Engine) computeRange(nmeaType string, iv *aggregateInterval, from int64, to int64) (int64, int, error) {
+	source := run.sourceInterval(iv)
+	span := hour
+	if source != nil {
+		span = 1000 * source.seconds
+	}
+	chunkPeriods := span / iv.seconds
+	if chunkPeriods < 1 {
+		chunkPeriods = 1
+	}
+
+	count := 0
+	for start := from; start < to; {
+		if run.isStopping() {
+			return start, count, nil
+		}
+		end := start
+		for i := int64(0); i < chunkPeriods && end < to; i++ {
+			end = iv.next(end)
+		}
+		periods, statistics, err := run.readStatistics(nmeaType, iv, source, start, end)
+		if err != nil {
+			return start, count, err
+		}
+		for _, period := range periods {
+			if err = run.writeAggregates(nmeaType, iv, period, statistics[period]); err != nil {
+				return start, count, err
+			}
+			count++
+		}
+		start = end
+	}
+	return to, count, nil
+}
+
+// readStatistics accumulates the source entries between start and end into
+// periods of iv per device, it returns the periods that hold entries in
+// order. Combined aggregates of the source are left out, each period
+// combines its devices anew.
+func (run *Engine) readStatistics(nmeaType string, iv *aggregateInterval, source *aggregateInterval, start int64, end int64) ([]int64, map[int64]map[int64]*nmea.Statistics, error) {
+	sourceSeconds := int64(0)
+	if source != nil {
+		sourceSeconds = source.seconds
+	}
+	entries, err := run.storage.QueryRange(nmeaType, sourceSeconds, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// entries are ordered by timestamp, so are the periods
+	periods := make([]int64, 0)
+	statistics := make(map[int64]map[int64]*nmea.Statistics)
+	for _, entry := range entries {
+		deviceID := entry.DeviceID()
+		if source != nil && deviceID == nmea.DeviceCombined {
+			continue
+		}
+		period := iv.start(entry.Timestamp)
+		devices, ok := statistics[period]
+		if !ok {
+			devices = make(map[int64]*nmea.Statistics)
+			statistics[period] = devices
+			periods = append(periods, period)
+		}
+		current, ok := devices[deviceID]
+		if !ok {
+			current = nmea.NewStatistics()
+			devices[deviceID] = current
+		}
+		if source == nil {
+			current.Add(entry.Data)
+		} else {
+			current.Merge(nmea.StatisticsFromDataMap(entry.Data))
+		}
+	}
+	return periods, statistics, nil
+}
+
+// writeAggregates writes one aggregate per device and the combined one if
+// any of the devices has a weight
+func (run *Engine) writeAggregates(nmeaType string, iv *aggregateInterval, start int64, devices map[int64]*nmea.Statistics) error {
+	deviceIDs := make([]int64, 0, len(devices))
+	for deviceID := range devices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Slice(deviceIDs, func(i, j int) bool { return deviceIDs[i] < deviceIDs[j] })
+
+	aggregates := make([]*nmea.Data, 0, len(devices)+1)
+	weighted := make([]*nmea.Statistics, 0)
+	weights := make([]float64, 0)
+	for _, deviceID := range deviceIDs {
+		aggregates = append(aggregates, run.aggregateData(nmeaType, start, deviceID, devices[deviceID].DataMap()))
+		if weight := run.config.weights[deviceID]; weight > 0 {
+			weighted = append(weighted, devices[deviceID])
+			weights = append(weights, weight)
+		}
+	}
+	if len(weighted) > 0 {
+		combined := nmea.CombineStatistics(weighted, weights)
+		aggregates = append(aggregates, run.aggregateData(nmeaType, start, nmea.DeviceCombined, combined))
+	}
+	return run.storage.WriteAggregates(nmeaType, iv.seconds, aggregates)
+}
+
+func (run *Engine) aggregateData(nmeaType string, start int64, deviceID int64, data nmea.DataMap) *nmea.Data {
+	data["deviceid"] = float64(deviceID)
+	return &nmea.Data{
+		Timestamp: start,
+		Type:      nmeaType,
+		Data:      data,
+	}
+}
+
+// Rebuild computes the aggregates of all periods overlapping start to end
+// again, for all types if nmeaType is empty. The range is widened to whole
+// periods of the longest interval, so merged aggregates only use rebuilt
+// ones. Periods that are still open are left to the average routine.
+func (run *Engine) Rebuild(nmeaType string, start int64, end int64) error {
+	if err := run.storage.Ping(); err != nil {
+		return err
+	}
+	nmeaTypes := []string{nmeaType}
+	if nmeaType == "" {
+		var err error
+		if nmeaTypes, err = run.aggregateTypes(); err != nil {
+			return err
+		}
+	}
+
+	run.averageLock.Lock()
+	defer run.averageLock.Unlock()
+	if err := run.dropLegacyAggregates(nmeaTypes); err != nil {
+		return err
+	}
+	for _, nmeaType := range nmeaTypes {
+		startTime := time.Now()
+		first, last, ok, err := run.storage.Bounds(nmeaType, 0)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		longest := run.config.intervals[len(run.config.intervals)-1]
+		widened := longest.start(start)
+		if start < first {
+			widened = longest.start(first)
+		}
+		until := last
+		if end < until {
+			if until = longest.start(end); until < end {
+				until = longest.next(until)
+			}
+		}
+
+		periods := 0
+		for _, iv := range run.config.intervals {
+			if run.isStopping() {
+				return nil
+			}
+			// the period of the last record is still open
+			from := iv.start(widened)
+			to := iv.start(until)
+			if open := iv.start(last); to > open {
+				to = open
+			}
+			if to <= from {
+				continue
+			}
+
+			key := watermarkKey{dataType: nmeaType, interval: iv.seconds}
+			run.watermarkLock.Lock()
+			watermark, _, err := run.loadWatermark(nmeaType, iv)
+			run.watermarkLock.Unlock()
+			if err != nil {
+				return err
+			}
+
+			done, count, err := run.computeRange(nmeaType, iv, from, to)
+			periods += count
+			if err != nil {
+				return err
+			}
+			// the rebuilt range may reach beyond the watermark
+			if from <= watermark && done > watermark {
+				run.advanceWatermark(key, watermark, done)
+			}
+		}
+		run.errorChan <- Error.New(Error.Info,
+			"rebuilt "+strconv.Itoa(periods)+" periods of "+nmeaType+
+				" in "+strconv.FormatFloat(time.Since(startTime).Seconds(), 'f', 3, 64)+"s",
+			mongoFlag)
+	}
+	return nil
+}
+
+// RecalculateAverage rebuilds all aggregates in the background
+func (run *Engine) RecalculateAverage() {
+	run.errorChan <- Error.New(Error.Debug,
+		"recalculating averages: please wait",
+		mongoFlag)
+
+	run.averages.Add(1)
+	go func() {
+		defer run.averages.Done()
+		if err := run.Rebuild("", 0, math.MaxInt64); err != nil {
+			run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+		}
+	}()
+}
@@ -0,0 +1,241 @@
+package nmea2mongo
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"../storage"
+	"../storage/sqlite"
+)
+
+const averagesType string = "MTW"
+
+// averagesBase is 2024-05-01 10:00 UTC
+var averagesBase = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).Unix()
+
+// temperatures returns a record of devices 1 and 2 every 10 seconds from
+// offset to offset+duration after averagesBase, device 2 reads 2 degrees more
+func temperatures(offset int64, duration int64) []*nmea.Data {
+	records := make([]*nmea.Data, 0)
+	for second := offset; second < offset+duration; second += 10 {
+		for device := int64(1); device <= 2; device++ {
+			data := nmea.NewSensorData(averagesType, device, nmea.DataMap{
+				"temperature": 15 + float64(second%600)/100 + float64(2*(device-1)),
+			})
+			data.Timestamp = averagesBase + second
+			records = append(records, data)
+		}
+	}
+	return records
+}
+
+// newAveragesEngine aggregates minutes and hours in UTC on a new sqlite
+// database, the spool is off and both devices are combined with the same weight
+func newAveragesEngine(t *testing.T) (*Engine, *sqlite.Storage) {
+	store, err := sqlite.Open(filepath.Join(t.TempDir(), "averages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	config, err := NewConfig(map[string]string{
+		ParamIntervals:          "1m,1h",
+		ParamTimezone:           "UTC",
+		ParamSpoolPath:          "",
+		ParamWeightPrefix + "1": "1",
+		ParamWeightPrefix + "2": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorChan := make(chan *Error.Error)
+	go func() {
+		for range errorChan {
+		}
+	}()
+	return NewWithStorage(make(chan *nmea.Data), errorChan, store, config), store
+}
+
+func TestAggregateIncremental(t *testing.T) {
+	run, store := newAveragesEngine(t)
+
+	// all records written so far, in the order of time
+	var records []*nmea.Data
+	write := func(list []*nmea.Data) {
+		records = append(records, list...)
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp < records[j].Timestamp })
+		if _, err := run.writeRecords(averagesType, list); err != nil {
+			t.Fatal(err)
+		}
+		run.averageWorkDispatcher()
+	}
+	aggregate := func(interval int64, start int64, deviceID int64) nmea.DataMap {
+		entries, err := store.QueryRange(averagesType, interval, start, start+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.DeviceID() == deviceID {
+				return entry.Data
+			}
+		}
+		t.Fatalf("no aggregate of device %d at %d", deviceID, start)
+		return nil
+	}
+	// the aggregates of a period, also those merged from shorter ones, have
+	// to match a single pass over the records of each device
+	check := func(name string, interval int64, start int64) {
+		for _, deviceID := range []int64{1, 2} {
+			want := nmea.NewStatistics()
+			for _, data := range records {
+				if data.DeviceID() == deviceID && data.Timestamp >= start && data.Timestamp < start+interval {
+					want.Add(data.Data)
+				}
+			}
+			got := aggregate(interval, start, deviceID)
+			for key, value := range want.DataMap() {
+				if math.Abs(got[key]-value) > 1e-9 {
+					t.Errorf("%s of device %d: %s is %v, want %v", name, deviceID, key, got[key], value)
+				}
+			}
+		}
+	}
+
+	// 10:00 to 12:30, the minute 12:29 and the hour 12:00 are still open
+	write(temperatures(0, 150*60))
+	tests := []struct {
+		interval   int64
+		aggregates int
+		watermark  int64
+	}{
+		{60, 149 * 3, averagesBase + 149*60},
+		{3600, 2 * 3, averagesBase + 2*3600},
+	}
+	for _, test := range tests {
+		entries, err := store.QueryRange(averagesType, test.interval, 0, math.MaxInt64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != test.aggregates {
+			t.Errorf("%d aggregates of %ds, want %d", len(entries), test.interval, test.aggregates)
+		}
+		watermark, ok, err := store.Watermark(averagesType, test.interval)
+		if err != nil || !ok || watermark != test.watermark {
+			t.Errorf("watermark of %ds at %d, want %d", test.interval, watermark, test.watermark)
+		}
+	}
+	check("minute", 60, averagesBase+5*60)
+	check("hour", 3600, averagesBase+3600)
+	combined := aggregate(3600, averagesBase+3600, nmea.DeviceCombined)["temperature"]
+	if device1 := aggregate(3600, averagesBase+3600, 1)["temperature"]; math.Abs(combined-(device1+1)) > 1e-9 {
+		t.Errorf("combined mean %v, want %v", combined, device1+1)
+	}
+
+	// a late record lowers the watermarks, its minute and hour are computed
+	// again, later records close the open periods
+	late := nmea.NewSensorData(averagesType, 1, nmea.DataMap{"temperature": 99})
+	late.Timestamp = averagesBase + 5*60 + 5
+	write([]*nmea.Data{late})
+	write(temperatures(150*60, 40*60))
+	check("late minute", 60, averagesBase+5*60)
+	check("late hour", 3600, averagesBase)
+	check("closed minute", 60, averagesBase+149*60)
+	check("closed hour", 3600, averagesBase+2*3600)
+	if got := aggregate(3600, averagesBase, 1)["temperature"+nmea.SuffixMax]; got != 99 {
+		t.Errorf("max of the hour %v, want the late 99", got)
+	}
+}
+
+// a rebuild computes the same aggregates as the average routine
+func TestRebuild(t *testing.T) {
+	run, store := newAveragesEngine(t)
+	if _, err := run.writeRecords(averagesType, temperatures(0, 150*60)); err != nil {
+		t.Fatal(err)
+	}
+	run.averageWorkDispatcher()
+	before := map[int64][]*nmea.Data{}
+	for _, interval := range []int64{60, 3600} {
+		entries, err := store.QueryRange(averagesType, interval, 0, math.MaxInt64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[interval] = entries
+	}
+
+	if err := store.DropAggregates(); err != nil {
+		t.Fatal(err)
+	}
+	// like a restarted logger without cached watermarks
+	run.watermarks = make(map[watermarkKey]int64)
+	if err := run.Rebuild("", 0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	for interval, want := range before {
+		got, err := store.QueryRange(averagesType, interval, 0, math.MaxInt64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d rebuilt aggregates of %ds differ from the %d of the routine",
+				len(got), interval, len(want))
+		}
+	}
+}
+
+// slowStorage makes the first pass of the average routine take a while
+type slowStorage struct {
+	storage.Storage
+	calls  int64
+	listed int32
+}
+
+func (s *slowStorage) Ping() error {
+	atomic.AddInt64(&s.calls, 1)
+	time.Sleep(50 * time.Millisecond)
+	return s.Storage.Ping()
+}
+
+func (s *slowStorage) ListTypes() ([]string, error) {
+	atomic.AddInt64(&s.calls, 1)
+	time.Sleep(50 * time.Millisecond)
+	defer atomic.StoreInt32(&s.listed, 1)
+	return s.Storage.ListTypes()
+}
+
+// Stop right after Run waits for the first pass of the average routine
+func TestStopWaitsForAverages(t *testing.T) {
+	// on one processor the average routine does not start before Run returns
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	run, sqliteStore := newAveragesEngine(t)
+	store := &slowStorage{Storage: sqliteStore}
+	run.storage = store
+	dataChan := make(chan *nmea.Data)
+	run.dataChan = dataChan
+
+	run.Run(true)
+	waited := make(chan int32, 1)
+	go func() {
+		run.averages.Wait()
+		waited <- atomic.LoadInt32(&store.listed)
+	}()
+	close(dataChan)
+	run.Stop(5 * time.Second)
+	if atomic.LoadInt32(&store.listed) == 0 {
+		t.Fatal("Stop returned before the average routine listed the types")
+	}
+	if <-waited == 0 {
+		t.Fatal("the average routine was not counted when Run returned")
+	}
+	calls := atomic.LoadInt64(&store.calls)
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt64(&store.calls) != calls {
+		t.Error("the storage was used after Stop returned")
+	}
+}
@@ -0,0 +1,308 @@
+package nmea2mongo
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ParamURI                    string = "uri"
+	ParamDatabase               string = "database"
+	ParamCollectionPrefix       string = "collection_prefix"
+	ParamUsername               string = "username"
+	ParamPassword               string = "password"
+	ParamAuthSource             string = "auth_source"
+	ParamAuthMechanism          string = "auth_mechanism"
+	ParamTLSCAFile              string = "tls_ca_file"
+	ParamTLSCertFile            string = "tls_cert_file"
+	ParamTLSKeyFile             string = "tls_key_file"
+	ParamTLSInsecure            string = "tls_insecure"
+	ParamConnectTimeout         string = "connect_timeout"
+	ParamServerSelectionTimeout string = "server_selection_timeout"
+	ParamOperationTimeout       string = "operation_timeout"
+	ParamConnectRetry           string = "connect_retry"
+	ParamBatchSize              string = "batch_size"
+	ParamBatchInterval          string = "batch_interval"
+	ParamMaxFlushes             string = "max_flushes"
+	ParamSpoolPath              string = "spool_path"
+	ParamSpoolMaxBytes          string = "spool_max_bytes"
+	ParamSpoolSegmentBytes      string = "spool_segment_bytes"
+	ParamSpoolRetry             string = "spool_retry"
+	ParamWeightPrefix           string = "weight."
+	ParamIntervals              string = "intervals"
+	ParamTimezone               string = "timezone"
+
+	DefaultURI      string = "mongodb://boatpi:27017"
+	DefaultDatabase string = "NMEA0183"
+
+	defaultConnectTimeout         = 10 * time.Second
+	defaultServerSelectionTimeout = 10 * time.Second
+	defaultOperationTimeout       = 30 * time.Second
+	defaultConnectRetry           = 2 * time.Second
+
+	defaultBatchSize     int = 256
+	defaultBatchInterval     = time.Second
+	defaultMaxFlushes    int = 4
+
+	defaultSpoolMaxBytes     int64 = 256 << 20
+	defaultSpoolSegmentBytes int64 = 4 << 20
+	defaultSpoolRetry              = 10 * time.Second
+
+	defaultIntervals string = "1m,1h,1d"
+)
+
+type DbConfig struct {
+	uri              string
+	database         string
+	collectionPrefix string
+
+	// credentials, they override those of the uri
+	username      string
+	password      string
+	authSource    string
+	authMechanism string
+
+	// tls is used if any of these is set, the key file defaults to the
+	// certificate file for a combined pem
+	tlsCAFile   string
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsInsecure bool
+
+	connectTimeout         time.Duration
+	serverSelectionTimeout time.Duration
+	operationTimeout       time.Duration
+	// delay between attempts to set up the client, doubled up to spoolRetry
+	connectRetry time.Duration
+
+	// records of a collection are flushed once batchSize of them are
+	// collected or batchInterval passed, with at most maxFlushes at a time
+	batchSize     int
+	batchInterval time.Duration
+	maxFlushes    int
+
+	// records are spooled to disk while the database is unreachable, the
+	// database is pinged every spoolRetry to replay them
+	spoolPath         string
+	spoolMaxBytes     int64
+	spoolSegmentBytes int64
+	spoolRetry        time.Duration
+
+	// aggregates are computed per device, devices with a weight are also
+	// combined into one more aggregate per period
+	weights map[int64]float64
+
+	// aggregation intervals from the shortest to the longest, their periods
+	// are aligned to the local time of location
+	intervals []*aggregateInterval
+	location  *time.Location
+}
+
+// all database config is optional, other keys are an error:
+// uri = mongodb://host:port or mongodb+srv://host
+// database = name (default: NMEA0183)
+// collection_prefix = prepended to every collection name
+// username = string
+// password = string
+// auth_source = database holding the user (default: admin)
+// auth_mechanism = SCRAM-SHA-256, SCRAM-SHA-1, MONGODB-X509, ...
+// tls_ca_file = pem file of the certificate authority
+// tls_cert_file = pem file of the client certificate
+// tls_key_file = pem file of the client key (default: tls_cert_file)
+// tls_insecure = bool, skip the verification of the server certificate
+// connect_timeout = duration
+// server_selection_timeout = duration
+// operation_timeout = duration of a single database operation
+// connect_retry = duration, first delay between attempts to connect
+// batch_size = records per bulk write
+// batch_interval = duration after which a batch is written anyway
+// max_flushes = concurrent bulk writes
+// spool_path = directory records are kept in while the database is
+// unreachable, the spool is off unless it is set
+// spool_max_bytes = int
+// spool_segment_bytes = int
+// spool_retry = duration between pings while records are spooled
+// weight.<deviceid> = float, weight of the device in the combined aggregate
+// intervals = comma separated counts with s, m, h, d, w, mo or y (default: 1m,1h,1d)
+// timezone = name of the zone periods are aligned to, e.g. Europe/Berlin (default: Local)
+
+func NewConfig(configMap map[string]string) (*DbConfig, error) {
+	config := defaultConfig()
+	intervals := defaultIntervals
+
+	for key, value := range configMap {
+		var err error
+		switch key {
+		case ParamURI:
+			config.uri = value
+		case ParamDatabase:
+			config.database = value
+		case ParamCollectionPrefix:
+			config.collectionPrefix = value
+		case ParamUsername:
+			config.username = value
+		case ParamPassword:
+			config.password = value
+		case ParamAuthSource:
+			config.authSource = value
+		case ParamAuthMechanism:
+			config.authMechanism = strings.ToUpper(value)
+		case ParamTLSCAFile:
+			config.tlsCAFile = value
+		case ParamTLSCertFile:
+			config.tlsCertFile = value
+		case ParamTLSKeyFile:
+			config.tlsKeyFile = value
+		case ParamTLSInsecure:
+			config.tlsInsecure, err = strconv.ParseBool(value)
+		case ParamConnectTimeout:
+			config.connectTimeout, err = time.ParseDuration(value)
+		case ParamServerSelectionTimeout:
+			config.serverSelectionTimeout, err = time.ParseDuration(value)
+		case ParamOperationTimeout:
+			config.operationTimeout, err = time.ParseDuration(value)
+		case ParamConnectRetry:
+			config.connectRetry, err = time.ParseDuration(value)
+		case ParamBatchSize:
+			config.batchSize, err = strconv.Atoi(value)
+		case ParamBatchInterval:
+			config.batchInterval, err = time.ParseDuration(value)
+		case ParamMaxFlushes:
+			config.maxFlushes, err = strconv.Atoi(value)
+		case ParamSpoolPath:
+			config.spoolPath = value
+		case ParamSpoolMaxBytes:
+			config.spoolMaxBytes, err = strconv.ParseInt(value, 10, 64)
+		case ParamSpoolSegmentBytes:
+			config.spoolSegmentBytes, err = strconv.ParseInt(value, 10, 64)
+		case ParamSpoolRetry:
+			config.spoolRetry, err = time.ParseDuration(value)
+		case ParamIntervals:
+			intervals = value
+		case ParamTimezone:
+			config.location, err = time.LoadLocation(value)
+		default:
+			if !strings.HasPrefix(key, ParamWeightPrefix) {
+				return nil, errors.New(mongoFlag + ": unknown key " + key)
+			}
+			err = config.parseWeight(strings.TrimPrefix(key, ParamWeightPrefix), value)
+		}
+		if err != nil {
+			return nil, errors.New(mongoFlag + ": invalid value for " + key + ": " + value)
+		}
+	}
+
+	if config.uri == "" || config.database == "" {
+		return nil, errors.New(mongoFlag + ": uri and database must not be empty")
+	}
+	if config.password != "" && config.username == "" {
+		return nil, errors.New(mongoFlag + ": password given without username")
+	}
+	if config.tlsKeyFile != "" && config.tlsCertFile == "" {
+		return nil, errors.New(mongoFlag + ": tls key file given without certificate file")
+	}
+	if config.connectTimeout <= 0 || config.serverSelectionTimeout <= 0 ||
+		config.operationTimeout <= 0 || config.connectRetry <= 0 {
+		return nil, errors.New(mongoFlag + ": timeouts must be positive")
+	}
+	if config.batchSize <= 0 || config.batchInterval <= 0 || config.maxFlushes <= 0 {
+		return nil, errors.New(mongoFlag + ": invalid batch settings")
+	}
+	if config.spoolMaxBytes < config.spoolSegmentBytes || config.spoolSegmentBytes <= 0 ||
+		config.spoolRetry <= 0 {
+		return nil, errors.New(mongoFlag + ": invalid spool settings")
+	}
+
+	var err error
+	if config.intervals, err = parseIntervals(intervals, config.location); err != nil {
+		return nil, errors.New(mongoFlag + ": " + err.Error())
+	}
+	if len(config.intervals) == 0 {
+		return nil, errors.New(mongoFlag + ": no aggregation intervals")
+	}
+	return config, nil
+}
+
+func (config *DbConfig) parseWeight(device string, value string) error {
+	deviceID, err := strconv.ParseInt(device, 10, 64)
+	if err != nil {
+		return err
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if weight < 0 {
+		return errors.New("negative weight")
+	}
+	config.weights[deviceID] = weight
+	return nil
+}
+
+func defaultConfig() *DbConfig {
+	config := &DbConfig{
+		uri:      DefaultURI,
+		database: DefaultDatabase,
+
+		connectTimeout:         defaultConnectTimeout,
+		serverSelectionTimeout: defaultServerSelectionTimeout,
+		operationTimeout:       defaultOperationTimeout,
+		connectRetry:           defaultConnectRetry,
+
+		batchSize:     defaultBatchSize,
+		batchInterval: defaultBatchInterval,
+		maxFlushes:    defaultMaxFlushes,
+
+		spoolMaxBytes:     defaultSpoolMaxBytes,
+		spoolSegmentBytes: defaultSpoolSegmentBytes,
+		spoolRetry:        defaultSpoolRetry,
+
+		weights: make(map[int64]float64),
+
+		location: time.Local,
+	}
+	// the default intervals are valid
+	config.intervals, _ = parseIntervals(defaultIntervals, config.location)
+	return config
+}
+
+// WithoutSpool returns a copy of the config with the spool off, for runs
+// that only read records
+func (config *DbConfig) WithoutSpool() *DbConfig {
+	copied := *config
+	copied.spoolPath = ""
+	return &copied
+}
+
+// Location returns the timezone the aggregation periods are aligned to
+func (config *DbConfig) Location() *time.Location {
+	return config.location
+}
+
+func (config *DbConfig) usesTLS() bool {
+	return config.tlsCAFile != "" || config.tlsCertFile != "" || config.tlsInsecure
+}
+
+// redactedURI hides the password of the uri for log messages
+func (config *DbConfig) redactedURI() string {
+	scheme := strings.Index(config.uri, "://")
+	if scheme < 0 {
+		return config.uri
+	}
+	rest := config.uri[scheme+3:]
+	hosts := rest
+	if slash := strings.IndexAny(rest, "/?"); slash >= 0 {
+		hosts = rest[:slash]
+	}
+	at := strings.LastIndex(hosts, "@")
+	if at < 0 {
+		return config.uri
+	}
+	user := hosts[:at]
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		user = user[:colon] + ":***"
+	}
+	return config.uri[:scheme+3] + user + rest[at:]
+}
@@ -0,0 +1,152 @@
+package nmea2mongo
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"../storage"
+)
+
+var errNotConnected = errors.New(mongoFlag + ": not connected to the database yet")
+
+// connection stands in for a storage that could not be set up yet. Until
+// connectRoutine succeeds every call fails like an unreachable database
+// would, so records end up in the spool meanwhile.
+type connection struct {
+	lock   sync.RWMutex
+	store  storage.Storage
+	closed bool
+}
+
+func (c *connection) current() (storage.Storage, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.store == nil {
+		return nil, errNotConnected
+	}
+	return c.store, nil
+}
+
+// set returns false if the connection was closed in the meantime, the
+// storage is closed then
+func (c *connection) set(store storage.Storage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		store.Close()
+		return false
+	}
+	c.store = store
+	return true
+}
+
+func (c *connection) WriteRecords(dataType string, records []*nmea.Data) error {
+	store, err := c.current()
+	if err != nil {
+		return err
+	}
+	return store.WriteRecords(dataType, records)
+}
+
+func (c *connection) WriteAggregates(dataType string, interval int64, aggregates []*nmea.Data) error {
+	store, err := c.current()
+	if err != nil {
+		return err
+	}
+	return store.WriteAggregates(dataType, interval, aggregates)
+}
+
+func (c *connection) QueryRange(dataType string, interval int64, start int64, end int64) ([]*nmea.Data, error) {
+	store, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	return store.QueryRange(dataType, interval, start, end)
+}
+
+func (c *connection) Bounds(dataType string, interval int64) (int64, int64, bool, error) {
+	store, err := c.current()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return store.Bounds(dataType, interval)
+}
+
+func (c *connection) ListTypes() ([]string, error) {
+	store, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	return store.ListTypes()
+}
+
+func (c *connection) Watermark(dataType string, interval int64) (int64, bool, error) {
+	store, err := c.current()
+	if err != nil {
+		return 0, false, err
+	}
+	return store.Watermark(dataType, interval)
+}
+
+func (c *connection) SetWatermark(dataType string, interval int64, timestamp int64) error {
+	store, err := c.current()
+	if err != nil {
+		return err
+	}
+	return store.SetWatermark(dataType, interval, timestamp)
+}
+
+func (c *connection) DropAggregates() error {
+	store, err := c.current()
+	if err != nil {
+		return err
+	}
+	return store.DropAggregates()
+}
+
+func (c *connection) Ping() error {
+	store, err := c.current()
+	if err != nil {
+		return err
+	}
+	return store.Ping()
+}
+
+func (c *connection) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Close()
+}
+
+// connectRoutine retries to set up the client until it succeeds, the delay
+// between attempts doubles from connectRetry up to spoolRetry
+func (run *Engine) connectRoutine(conn *connection, open func() (storage.Storage, error)) {
+	delay := run.config.connectRetry
+	for {
+		select {
+		case <-time.After(delay):
+		case <-run.stopChan:
+			return
+		}
+
+		store, err := open()
+		if err == nil {
+			if conn.set(store) {
+				run.errorChan <- Error.New(Error.Info,
+					"connected to "+run.config.redactedURI(),
+					mongoFlag)
+			}
+			return
+		}
+		if delay *= 2; delay > run.config.spoolRetry {
+			delay = run.config.spoolRetry
+		}
+	}
+}
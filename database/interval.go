@@ -0,0 +1,187 @@
+package nmea2mongo
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type intervalUnit int
+
+const (
+	// units shorter than a day, their periods restart at local midnight
+	unitSecond intervalUnit = iota
+	unitDay
+	unitWeek
+	unitMonth
+
+	nominalMonth int64 = 2629746 // 365.2425 days / 12
+)
+
+// aggregateInterval describes the periods of one aggregation level. Periods
+// are aligned to the local time of location: days start at midnight, weeks on
+// monday and months on the first. Periods shorter than a day restart at
+// midnight, the last one of a day is cut short where the day is not a
+// multiple of their length, e.g. on the days daylight saving time starts or
+// ends.
+type aggregateInterval struct {
+	// collection suffix, e.g. minutes or 5minutes
+	name string
+	// nominal length, it identifies the interval in the storage
+	seconds  int64
+	unit     intervalUnit
+	count    int64
+	location *time.Location
+}
+
+var intervalUnits = []struct {
+	suffix string
+	unit   intervalUnit
+	scale  int64
+	name   string
+}{
+	{"mo", unitMonth, 1, "months"},
+	{"y", unitMonth, 12, "years"},
+	{"w", unitWeek, 1, "weeks"},
+	{"d", unitDay, 1, "days"},
+	{"h", unitSecond, 3600, "hours"},
+	{"m", unitSecond, 60, "minutes"},
+	{"s", unitSecond, 1, "seconds"},
+}
+
+// parseInterval reads a count with one of the units s, m, h, d, w, mo or y
+func parseInterval(spec string, location *time.Location) (*aggregateInterval, error) {
+	spec = strings.TrimSpace(spec)
+	for _, unit := range intervalUnits {
+		if !strings.HasSuffix(spec, unit.suffix) {
+			continue
+		}
+		count, err := strconv.ParseInt(strings.TrimSuffix(spec, unit.suffix), 10, 64)
+		if err != nil || count <= 0 {
+			return nil, errors.New("invalid interval " + spec)
+		}
+		iv := &aggregateInterval{
+			unit:     unit.unit,
+			count:    count * unit.scale,
+			location: location,
+		}
+		switch iv.unit {
+		case unitSecond:
+			iv.seconds = iv.count
+			if day%iv.seconds != 0 {
+				return nil, errors.New("interval " + spec + " does not divide a day")
+			}
+		case unitDay:
+			iv.seconds = iv.count * day
+		case unitWeek:
+			iv.seconds = iv.count * 7 * day
+		case unitMonth:
+			iv.seconds = iv.count * nominalMonth
+		}
+
+		iv.name = unit.name
+		if count != 1 {
+			iv.name = strconv.FormatInt(count, 10) + unit.name
+		}
+		return iv, nil
+	}
+	return nil, errors.New("invalid interval " + spec + ", expected a count with s, m, h, d, w, mo or y")
+}
+
+// parseIntervals reads a comma separated list, the result is sorted from the
+// shortest to the longest interval
+func parseIntervals(list string, location *time.Location) ([]*aggregateInterval, error) {
+	intervals := make([]*aggregateInterval, 0)
+	seen := make(map[int64]string)
+	for _, spec := range strings.Split(list, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		iv, err := parseInterval(spec, location)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[iv.seconds]; ok {
+			return nil, errors.New("intervals " + other + " and " + spec + " are the same")
+		}
+		seen[iv.seconds] = spec
+		intervals = append(intervals, iv)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].seconds < intervals[j].seconds })
+	return intervals, nil
+}
+
+// civilDay returns the number of the local day of t since 1970-01-01
+func civilDay(t time.Time) int64 {
+	year, month, dayOfMonth := t.Date()
+	return time.Date(year, month, dayOfMonth, 0, 0, 0, 0, time.UTC).Unix() / day
+}
+
+func (iv *aggregateInterval) midnight(civil int64) time.Time {
+	return time.Date(1970, time.January, int(1+civil), 0, 0, 0, 0, iv.location)
+}
+
+// start returns the start of the period that holds timestamp
+func (iv *aggregateInterval) start(timestamp int64) int64 {
+	t := time.Unix(timestamp, 0).In(iv.location)
+	civil := civilDay(t)
+
+	switch iv.unit {
+	case unitSecond:
+		midnight := iv.midnight(civil).Unix()
+		elapsed := timestamp - midnight
+		return midnight + elapsed - elapsed%iv.seconds
+	case unitDay:
+		return iv.midnight(civil - modulo(civil, iv.count)).Unix()
+	case unitWeek:
+		// 1970-01-01 was a thursday, weeks count from monday 1969-12-29
+		return iv.midnight(civil - modulo(civil+3, 7*iv.count)).Unix()
+	default:
+		months := int64(t.Year())*12 + int64(t.Month()) - 1
+		months -= modulo(months, iv.count)
+		return time.Date(int(months/12), time.Month(months%12+1), 1, 0, 0, 0, 0, iv.location).Unix()
+	}
+}
+
+// next returns the start of the period after the one starting at start
+func (iv *aggregateInterval) next(start int64) int64 {
+	t := time.Unix(start, 0).In(iv.location)
+	switch iv.unit {
+	case unitSecond:
+		end := start + iv.seconds
+		if midnight := iv.midnight(civilDay(t) + 1).Unix(); end > midnight {
+			end = midnight
+		}
+		return end
+	case unitDay:
+		return iv.midnight(civilDay(t) + iv.count).Unix()
+	case unitWeek:
+		return iv.midnight(civilDay(t) + 7*iv.count).Unix()
+	default:
+		return t.AddDate(0, int(iv.count), 0).Unix()
+	}
+}
+
+// nestsIn tells if every period of coarser is made up of whole periods of
+// iv, so the aggregates of coarser can be merged from those of iv
+func (iv *aggregateInterval) nestsIn(coarser *aggregateInterval) bool {
+	if iv.seconds >= coarser.seconds || iv.location != coarser.location {
+		return false
+	}
+	switch iv.unit {
+	case unitSecond:
+		return coarser.unit != unitSecond || coarser.seconds%iv.seconds == 0
+	case unitDay:
+		return iv.count == 1 || (coarser.unit == unitDay && coarser.count%iv.count == 0)
+	case unitWeek:
+		return coarser.unit == unitWeek && coarser.count%iv.count == 0
+	default:
+		return coarser.unit == unitMonth && coarser.count%iv.count == 0
+	}
+}
+
+func modulo(a int64, b int64) int64 {
+	return ((a % b) + b) % b
+}
@@ -0,0 +1,247 @@
+package nmea2mongo
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skip("no timezone database: " + err.Error())
+	}
+	return location
+}
+
+func TestParseIntervals(t *testing.T) {
+	tests := []struct {
+		list  string
+		names []string
+		err   string
+	}{
+		{list: "1m,1h,1d", names: []string{"minutes", "hours", "days"}},
+		{list: "1h, 5m ,1m", names: []string{"minutes", "5minutes", "hours"}},
+		{list: "1y,1mo,1w,2w", names: []string{"weeks", "2weeks", "months", "years"}},
+		{list: "30s,,1d", names: []string{"30seconds", "days"}},
+		{list: "", names: []string{}},
+		{list: "7m", err: "does not divide a day"},
+		{list: "0m", err: "invalid interval 0m"},
+		{list: "-1h", err: "invalid interval -1h"},
+		{list: "1x", err: "expected a count with"},
+		{list: "60m,1h", err: "intervals 60m and 1h are the same"},
+		{list: "12mo,1y", err: "are the same"},
+	}
+	for _, test := range tests {
+		t.Run(test.list, func(t *testing.T) {
+			intervals, err := parseIntervals(test.list, time.UTC)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(intervals))
+			for _, iv := range intervals {
+				names = append(names, iv.name)
+			}
+			if strings.Join(names, ",") != strings.Join(test.names, ",") {
+				t.Errorf("got %v, want %v", names, test.names)
+			}
+		})
+	}
+}
+
+func TestIntervalPeriods(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	kolkata := loadLocation(t, "Asia/Kolkata")
+	cet := time.FixedZone("CET", 3600)
+	cest := time.FixedZone("CEST", 2*3600)
+	ist := time.FixedZone("IST", 5*3600+1800)
+	date := func(location *time.Location, year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, location)
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		location *time.Location
+		at       time.Time
+		start    time.Time
+		next     time.Time
+	}{
+		{name: "quarter hour utc", spec: "15m", location: time.UTC,
+			at:    date(time.UTC, 2024, 5, 1, 12, 7),
+			start: date(time.UTC, 2024, 5, 1, 12, 0), next: date(time.UTC, 2024, 5, 1, 12, 15)},
+		{name: "hour before the gap", spec: "1h", location: berlin,
+			at:    date(cet, 2024, 3, 31, 1, 30),
+			start: date(cet, 2024, 3, 31, 1, 0), next: date(cest, 2024, 3, 31, 3, 0)},
+		{name: "hour repeated first", spec: "1h", location: berlin,
+			at:    date(cest, 2024, 10, 27, 2, 30),
+			start: date(cest, 2024, 10, 27, 2, 0), next: date(cet, 2024, 10, 27, 2, 0)},
+		{name: "hour repeated second", spec: "1h", location: berlin,
+			at:    date(cet, 2024, 10, 27, 2, 30),
+			start: date(cet, 2024, 10, 27, 2, 0), next: date(cet, 2024, 10, 27, 3, 0)},
+		// periods restart at midnight, the last one of a day is cut short
+		{name: "last 6h of a short day", spec: "6h", location: berlin,
+			at:    date(cest, 2024, 3, 31, 22, 0),
+			start: date(cest, 2024, 3, 31, 19, 0), next: date(cest, 2024, 4, 1, 0, 0)},
+		{name: "extra hour of a long day", spec: "6h", location: berlin,
+			at:    date(cet, 2024, 10, 27, 23, 30),
+			start: date(cet, 2024, 10, 27, 23, 0), next: date(cet, 2024, 10, 28, 0, 0)},
+		{name: "short day", spec: "1d", location: berlin,
+			at:    date(cest, 2024, 3, 31, 12, 0),
+			start: date(cet, 2024, 3, 31, 0, 0), next: date(cest, 2024, 4, 1, 0, 0)},
+		{name: "long day", spec: "1d", location: berlin,
+			at:    date(cet, 2024, 10, 27, 12, 0),
+			start: date(cest, 2024, 10, 27, 0, 0), next: date(cet, 2024, 10, 28, 0, 0)},
+		{name: "half hour offset", spec: "1h", location: kolkata,
+			at:    date(ist, 2024, 5, 1, 10, 45),
+			start: date(ist, 2024, 5, 1, 10, 0), next: date(ist, 2024, 5, 1, 11, 0)},
+		{name: "half hour offset day", spec: "1d", location: kolkata,
+			at:    date(time.UTC, 2024, 4, 30, 18, 45),
+			start: date(ist, 2024, 5, 1, 0, 0), next: date(ist, 2024, 5, 2, 0, 0)},
+		{name: "week from monday", spec: "1w", location: berlin,
+			at:    date(cest, 2024, 3, 31, 12, 0),
+			start: date(cet, 2024, 3, 25, 0, 0), next: date(cest, 2024, 4, 1, 0, 0)},
+		{name: "two weeks", spec: "2w", location: berlin,
+			at:    date(cest, 2024, 4, 7, 23, 59),
+			start: date(cet, 2024, 3, 25, 0, 0), next: date(cest, 2024, 4, 8, 0, 0)},
+		{name: "month across the change", spec: "1mo", location: berlin,
+			at:    date(cest, 2024, 3, 31, 23, 30),
+			start: date(cet, 2024, 3, 1, 0, 0), next: date(cest, 2024, 4, 1, 0, 0)},
+		{name: "quarter", spec: "3mo", location: berlin,
+			at:    date(cest, 2024, 5, 15, 8, 0),
+			start: date(cest, 2024, 4, 1, 0, 0), next: date(cest, 2024, 7, 1, 0, 0)},
+		{name: "year", spec: "1y", location: berlin,
+			at:    date(cet, 2024, 12, 31, 23, 59),
+			start: date(cet, 2024, 1, 1, 0, 0), next: date(cet, 2025, 1, 1, 0, 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iv, err := parseInterval(test.spec, test.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := iv.start(test.at.Unix())
+			if start != test.start.Unix() {
+				t.Errorf("start %v, want %v", time.Unix(start, 0).In(test.location), test.start)
+			}
+			if next := iv.next(start); next != test.next.Unix() {
+				t.Errorf("next %v, want %v", time.Unix(next, 0).In(test.location), test.next)
+			}
+		})
+	}
+}
+
+// every timestamp lies in the period that starts at start and the periods
+// follow each other without a gap, across both changes of a year
+func TestIntervalPeriodsContiguous(t *testing.T) {
+	locations := []*time.Location{
+		time.UTC,
+		loadLocation(t, "Europe/Berlin"),
+		loadLocation(t, "Asia/Kolkata"),
+		loadLocation(t, "America/St_Johns"),
+	}
+	intervals := []string{"1m", "15m", "1h", "6h", "1d", "3d", "1w", "2w", "1mo", "3mo", "1y"}
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	for _, location := range locations {
+		for _, spec := range intervals {
+			iv, err := parseInterval(spec, location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for timestamp := from; timestamp < to; timestamp += 7919 {
+				start := iv.start(timestamp)
+				next := iv.next(start)
+				if start > timestamp || next <= timestamp {
+					t.Fatalf("%s in %s: %d not in [%d, %d)", spec, location, timestamp, start, next)
+				}
+				if iv.start(next) != next || iv.start(next-1) != start {
+					t.Fatalf("%s in %s: periods at %d and %d do not meet", spec, location, start, next)
+				}
+			}
+		}
+	}
+}
+
+func TestIntervalNestsIn(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	tests := []struct {
+		finer   string
+		coarser string
+		want    bool
+	}{
+		{"1m", "1h", true},
+		{"5m", "1h", true},
+		{"1h", "1d", true},
+		{"6h", "1d", true},
+		{"1d", "1w", true},
+		{"1d", "1mo", true},
+		{"1h", "1mo", true},
+		{"2d", "4d", true},
+		{"1w", "2w", true},
+		{"1mo", "1y", true},
+		{"4mo", "1y", true},
+		{"45m", "2h", false},
+		{"2d", "1w", false},
+		{"3d", "1mo", false},
+		{"1w", "1mo", false},
+		{"5mo", "1y", false},
+		{"1h", "1h", false},
+		{"1d", "1h", false},
+	}
+	for _, test := range tests {
+		finer, err := parseInterval(test.finer, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coarser, err := parseInterval(test.coarser, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := finer.nestsIn(coarser); got != test.want {
+			t.Errorf("%s nests in %s: got %v, want %v", test.finer, test.coarser, got, test.want)
+		}
+	}
+
+	// periods of another timezone do not line up
+	hours, _ := parseInterval("1h", time.UTC)
+	days, _ := parseInterval("1d", berlin)
+	if hours.nestsIn(days) {
+		t.Error("intervals of different timezones nest")
+	}
+}
+
+func TestSourceInterval(t *testing.T) {
+	intervals, err := parseIntervals("1m,5m,1h,3d,1d,1w,1mo,1y", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := &Engine{config: &DbConfig{intervals: intervals}}
+
+	want := map[string]string{
+		"minutes":  "",
+		"5minutes": "minutes",
+		"hours":    "5minutes",
+		"days":     "hours",
+		"3days":    "days",
+		"weeks":    "days",
+		"months":   "days",
+		"years":    "months",
+	}
+	for _, iv := range intervals {
+		got := ""
+		if source := run.sourceInterval(iv); source != nil {
+			got = source.name
+		}
+		if got != want[iv.name] {
+			t.Errorf("source of %s is %q, want %q", iv.name, got, want[iv.name])
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package nmea2mongo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../nmea"
+	"../storage"
+)
+
+// mongoStorage keeps one collection per type and one per type and interval
+// for the aggregates, named after the interval, e.g. GPRMCminutes or
+// GPRMC5minutes. All names start with the collection prefix. Each
+// document holds all records of one second:
+// {_id: timestamp, data: [record, ...], devices: [deviceid, ...]}
+// The watermarks are kept in a collection of their own:
+// {_id: "type/interval", timestamp: timestamp}
+type mongoStorage struct {
+	client           *mongo.Client
+	database         *mongo.Database
+	collectionPrefix string
+	timeout          time.Duration
+	intervalNames    map[int64]string
+}
+
+// OpenMongo sets up the client for the database of a MongoDB server. The
+// server need not be reachable yet, the driver connects in the background.
+func OpenMongo(config *DbConfig) (storage.Storage, error) {
+	opts := options.Client().
+		ApplyURI(config.uri).
+		SetConnectTimeout(config.connectTimeout).
+		SetServerSelectionTimeout(config.serverSelectionTimeout)
+
+	if config.username != "" || config.authMechanism != "" {
+		opts.SetAuth(options.Credential{
+			AuthMechanism: config.authMechanism,
+			AuthSource:    config.authSource,
+			Username:      config.username,
+			Password:      config.password,
+			PasswordSet:   config.password != "",
+		})
+	}
+	if config.usesTLS() {
+		tlsConfig, err := mongoTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.connectTimeout)
+	defer cancel()
+	if err = client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	intervalNames := make(map[int64]string)
+	for _, iv := range config.intervals {
+		intervalNames[iv.seconds] = iv.name
+	}
+	return &mongoStorage{
+		client:           client,
+		database:         client.Database(config.database),
+		collectionPrefix: config.collectionPrefix,
+		timeout:          config.operationTimeout,
+		intervalNames:    intervalNames,
+	}, nil
+}
+
+func mongoTLSConfig(config *DbConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.tlsInsecure}
+	if config.tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(config.tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(mongoFlag + ": no certificate found in " + config.tlsCAFile)
+		}
+	}
+	if config.tlsCertFile != "" {
+		keyFile := config.tlsKeyFile
+		if keyFile == "" {
+			keyFile = config.tlsCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(config.tlsCertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (ms *mongoStorage) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), ms.timeout)
+}
+
+func (ms *mongoStorage) collection(dataType string, interval int64) *mongo.Collection {
+	name := dataType
+	if interval != 0 {
+		name += ms.intervalName(interval)
+	}
+	return ms.database.Collection(ms.collectionPrefix + name)
+}
+
+// intervalName returns the collection suffix of a configured interval, other
+// intervals are named by their seconds
+func (ms *mongoStorage) intervalName(interval int64) string {
+	if name, ok := ms.intervalNames[interval]; ok {
+		return name
+	}
+	return strconv.FormatInt(interval, 10) + "seconds"
+}
+
+// collectionNames lists the collections with the prefix, without it
+func (ms *mongoStorage) collectionNames() ([]string, error) {
+	ctx, cancel := ms.context()
+	defer cancel()
+	collList, err := ms.database.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(collList))
+	for _, collName := range collList {
+		if strings.HasPrefix(collName, ms.collectionPrefix) {
+			names = append(names, strings.TrimPrefix(collName, ms.collectionPrefix))
+		}
+	}
+	return names, nil
+}
+
+// isTypeCollection tells if a collection holds the raw records of a type
+func isTypeCollection(name string) bool {
+	return name != watermarkCollection && !isAggregateCollection(name)
+}
+
+// isAggregateCollection also recognises the aggregates of intervals that are
+// no longer configured, so they are not taken for types. customInterval was
+// used by earlier versions.
+func isAggregateCollection(name string) bool {
+	if strings.HasSuffix(name, "customInterval") {
+		return true
+	}
+	for _, unit := range intervalUnits {
+		if strings.HasSuffix(name, unit.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// upsertModel adds the record of a device to the document of its second,
+// the document is created if it does not exist yet. A device that already
+// has an entry for that second does not match the filter, the upsert then
+// fails with a duplicate key, which leaves the first entry in place.
+func upsertModel(data *nmea.Data) *mongo.UpdateOneModel {
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{
+			"_id":     data.Timestamp,
+			"devices": bson.M{"$ne": data.DeviceID()},
+		}).
+		SetUpdate(bson.M{"$push": bson.M{
+			"data":    data.Data,
+			"devices": data.DeviceID(),
+		}}).
+		SetUpsert(true)
+}
+
+// WriteRecords writes the records of one collection in a single round trip.
+// Two upserts that create the document of the same second at once collide on
+// its _id, the loser fails with a duplicate key as well. Those are retried
+// once, against the document that exists by then, only a duplicate key that
+// remains means the record was written before.
+func (ms *mongoStorage) WriteRecords(dataType string, records []*nmea.Data) error {
+	models := make([]mongo.WriteModel, 0, len(records))
+	for _, data := range records {
+		models = append(models, upsertModel(data))
+	}
+
+	refused := &storage.RefusedError{Total: len(records)}
+	for retry := false; len(models) > 0; retry = true {
+		duplicates, err := ms.writeModels(dataType, models, refused)
+		if err != nil {
+			return err
+		}
+		if retry {
+			break
+		}
+		models = duplicates
+	}
+	if refused.Refused == 0 && refused.Err == nil {
+		return nil
+	}
+	return refused
+}
+
+// writeModels counts the models refused for other reasons than a duplicate
+// key and returns the duplicates
+func (ms *mongoStorage) writeModels(dataType string, models []mongo.WriteModel, refused *storage.RefusedError) ([]mongo.WriteModel, error) {
+	ctx, cancel := ms.context()
+	defer cancel()
+	coll := ms.collection(dataType, 0)
+	_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		return nil, nil
+	}
+
+	bulkErr, ok := err.(mongo.BulkWriteException)
+	if !ok {
+		return nil, err
+	}
+	duplicates := make([]mongo.WriteModel, 0)
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code == duplicateKeyCode {
+			duplicates = append(duplicates, models[writeErr.Index])
+			continue
+		}
+		refused.Refused++
+		refused.Err = writeErr
+	}
+	if bulkErr.WriteConcernError != nil {
+		refused.Err = bulkErr.WriteConcernError
+	}
+	return duplicates, nil
+}
+
+// WriteAggregates replaces the document of the period, the aggregates are
+// kept like the records of a second
+func (ms *mongoStorage) WriteAggregates(dataType string, interval int64, aggregates []*nmea.Data) error {
+	if len(aggregates) == 0 {
+		return nil
+	}
+	data := make([]nmea.DataMap, 0, len(aggregates))
+	devices := make([]int64, 0, len(aggregates))
+	for _, aggregate := range aggregates {
+		data = append(data, aggregate.Data)
+		devices = append(devices, aggregate.DeviceID())
+	}
+
+	ctx, cancel := ms.context()
+	defer cancel()
+	coll := ms.collection(dataType, interval)
+	filter := bson.M{"_id": aggregates[0].Timestamp}
+	update := bson.M{"$set": bson.M{
+		"data":    data,
+		"devices": devices,
+	}}
+	_, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (ms *mongoStorage) QueryRange(dataType string, interval int64, start int64, end int64) ([]*nmea.Data, error) {
+	ctx, cancel := ms.context()
+	defer cancel()
+	coll := ms.collection(dataType, interval)
+	filter := bson.M{"_id": bson.M{
+		"$gte": start,
+		"$lt":  end},
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	list := make([]*nmea.Data, 0)
+	for cursor.Next(ctx) {
+		var current *Result
+		if err = cursor.Decode(&current); err != nil {
+			return nil, err
+		}
+		entries := make([]*nmea.Data, 0, len(current.Data))
+		for i, value := range current.Data {
+			if i < len(current.Devices) {
+				value["deviceid"] = float64(current.Devices[i])
+			}
+			entries = append(entries, &nmea.Data{
+				Timestamp: current.Id,
+				Type:      dataType,
+				Data:      value,
+			})
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].DeviceID() < entries[j].DeviceID()
+		})
+		list = append(list, entries...)
+	}
+	return list, cursor.Err()
+}
+
+func (ms *mongoStorage) Bounds(dataType string, interval int64) (int64, int64, bool, error) {
+	ctx, cancel := ms.context()
+	defer cancel()
+	coll := ms.collection(dataType, interval)
+	var bounds [2]int64
+	for i, order := range []int{1, -1} {
+		var result *Result
+		opts := options.FindOne().SetSort(bson.M{"_id": order})
+		err := coll.FindOne(ctx, bson.M{}, opts).Decode(&result)
+		if err == mongo.ErrNoDocuments {
+			return 0, 0, false, nil
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+		bounds[i] = result.Id
+	}
+	return bounds[0], bounds[1], true, nil
+}
+
+func (ms *mongoStorage) ListTypes() ([]string, error) {
+	names, err := ms.collectionNames()
+	if err != nil {
+		return nil, err
+	}
+	types := make([]string, 0)
+	for _, name := range names {
+		if isTypeCollection(name) {
+			types = append(types, name)
+		}
+	}
+	return types, nil
+}
+
+func watermarkID(dataType string, interval int64) string {
+	return dataType + "/" + strconv.FormatInt(interval, 10)
+}
+
+func (ms *mongoStorage) Watermark(dataType string, interval int64) (int64, bool, error) {
+	ctx, cancel := ms.context()
+	defer cancel()
+	var result struct {
+		Timestamp int64 `bson:"timestamp"`
+	}
+	coll := ms.database.Collection(ms.collectionPrefix + watermarkCollection)
+	err := coll.FindOne(ctx, bson.M{"_id": watermarkID(dataType, interval)}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return result.Timestamp, true, nil
+}
+
+func (ms *mongoStorage) SetWatermark(dataType string, interval int64, timestamp int64) error {
+	ctx, cancel := ms.context()
+	defer cancel()
+	coll := ms.database.Collection(ms.collectionPrefix + watermarkCollection)
+	_, err := coll.UpdateOne(ctx,
+		bson.M{"_id": watermarkID(dataType, interval)},
+		bson.M{"$set": bson.M{"timestamp": timestamp}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func (ms *mongoStorage) DropAggregates() error {
+	names, err := ms.collectionNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !isTypeCollection(name) {
+			ctx, cancel := ms.context()
+			err = ms.database.Collection(ms.collectionPrefix + name).Drop(ctx)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *mongoStorage) Ping() error {
+	ctx, cancel := ms.context()
+	defer cancel()
+	return ms.client.Ping(ctx, readpref.Primary())
+}
+
+func (ms *mongoStorage) Close() error {
+	ctx, cancel := ms.context()
+	defer cancel()
+	return ms.client.Disconnect(ctx)
+}
@@ -1,37 +1,43 @@
 package nmea2mongo
 
 import (
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
 
 	"../Error"
 	"../nmea"
+	"../storage"
 )
 
 const (
-	minute    int64  = 60
 	hour      int64  = 3600
 	day       int64  = 86400
 	mongoFlag string = "[mongodb]"
-)
 
-type DbConfig struct {
-	username string
-	password string
-	uri      string
-	database string
-}
+	duplicateKeyCode    int    = 11000
+	watermarkCollection string = "watermarks"
+)
 
 type Engine struct {
-	config               DbConfig
-	clientOpts           *options.ClientOptions
-	client               *mongo.Client
-	database             *mongo.Database
-	errorChan            chan<- *Error.Error
-	dataChan             <-chan *nmea.Data
-	averageStopIndicator bool
-
-	collections map[string]*mongo.Collection
+	config       *DbConfig
+	storage      storage.Storage
+	errorChan    chan<- *Error.Error
+	dataChan     <-chan *nmea.Data
+	dataRunning  bool
+	dataDone     chan bool
+	stopChan     chan bool
+	writes       sync.WaitGroup
+	averages     sync.WaitGroup
+	failedWrites int64
+	spool        *spool
+	spoolDone    chan bool
+
+	// one aggregation at a time, watermarks are also lowered by writes
+	averageLock   sync.Mutex
+	watermarkLock sync.Mutex
+	watermarks    map[watermarkKey]int64
+	// aggregates of earlier versions were looked for, under averageLock
+	legacyChecked bool
 }
 
 type Result struct {
@@ -40,15 +46,12 @@ type Result struct {
 	Data    []nmea.DataMap `bson:"data"`
 }
 
-func interval2string(interval int64) string {
-	switch interval {
-	case minute:
-		return "minutes"
-	case hour:
-		return "hours"
-	case day:
-		return "days"
-	default:
-		return "customInterval"
+// waitFor returns false if done was not closed before the deadline
+func waitFor(done <-chan bool, deadline time.Time) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
 	}
 }
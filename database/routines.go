@@ -1,35 +1,62 @@
 package nmea2mongo
 
 import (
-	"context"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"math"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"../Error"
 	"../nmea"
+	"../storage"
 )
 
-func New(ch <-chan *nmea.Data, errCh chan<- *Error.Error) *Engine {
-	config := DbConfig{
-		username: "",
-		password: "",
-		uri:      "mongodb://boatpi:27017",
-		database: "NMEA0183",
+// New starts the engine on a MongoDB server, config may be nil for the
+// defaults. The engine is returned even if the server is not reachable yet:
+// it connects in the background and spools the records meanwhile.
+func New(ch <-chan *nmea.Data, errCh chan<- *Error.Error, config *DbConfig) *Engine {
+	if config == nil {
+		config = defaultConfig()
+	}
+	conn := &connection{}
+	run := NewWithStorage(ch, errCh, conn, config)
+	if run == nil {
+		return nil
 	}
 
+	open := func() (storage.Storage, error) {
+		return OpenMongo(config)
+	}
+	store, err := open()
+	if err != nil {
+		run.errorChan <- Error.New(Error.Warning,
+			"cannot connect to "+config.redactedURI()+", retrying in the background: "+err.Error(),
+			mongoFlag)
+		go run.connectRoutine(conn, open)
+		return run
+	}
+	conn.set(store)
+	run.errorChan <- Error.New(Error.Debug,
+		"engine started on "+config.redactedURI(),
+		mongoFlag)
+	return run
+}
+
+// NewWithStorage runs the engine on any storage backend, config may be nil
+// for the defaults
+func NewWithStorage(ch <-chan *nmea.Data, errCh chan<- *Error.Error, store storage.Storage, config *DbConfig) *Engine {
+	if config == nil {
+		config = defaultConfig()
+	}
 	conn := &Engine{
-		config:     config,
-		clientOpts: options.Client().ApplyURI(config.uri),
-		client:     nil,
-		database:   nil,
-		errorChan:  errCh,
-		dataChan:   ch,
+		config:    config,
+		storage:   store,
+		errorChan: errCh,
+		dataChan:  ch,
+		dataDone:  make(chan bool),
+		stopChan:  make(chan bool),
+		spoolDone: make(chan bool),
+
+		watermarks: make(map[watermarkKey]int64),
 	}
 
 	if conn.errorChan == nil {
@@ -41,44 +68,44 @@ func New(ch <-chan *nmea.Data, errCh chan<- *Error.Error) *Engine {
 			mongoFlag)
 	}
 
-	client, err := mongo.NewClient(conn.clientOpts)
-	if err != nil {
-		conn.errorChan <- Error.Err(Error.High, err, mongoFlag)
-		return nil
+	if config.spoolPath == "" {
+		conn.errorChan <- Error.New(Error.Info,
+			"spool off, records are lost while the database is unreachable unless "+ParamSpoolPath+" is set",
+			mongoFlag)
+		return conn
 	}
-	conn.client = client
-	err = conn.client.Connect(context.Background())
+	sp, err := newSpool(config.spoolPath, config.spoolMaxBytes, config.spoolSegmentBytes)
 	if err != nil {
-		conn.errorChan <- Error.Err(Error.High, err, mongoFlag)
-		return nil
-	}
-
-	if !conn.Ping() {
-		return nil
+		conn.errorChan <- Error.New(Error.High,
+			"spool disabled, records are lost while the database is unreachable: "+err.Error(),
+			mongoFlag)
+	} else {
+		conn.spool = sp
 	}
-
-	conn.database = conn.client.Database(config.database)
-	conn.errorChan <- Error.New(Error.Debug,
-		"engine connected to "+config.uri,
-		mongoFlag)
-
 	return conn
 }
 
+// Run starts writing records, they are spooled while the database is not
+// reachable
 func (run *Engine) Run(calculateAverages ...bool) bool {
-	if !run.Ping() {
-		return false
+	if err := run.storage.Ping(); err != nil {
+		run.errorChan <- Error.New(Error.Warning,
+			"database not reachable yet: "+err.Error(),
+			mongoFlag)
 	}
+	run.dataRunning = true
 	go run.dataRoutine()
+	go run.spoolRoutine()
 	if len(calculateAverages) > 0 && calculateAverages[0] {
+		run.averages.Add(1)
 		go run.averageRoutine()
 	}
-	return false
+	return true
 }
 
-//TODO include complete state validation
+// TODO include complete state validation
 func (run *Engine) Ping() bool {
-	err := run.client.Ping(context.Background(), readpref.Primary())
+	err := run.storage.Ping()
 	if err != nil {
 		run.errorChan <- Error.Err(Error.High, err, mongoFlag)
 		return false
@@ -86,145 +113,232 @@ func (run *Engine) Ping() bool {
 	return true
 }
 
-//TODO
-func (run *Engine) Stop() {
-	err := run.client.Disconnect(context.Background())
-	if err != nil {
-		run.errorChan <- Error.Err(Error.Debug, err, mongoFlag)
+// Stop ends the average calculation and waits until the data channel has
+// been closed by its sender and every record in it was written. It returns
+// false if records were lost, either because the timeout passed or because
+// writes failed.
+func (run *Engine) Stop(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	lost := false
+	close(run.stopChan)
+
+	if !run.dataRunning {
+		if buffered := len(run.dataChan); buffered > 0 {
+			run.errorChan <- Error.New(Error.High,
+				"data routine not running: "+strconv.Itoa(buffered)+" buffered records lost",
+				mongoFlag)
+			lost = true
+		}
+	} else if !waitFor(run.dataDone, deadline) {
+		run.errorChan <- Error.New(Error.High,
+			"timeout while draining data channel: "+
+				strconv.Itoa(len(run.dataChan))+" buffered records lost",
+			mongoFlag)
+		lost = true
 	}
 
-}
+	averagesDone := make(chan bool)
+	go func() {
+		run.averages.Wait()
+		close(averagesDone)
+	}()
+	if !waitFor(averagesDone, deadline) {
+		run.errorChan <- Error.New(Error.Warning,
+			"timeout while waiting for average calculation",
+			mongoFlag)
+	}
 
-func (run *Engine) RecalculateAverage() {
-	run.errorChan <- Error.New(Error.Debug,
-		"recalculating averages: please wait",
-		mongoFlag)
+	if run.dataRunning && !waitFor(run.spoolDone, deadline) {
+		run.errorChan <- Error.New(Error.Warning,
+			"timeout while replaying the spool",
+			mongoFlag)
+	}
+	if run.spool != nil {
+		if err := run.spool.close(); err != nil {
+			run.errorChan <- Error.Err(Error.High, err, mongoFlag)
+		}
+		stats := run.spool.stats()
+		run.errorChan <- Error.New(Error.Info, "spool: "+stats.String(), mongoFlag)
+		if stats.Dropped > 0 {
+			lost = true
+		}
+	}
 
-	if err := run.pingAsError(); err != nil {
-		run.errorChan <- err
-		return
+	if failed := atomic.LoadInt64(&run.failedWrites); failed > 0 {
+		run.errorChan <- Error.New(Error.High,
+			strconv.FormatInt(failed, 10)+" records could not be written",
+			mongoFlag)
+		lost = true
 	}
 
-	collList, err := run.database.ListCollectionNames(context.TODO(), bson.M{})
+	err := run.storage.Close()
 	if err != nil {
 		run.errorChan <- Error.Err(Error.Debug, err, mongoFlag)
-		return
 	}
-
-	for _, collName := range collList {
-		if strings.Contains(collName, "minutes") ||
-			strings.Contains(collName, "hours") ||
-			strings.Contains(collName, "days") {
-			err = run.database.Collection(collName).Drop(context.TODO())
-			if err != nil {
-				run.errorChan <- Error.Err(Error.Debug, err, mongoFlag)
-			}
-		}
-	}
-
-	go run.averageWorkDispatcher()
+	return !lost
 }
 
+// dataRoutine collects the records per collection and flushes them in
+// batches. A collection is flushed by one write at a time, so its batches do
+// not race for the documents of the same seconds and are written in order.
+// If all flushes are busy it stops reading, so the data channel fills up and
+// holds back its sender instead of piling up goroutines.
 func (run *Engine) dataRoutine() {
 	run.errorChan <- Error.New(Error.Debug,
 		"data routine started",
 		mongoFlag)
 
-	for data := range run.dataChan {
-		go run.write(data, data.Type)
+	batches := make(map[string][]*nmea.Data)
+	flushSlots := make(chan bool, run.config.maxFlushes)
+	collectionSlots := make(map[string]chan bool)
+	ticker := time.NewTicker(run.config.batchInterval)
+	defer ticker.Stop()
+
+	flush := func(collection string) {
+		records := batches[collection]
+		delete(batches, collection)
+		if len(records) == 0 {
+			return
+		}
+		collectionSlot, ok := collectionSlots[collection]
+		if !ok {
+			collectionSlot = make(chan bool, 1)
+			collectionSlots[collection] = collectionSlot
+		}
+		collectionSlot <- true
+		flushSlots <- true
+		run.writes.Add(1)
+		go func() {
+			defer run.writes.Done()
+			defer func() { <-collectionSlot }()
+			defer func() { <-flushSlots }()
+			run.store(collection, records)
+		}()
 	}
-}
 
-func (run *Engine) averageRoutine() {
-	minuteTicker := time.NewTicker(time.Minute)
-	defer minuteTicker.Stop()
-	run.averageWorkDispatcher()
-
-	for !run.averageStopIndicator {
+	for running := true; running; {
 		select {
-		case <-minuteTicker.C:
-			go run.averageWorkDispatcher()
+		case data, ok := <-run.dataChan:
+			if !ok {
+				running = false
+				break
+			}
+			batches[data.Type] = append(batches[data.Type], data)
+			if len(batches[data.Type]) >= run.config.batchSize {
+				flush(data.Type)
+			}
+		case <-ticker.C:
+			for collection := range batches {
+				flush(collection)
+			}
 		}
 	}
-}
 
-func (run *Engine) averageWorkDispatcher() {
-	if err := run.pingAsError(); err != nil {
-		run.errorChan <- err
-		return
+	// the sender closed the channel, flush the rest and wait for all writes
+	for collection := range batches {
+		flush(collection)
 	}
+	run.writes.Wait()
+	close(run.dataDone)
+	run.errorChan <- Error.New(Error.Debug,
+		"data routine finished",
+		mongoFlag)
+}
 
-	nmeaTypes := make([]string, 0)
-	collList, err := run.database.ListCollectionNames(context.TODO(), bson.M{})
-	if err != nil {
-		run.errorChan <- Error.Err(Error.Debug, err, mongoFlag)
+// store writes the records of one collection. They are spooled instead while
+// older records wait in the spool or if the database is unreachable.
+func (run *Engine) store(collection string, records []*nmea.Data) {
+	if run.spool != nil && run.spool.pending() {
+		run.spoolRecords(records)
 		return
 	}
 
-	for _, collName := range collList {
-		if !strings.Contains(collName, "minutes") &&
-			!strings.Contains(collName, "hours") &&
-			!strings.Contains(collName, "days") {
-			nmeaTypes = append(nmeaTypes, collName)
+	failed, err := run.writeRecords(collection, records)
+	if err != nil {
+		if run.spool != nil {
+			run.errorChan <- Error.New(Error.Warning,
+				"database unreachable, spooling records to "+run.config.spoolPath+": "+err.Error(),
+				mongoFlag)
+			run.spoolRecords(records)
+			return
 		}
+		run.errorChan <- Error.Err(Error.Low, err, mongoFlag)
+		failed = len(records)
 	}
-
-	for _, nmeaType := range nmeaTypes {
-		run.averageWorker(nmeaType)
+	if failed > 0 {
+		atomic.AddInt64(&run.failedWrites, int64(failed))
 	}
+}
 
+func (run *Engine) spoolRecords(records []*nmea.Data) {
+	if err := run.spool.append(records); err != nil {
+		run.errorChan <- Error.New(Error.High,
+			"records dropped from spool: "+err.Error(),
+			mongoFlag)
+	}
 }
 
-func (run *Engine) averageWorker(nmeaType string) {
-
-	startTime := time.Now()
-	todo := make([]int64, 0)
-	intervalList := []int64{60, 3600, 86400}
-	for _, interval := range intervalList {
-		// just do last entry if collection exists
-		if run.collectionExists(nmeaType + interval2string(minute)) {
-			run.writeAverage(
-				nmeaType,
-				run.readLastSecond(nmeaType, interval),
-				interval)
-		} else {
-			todo = append(todo, interval)
-		}
+// spoolRoutine replays the spool once the database answers again
+func (run *Engine) spoolRoutine() {
+	defer close(run.spoolDone)
+	if run.spool == nil {
+		return
 	}
+	ticker := time.NewTicker(run.config.spoolRetry)
+	defer ticker.Stop()
 
-	if len(todo) > 0 {
-		start := int64(math.MaxInt64)
-		end := int64(math.MinInt64)
-		for _, interval := range intervalList {
-			startTemp := run.readLastSecond(nmeaType, interval, true)
-			endTemp := run.readLastSecond(nmeaType, interval)
-			if startTemp < start {
-				start = startTemp
+	for {
+		select {
+		case <-ticker.C:
+			if !run.spool.pending() || run.storage.Ping() != nil {
+				continue
 			}
-			if endTemp > end {
-				end = endTemp
+			err := run.spool.replay(run.replayRecords)
+			if err != nil {
+				run.errorChan <- Error.New(Error.Warning,
+					"spool replay interrupted: "+err.Error(),
+					mongoFlag)
+			} else {
+				run.errorChan <- Error.New(Error.Info,
+					"spool replayed: "+run.spool.stats().String(),
+					mongoFlag)
 			}
+		case <-run.stopChan:
+			return
 		}
+	}
+}
 
-		run.errorChan <- Error.New(Error.Debug,
-			"recalculating "+nmeaType+"\n"+
-				"start: "+time.Unix(start, 0).String()+"\n"+
-				"end:   "+time.Unix(end, 0).String(),
-			mongoFlag)
+// replayRecords writes spooled records in batches per collection, an error
+// means the database became unreachable again
+func (run *Engine) replayRecords(records []*nmea.Data) (int, error) {
+	collections := make(map[string][]*nmea.Data)
+	for _, data := range records {
+		collections[data.Type] = append(collections[data.Type], data)
+	}
 
-		//TODO improve search
-		for i := start; i <= end; i += minute {
-			for _, interval := range todo {
-				if i%interval == 0 {
-					run.writeAverage(nmeaType, i, interval)
-				}
+	failed := 0
+	for collection, list := range collections {
+		for start := 0; start < len(list); start += run.config.batchSize {
+			end := start + run.config.batchSize
+			if end > len(list) {
+				end = len(list)
 			}
+			batchFailed, err := run.writeRecords(collection, list[start:end])
+			if err != nil {
+				return 0, err
+			}
+			failed += batchFailed
 		}
 	}
+	return failed, nil
+}
 
-	run.errorChan <- Error.New(Error.Debug,
-		"finished calculating "+nmeaType+
-			" in "+strconv.FormatFloat(time.Since(startTime).Seconds(), 'f', 3, 64)+"s",
-		mongoFlag)
-
+func (run *Engine) isStopping() bool {
+	select {
+	case <-run.stopChan:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,102 @@
+package nmea2mongo
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"../storage"
+	"../storage/sqlite"
+)
+
+// flushStorage records how many writes of each collection run at a time
+type flushStorage struct {
+	storage.Storage
+	lock     sync.Mutex
+	running  map[string]int
+	total    int
+	maxPer   int
+	maxTotal int
+}
+
+func (s *flushStorage) WriteRecords(dataType string, records []*nmea.Data) error {
+	s.lock.Lock()
+	s.running[dataType]++
+	s.total++
+	if s.running[dataType] > s.maxPer {
+		s.maxPer = s.running[dataType]
+	}
+	if s.total > s.maxTotal {
+		s.maxTotal = s.total
+	}
+	s.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	err := s.Storage.WriteRecords(dataType, records)
+
+	s.lock.Lock()
+	s.running[dataType]--
+	s.total--
+	s.lock.Unlock()
+	return err
+}
+
+// a collection is flushed by one write at a time, different collections are
+// flushed in parallel
+func TestFlushPerCollection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flush.db")
+	sqliteStore, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &flushStorage{Storage: sqliteStore, running: map[string]int{}}
+	config, err := NewConfig(map[string]string{
+		ParamBatchSize:  "2",
+		ParamMaxFlushes: "4",
+		ParamSpoolPath:  "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorChan := make(chan *Error.Error)
+	go func() {
+		for range errorChan {
+		}
+	}()
+	dataChan := make(chan *nmea.Data)
+	run := NewWithStorage(dataChan, errorChan, store, config)
+	run.Run()
+
+	types := []string{"MTW", "XDR"}
+	for second := int64(0); second < 10; second++ {
+		for _, dataType := range types {
+			data := nmea.NewSensorData(dataType, 1, nmea.DataMap{"value": float64(second)})
+			data.Timestamp = 1000 + second
+			dataChan <- data
+		}
+	}
+	close(dataChan)
+	if !run.Stop(5 * time.Second) {
+		t.Error("records lost")
+	}
+
+	if store.maxPer != 1 || store.maxTotal != len(types) {
+		t.Errorf("%d writes of a collection and %d in total at a time, want 1 and %d",
+			store.maxPer, store.maxTotal, len(types))
+	}
+
+	// Stop closed the storage
+	written, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	for _, dataType := range types {
+		if records, err := written.QueryRange(dataType, 0, 0, 2000); err != nil || len(records) != 10 {
+			t.Errorf("%s: %d records written, error %v", dataType, len(records), err)
+		}
+	}
+}
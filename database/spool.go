@@ -0,0 +1,322 @@
+package nmea2mongo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../nmea"
+)
+
+const (
+	spoolSuffix string = ".spool"
+)
+
+// spool keeps records on disk while the database is unreachable. Records are
+// appended as json lines to segment files, which are replayed and removed
+// oldest first. If the spool is full the oldest segment is dropped.
+type spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mutex    sync.Mutex
+	segments []*spoolSegment
+	current  *os.File
+	// segment that is being replayed, it must not be dropped meanwhile
+	replaying *spoolSegment
+	nextSeq   uint64
+	size      int64
+	records   int64
+
+	spooled  int64
+	replayed int64
+	dropped  int64
+}
+
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	records int64
+}
+
+type SpoolStats struct {
+	Spooled  int64
+	Replayed int64
+	Dropped  int64
+	Pending  int64
+}
+
+func (s SpoolStats) String() string {
+	return strconv.FormatInt(s.Spooled, 10) + " spooled, " +
+		strconv.FormatInt(s.Replayed, 10) + " replayed, " +
+		strconv.FormatInt(s.Dropped, 10) + " dropped, " +
+		strconv.FormatInt(s.Pending, 10) + " pending"
+}
+
+// newSpool opens the spool in dir, segments left over from a previous run
+// are kept for replay
+func newSpool(dir string, maxBytes int64, segmentBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		segments:     make([]*spoolSegment, 0),
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		lines, err := countLines(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		sp.segments = append(sp.segments, &spoolSegment{seq: seq, size: file.Size(), records: lines})
+		sp.size += file.Size()
+		sp.records += lines
+		if seq >= sp.nextSeq {
+			sp.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(sp.segments, func(i, j int) bool {
+		return sp.segments[i].seq < sp.segments[j].seq
+	})
+	return sp, nil
+}
+
+func (sp *spool) segmentPath(seq uint64) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// pending is true as long as records wait for replay, new records have to
+// be spooled behind them to keep the order
+func (sp *spool) pending() bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return sp.records > 0
+}
+
+func (sp *spool) stats() SpoolStats {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return SpoolStats{
+		Spooled:  sp.spooled,
+		Replayed: sp.replayed,
+		Dropped:  sp.dropped,
+		Pending:  sp.records,
+	}
+}
+
+// append writes records to the current segment and syncs it. Records that
+// can not be encoded or do not fit are dropped and counted.
+func (sp *spool) append(records []*nmea.Data) error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	var lastErr error
+	for _, data := range records {
+		line, err := json.Marshal(data)
+		if err != nil {
+			sp.dropped++
+			lastErr = err
+			continue
+		}
+		line = append(line, '\n')
+		length := int64(len(line))
+
+		for sp.size+length > sp.maxBytes && sp.dropOldest() {
+		}
+		if sp.size+length > sp.maxBytes {
+			sp.dropped++
+			lastErr = errors.New("spool full")
+			continue
+		}
+
+		segment, err := sp.currentSegment()
+		if err != nil {
+			sp.dropped++
+			lastErr = err
+			continue
+		}
+		if _, err = sp.current.Write(line); err != nil {
+			sp.dropped++
+			lastErr = err
+			continue
+		}
+		segment.size += length
+		segment.records++
+		sp.size += length
+		sp.records++
+		sp.spooled++
+	}
+
+	if sp.current != nil {
+		if err := sp.current.Sync(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// currentSegment returns the segment records are appended to, it starts a
+// new one if there is none or the current one is full
+func (sp *spool) currentSegment() (*spoolSegment, error) {
+	if sp.current != nil {
+		segment := sp.segments[len(sp.segments)-1]
+		if segment.size < sp.segmentBytes {
+			return segment, nil
+		}
+		sp.rotate()
+	}
+
+	seq := sp.nextSeq
+	file, err := os.OpenFile(sp.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sp.nextSeq++
+	sp.current = file
+	segment := &spoolSegment{seq: seq}
+	sp.segments = append(sp.segments, segment)
+	return segment, nil
+}
+
+// rotate closes the current segment, the next record starts a new one
+func (sp *spool) rotate() {
+	if sp.current == nil {
+		return
+	}
+	sp.current.Close()
+	sp.current = nil
+}
+
+// dropOldest removes the oldest closed segment to make room, it returns false
+// if there is none
+func (sp *spool) dropOldest() bool {
+	closed := len(sp.segments)
+	if sp.current != nil {
+		closed--
+	}
+	if closed <= 0 || sp.segments[0] == sp.replaying {
+		return false
+	}
+	sp.remove(sp.segments[0])
+	sp.dropped += sp.segments[0].records
+	sp.segments = sp.segments[1:]
+	return true
+}
+
+func (sp *spool) remove(segment *spoolSegment) {
+	os.Remove(sp.segmentPath(segment.seq))
+	sp.size -= segment.size
+	sp.records -= segment.records
+}
+
+// replay hands the spooled records to write segment by segment, oldest
+// first. A segment is removed once write succeeded, replay stops at the first
+// error and leaves the segment for the next attempt.
+func (sp *spool) replay(write func(records []*nmea.Data) (failed int, err error)) error {
+	for {
+		sp.mutex.Lock()
+		if len(sp.segments) == 0 {
+			sp.mutex.Unlock()
+			return nil
+		}
+		segment := sp.segments[0]
+		if len(sp.segments) == 1 {
+			sp.rotate()
+		}
+		sp.replaying = segment
+		sp.mutex.Unlock()
+
+		records, corrupt, err := readSegment(sp.segmentPath(segment.seq))
+		failed := 0
+		if err == nil {
+			failed, err = write(records)
+		}
+
+		sp.mutex.Lock()
+		sp.replaying = nil
+		if err != nil {
+			sp.mutex.Unlock()
+			return err
+		}
+		sp.remove(segment)
+		sp.segments = sp.segments[1:]
+		sp.replayed += int64(len(records) - failed)
+		sp.dropped += int64(failed + corrupt)
+		sp.mutex.Unlock()
+	}
+}
+
+func (sp *spool) close() error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.current == nil {
+		return nil
+	}
+	err := sp.current.Close()
+	sp.current = nil
+	return err
+}
+
+// readSegment decodes a segment, lines that can not be decoded, like a line
+// cut off by a power loss, are skipped and counted
+func readSegment(path string) ([]*nmea.Data, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	records := make([]*nmea.Data, 0)
+	corrupt := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var data nmea.Data
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			corrupt++
+			continue
+		}
+		records = append(records, &data)
+	}
+	return records, corrupt, scanner.Err()
+}
+
+func countLines(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var lines int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,165 @@
+package nmea2mongo
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"../nmea"
+)
+
+// spoolRecords returns count records with consecutive timestamps, all of the
+// same length when spooled
+func spoolRecords(from int64, count int64) []*nmea.Data {
+	records := make([]*nmea.Data, 0, count)
+	for timestamp := from; timestamp < from+count; timestamp++ {
+		records = append(records, &nmea.Data{
+			Timestamp: timestamp,
+			Type:      "RMC",
+			Data:      nmea.DataMap{"deviceid": 65536, "speed": float64(timestamp % 10)},
+		})
+	}
+	return records
+}
+
+func TestSpoolReplay(t *testing.T) {
+	line, err := json.Marshal(spoolRecords(1000, 1)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := int64(len(line) + 1)
+
+	tests := []struct {
+		name string
+		// sizes in records
+		maxRecords     int64
+		segmentRecords int64
+		batches        []int64
+		// the spool is closed and opened again before this batch, zero if not
+		reopen int
+		// a line cut off by a power loss is left before reopening
+		cutOff   bool
+		segments int
+		// the replayed records start at this timestamp
+		first int64
+		want  SpoolStats
+	}{
+		{name: "one segment", maxRecords: 100, segmentRecords: 100, batches: []int64{3, 4}, segments: 1,
+			first: 1000, want: SpoolStats{Spooled: 7, Replayed: 7}},
+		{name: "segment per record", maxRecords: 100, segmentRecords: 1, batches: []int64{3, 4}, segments: 7,
+			first: 1000, want: SpoolStats{Spooled: 7, Replayed: 7}},
+		{name: "segments of three", maxRecords: 100, segmentRecords: 3, batches: []int64{5, 2, 3}, segments: 4,
+			first: 1000, want: SpoolStats{Spooled: 10, Replayed: 10}},
+		{name: "full spool drops the oldest segment", maxRecords: 6, segmentRecords: 2, batches: []int64{10},
+			segments: 3, first: 1004, want: SpoolStats{Spooled: 10, Replayed: 6, Dropped: 4}},
+		{name: "previous run first", maxRecords: 100, segmentRecords: 2, batches: []int64{5, 3}, reopen: 1,
+			segments: 5, first: 1000, want: SpoolStats{Spooled: 3, Replayed: 8}},
+		{name: "cut off line", maxRecords: 100, segmentRecords: 100, batches: []int64{2}, reopen: 1, cutOff: true,
+			segments: 1, first: 1000, want: SpoolStats{Replayed: 2, Dropped: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sp, err := newSpool(dir, test.maxRecords*length, test.segmentRecords*length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			timestamp := int64(1000)
+			for i := 0; i <= len(test.batches); i++ {
+				if i > 0 && i == test.reopen {
+					if err := sp.close(); err != nil {
+						t.Fatal(err)
+					}
+					if test.cutOff {
+						file, err := os.OpenFile(sp.segmentPath(sp.nextSeq-1), os.O_WRONLY|os.O_APPEND, 0644)
+						if err != nil {
+							t.Fatal(err)
+						}
+						file.WriteString(`{"Timestamp":1002,"Type":"RM`)
+						file.Close()
+					}
+					if sp, err = newSpool(dir, test.maxRecords*length, test.segmentRecords*length); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if i == len(test.batches) {
+					break
+				}
+				if err := sp.append(spoolRecords(timestamp, test.batches[i])); err != nil {
+					t.Fatal(err)
+				}
+				timestamp += test.batches[i]
+			}
+			if files, _ := ioutil.ReadDir(dir); len(files) != test.segments {
+				t.Errorf("%d segment files, want %d", len(files), test.segments)
+			}
+
+			var replayed []*nmea.Data
+			err = sp.replay(func(records []*nmea.Data) (int, error) {
+				replayed = append(replayed, records...)
+				return 0, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := spoolRecords(test.first, timestamp-test.first); !reflect.DeepEqual(replayed, want) {
+				t.Errorf("replayed %d records, want %d from %d in order", len(replayed), len(want), test.first)
+			}
+			if stats := sp.stats(); stats != test.want {
+				t.Errorf("stats %s, want %s", stats, test.want)
+			}
+			if files, _ := ioutil.ReadDir(dir); sp.pending() || len(files) != 0 {
+				t.Error("records left after the replay")
+			}
+		})
+	}
+}
+
+// a failed write keeps the segment for the next attempt, records the storage
+// refused are counted as dropped
+func TestSpoolReplayFailure(t *testing.T) {
+	line, err := json.Marshal(spoolRecords(1000, 1)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := newSpool(t.TempDir(), 100*int64(len(line)+1), 3*int64(len(line)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.append(spoolRecords(1000, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	err = sp.replay(func(records []*nmea.Data) (int, error) {
+		calls++
+		if calls == 2 {
+			return 0, errors.New("not reachable")
+		}
+		return 0, nil
+	})
+	if err == nil || calls != 2 {
+		t.Fatalf("error %v after %d writes", err, calls)
+	}
+	if stats := sp.stats(); stats != (SpoolStats{Spooled: 6, Replayed: 3, Pending: 3}) {
+		t.Errorf("stats %s after a failed write", stats)
+	}
+
+	var replayed []*nmea.Data
+	err = sp.replay(func(records []*nmea.Data) (int, error) {
+		replayed = append(replayed, records...)
+		return 1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed, spoolRecords(1003, 3)) {
+		t.Errorf("replayed %d records, want the second segment", len(replayed))
+	}
+	if stats := sp.stats(); stats != (SpoolStats{Spooled: 6, Replayed: 5, Dropped: 1}) {
+		t.Errorf("stats %s", stats)
+	}
+}
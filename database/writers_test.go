@@ -0,0 +1,46 @@
+package nmea2mongo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"testing"
+
+	"../nmea"
+)
+
+func TestUpsertModel(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   *nmea.Data
+		filter bson.M
+		update bson.M
+	}{
+		{name: "sensor",
+			data:   &nmea.Data{Timestamp: 1000, Type: "INA226", Data: nmea.DataMap{"deviceid": 64, "voltage": 12.6}},
+			filter: bson.M{"_id": int64(1000), "devices": bson.M{"$ne": int64(64)}},
+			update: bson.M{"$push": bson.M{"data": nmea.DataMap{"deviceid": 64, "voltage": 12.6}, "devices": int64(64)}}},
+		{name: "serial device",
+			data:   &nmea.Data{Timestamp: 1001, Type: "GPRMC", Data: nmea.DataMap{"deviceid": 65536, "sog": 5.2}},
+			filter: bson.M{"_id": int64(1001), "devices": bson.M{"$ne": int64(65536)}},
+			update: bson.M{"$push": bson.M{"data": nmea.DataMap{"deviceid": 65536, "sog": 5.2}, "devices": int64(65536)}}},
+		{name: "no device id",
+			data:   &nmea.Data{Timestamp: 1002, Type: "GPRMC", Data: nmea.DataMap{"sog": 5.2}},
+			filter: bson.M{"_id": int64(1002), "devices": bson.M{"$ne": int64(0)}},
+			update: bson.M{"$push": bson.M{"data": nmea.DataMap{"sog": 5.2}, "devices": int64(0)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := upsertModel(test.data)
+			if !reflect.DeepEqual(model.Filter, test.filter) {
+				t.Errorf("filter %v, want %v", model.Filter, test.filter)
+			}
+			if !reflect.DeepEqual(model.Update, test.update) {
+				t.Errorf("update %v, want %v", model.Update, test.update)
+			}
+			// without upsert the first record of a second would be lost
+			if model.Upsert == nil || !*model.Upsert {
+				t.Error("not an upsert")
+			}
+		})
+	}
+}
@@ -1,11 +1,33 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"./Error"
 	"./database"
 	"./nmea"
+	"./output"
 	"./sensors"
 	sensorCfg "./sensors/config"
+	"./storage/sqlite"
+)
+
+const (
+	shutdownTimeout = 10 * time.Second
+
+	storageMongo  = "mongodb"
+	storageSqlite = "sqlite"
+
+	rebuildAll = "all"
 )
 
 //TODO config files
@@ -13,7 +35,7 @@ type mainConfig struct {
 	I2cBus           string ""
 	SensorConfigPath string ""
 	toMongo          bool
-	Db               nmea2mongo.DbConfig
+	Db               *nmea2mongo.DbConfig
 	toSerial         bool
 	serialPath       string
 	toConsole        bool
@@ -24,61 +46,358 @@ type ChannelList struct {
 	In         chan *nmea.Data
 	MongoDb    chan *nmea.Data
 	SerialPort chan *nmea.Data
+	Signal     chan os.Signal
 
-	StopI2c       chan bool
-	StopSerialIn  chan bool
-	StopSerialOut chan bool
-	StopMongoDb   chan bool
-	StopConsole   chan bool
+	StopDispatcher chan bool
+	DispatcherDone chan bool
+	StopConsole    chan bool
+	ConsoleDone    chan bool
 }
 
 func main() {
+	scan := flag.Bool("scan", false, "probe all i2c buses and print configuration entries for the devices found")
+	scanOutput := flag.String("scan-output", "", "write the configuration entries of -scan to this file")
+	storageType := flag.String("storage", storageMongo, "where records are kept: "+storageMongo+" or "+storageSqlite)
+	sqlitePath := flag.String("sqlite", "nmealogger.db", "database file of the "+storageSqlite+" storage")
+	influxURL := flag.String("influx", "", "base url of an influxdb server to forward records to")
+	influxDb := flag.String("influx-db", "nmea", "database on an influxdb 1.x server")
+	influxOrg := flag.String("influx-org", "", "organisation on an influxdb 2.x server")
+	influxBucket := flag.String("influx-bucket", "", "bucket on an influxdb 2.x server, selects the 2.x api")
+	influxToken := flag.String("influx-token", "", "api token of an influxdb 2.x server")
+	prometheusURL := flag.String("prometheus", "", "prometheus remote write url to forward records to")
+	calibrationPath := flag.String("calibration", "calibration.conf", "file the sensor calibrations are stored in and restored from")
+	dbConfigPath := flag.String("db-config", "", "file with the database connection config, key = value per line")
+	rebuild := flag.String("rebuild", "", "rebuild the aggregates of a type, or of all types with "+rebuildAll+", and exit")
+	rebuildFrom := flag.String("rebuild-from", "", "start of the range to -rebuild, date or RFC 3339 time (default: first record)")
+	rebuildTo := flag.String("rebuild-to", "", "end of the range to -rebuild, date or RFC 3339 time (default: last record)")
+	flag.Parse()
+	if *scan {
+		os.Exit(scanI2C(*scanOutput))
+	}
+	dbConfig, err := readDbConfig(*dbConfigPath)
+	if err != nil {
+		println(err.Error())
+		os.Exit(2)
+	}
+	if *rebuild != "" {
+		os.Exit(rebuildAggregates(*storageType, *sqlitePath, dbConfig, *rebuild, *rebuildFrom, *rebuildTo))
+	}
+
 	channels := &ChannelList{
-		Error:         make(chan *Error.Error, 128),
-		In:            make(chan *nmea.Data),
-		MongoDb:       make(chan *nmea.Data, 1024),
-		SerialPort:    nil, //make(chan nmea.Raw, 1024),
-		StopI2c:       make(chan bool, 1),
-		StopSerialIn:  make(chan bool, 1),
-		StopSerialOut: nil, //make(chan bool, 1),
-		StopMongoDb:   make(chan bool, 1),
-		StopConsole:   make(chan bool, 1),
+		Error:          make(chan *Error.Error, 128),
+		In:             make(chan *nmea.Data),
+		MongoDb:        make(chan *nmea.Data, 1024),
+		SerialPort:     nil, //make(chan nmea.Raw, 1024),
+		Signal:         make(chan os.Signal, 1),
+		StopDispatcher: make(chan bool, 1),
+		DispatcherDone: make(chan bool),
+		StopConsole:    make(chan bool, 1),
+		ConsoleDone:    make(chan bool),
 	}
+	signal.Notify(channels.Signal, syscall.SIGINT, syscall.SIGTERM)
 
-	go nmeaDispatcher(channels)
+	go errorConsole(channels)
+	outputs := openOutputs(channels, output.InfluxConfig{
+		URL:      *influxURL,
+		Database: *influxDb,
+		Org:      *influxOrg,
+		Bucket:   *influxBucket,
+		Token:    *influxToken,
+	}, *prometheusURL)
 
-	mongoDb := nmea2mongo.New(channels.MongoDb, channels.Error)
-	mongoDb.RecalculateAverage()
-	mongoDb.Run(false)
+	mongoDb := openDatabase(*storageType, *sqlitePath, dbConfig, channels)
+	if mongoDb != nil {
+		mongoDb.Run(true)
+	}
+	go nmeaDispatcher(channels, outputs, mongoDb != nil)
 
 	sensorEng := sensors.NewEngine(channels.In, channels.Error)
+	sensorEng.SetCalibrationStore(sensors.NewCalibrationFile(*calibrationPath))
 	configGPS := sensorCfg.DefaultSerial()
 	configBmxx80 := sensorCfg.DefaultI2C()
 	sensorEng.Connect(configGPS)
 	sensorEng.Connect(configBmxx80)
 
-	for err := range channels.Error {
-		switch err.Lvl {
-		case Error.Debug:
-			println("[DEBUG] " + err.Text)
-		case Error.Info:
-			println("[INFO]  " + err.Text)
-		case Error.Warning:
-			println("[WARN]  " + err.Text)
-		case Error.Low:
-			println("[LOW]   " + err.Text)
-		case Error.High:
-			println("[HIGH]  " + err.Text)
-		case Error.Fatal:
-			println("[FATAL] " + err.Text)
-		default:
-			println("[UNKWN] " + err.Text)
+	sig := <-channels.Signal
+	channels.Error <- Error.New(Error.Info, "received "+sig.String()+": shutting down")
+	os.Exit(shutdown(channels, sensorEng, mongoDb, outputs))
+}
+
+// shutdown stops the sensors first, then lets the dispatcher and the database
+// drain everything that is still buffered. It returns the exit status, which
+// is non-zero if records were lost on the way.
+func shutdown(channels *ChannelList, sensorEng *sensors.Engine, mongoDb *nmea2mongo.Engine, outputs []*output.Engine) int {
+	status := 0
+	deadline := time.Now().Add(shutdownTimeout)
+
+	if err := sensorEng.Stop(shutdownTimeout); err != nil {
+		channels.Error <- Error.Err(Error.High, err)
+		status = 1
+	}
+
+	channels.StopDispatcher <- true
+	<-channels.DispatcherDone
+	for _, out := range outputs {
+		if !out.Stop(time.Until(deadline)) {
+			status = 1
 		}
 	}
+	if mongoDb != nil {
+		if !mongoDb.Stop(time.Until(deadline)) {
+			status = 1
+		}
+	}
+
+	channels.StopConsole <- true
+	<-channels.ConsoleDone
+	return status
 }
 
-func nmeaDispatcher(channels *ChannelList) {
-	for data := range channels.In {
-		channels.MongoDb <- data
+// openOutputs starts forwarding to the configured remote services
+func openOutputs(channels *ChannelList, influx output.InfluxConfig, prometheusURL string) []*output.Engine {
+	outputs := make([]*output.Engine, 0)
+	if influx.URL != "" {
+		sink, err := output.NewInflux(influx)
+		if err != nil {
+			channels.Error <- Error.Err(Error.High, err)
+		} else {
+			outputs = append(outputs, output.New(sink, nil, channels.Error))
+		}
+	}
+	if prometheusURL != "" {
+		sink, err := output.NewPrometheus(prometheusURL)
+		if err != nil {
+			channels.Error <- Error.Err(Error.High, err)
+		} else {
+			outputs = append(outputs, output.New(sink, nil, channels.Error))
+		}
+	}
+	return outputs
+}
+
+// readDbConfig reads the database config file, lines hold key = value and
+// lines starting with # are comments. Without a file the defaults are used.
+func readDbConfig(path string) (*nmea2mongo.DbConfig, error) {
+	configMap := make(map[string]string)
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			separator := strings.Index(line, "=")
+			if separator < 0 {
+				return nil, errors.New(path + ":" + strconv.Itoa(i+1) + ": expected key = value")
+			}
+			configMap[strings.TrimSpace(line[:separator])] = strings.TrimSpace(line[separator+1:])
+		}
+	}
+	return nmea2mongo.NewConfig(configMap)
+}
+
+// openDatabase starts the database engine on the configured storage, it
+// returns nil if the storage is not available
+func openDatabase(storageType string, sqlitePath string, dbConfig *nmea2mongo.DbConfig, channels *ChannelList) *nmea2mongo.Engine {
+	switch storageType {
+	case storageMongo:
+		return nmea2mongo.New(channels.MongoDb, channels.Error, dbConfig)
+	case storageSqlite:
+		store, err := sqlite.Open(sqlitePath)
+		if err != nil {
+			channels.Error <- Error.Err(Error.High, err)
+			return nil
+		}
+		return nmea2mongo.NewWithStorage(channels.MongoDb, channels.Error, store, dbConfig)
+	default:
+		channels.Error <- Error.New(Error.High, "unknown storage "+storageType)
+		return nil
+	}
+}
+
+// rebuildAggregates computes the aggregates of a type, or of all types, in
+// the range from to to again
+func rebuildAggregates(storageType string, sqlitePath string, dbConfig *nmea2mongo.DbConfig, dataType string, from string, to string) int {
+	start, end, err := parseRebuildRange(from, to, dbConfig.Location())
+	if err != nil {
+		println(err.Error())
+		return 2
+	}
+	return rebuildRange(storageType, sqlitePath, dbConfig, dataType, start, end)
+}
+
+// parseRebuildRange returns the range of -rebuild-from and -rebuild-to, all
+// records if both are empty
+func parseRebuildRange(from string, to string, location *time.Location) (int64, int64, error) {
+	start, err := parseRebuildTime(from, 0, location)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseRebuildTime(to, math.MaxInt64, location)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, errors.New("the end of the range must be after its start")
+	}
+	return start, end, nil
+}
+
+func rebuildRange(storageType string, sqlitePath string, dbConfig *nmea2mongo.DbConfig, dataType string, start int64, end int64) int {
+	channels := &ChannelList{
+		Error:       make(chan *Error.Error, 16),
+		MongoDb:     make(chan *nmea.Data),
+		StopConsole: make(chan bool, 1),
+		ConsoleDone: make(chan bool),
+	}
+	go errorConsole(channels)
+	close(channels.MongoDb)
+
+	status := 0
+	// nothing is written to the records, the spool of a running logger is
+	// left alone
+	mongoDb := openDatabase(storageType, sqlitePath, dbConfig.WithoutSpool(), channels)
+	if mongoDb == nil {
+		status = 1
+	} else {
+		if dataType == rebuildAll {
+			dataType = ""
+		}
+		if err := mongoDb.Rebuild(dataType, start, end); err != nil {
+			channels.Error <- Error.Err(Error.High, err)
+			status = 1
+		}
+		mongoDb.Stop(shutdownTimeout)
+	}
+
+	channels.StopConsole <- true
+	<-channels.ConsoleDone
+	return status
+}
+
+// parseRebuildTime reads a date in the timezone of the aggregates or an RFC
+// 3339 time, fallback is returned for an empty value
+func parseRebuildTime(value string, fallback int64, location *time.Location) (int64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+		return date.Unix(), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, errors.New("invalid time " + value + ", expected 2006-01-02 or RFC 3339")
+	}
+	return parsed.Unix(), nil
+}
+
+// scanI2C looks for supported devices on all i2c buses and writes a device
+// configuration entry for each of them to stdout or the output file
+func scanI2C(output string) int {
+	errorChan := make(chan *Error.Error, 16)
+	consoleDone := make(chan bool)
+	go func() {
+		for err := range errorChan {
+			printError(err)
+		}
+		close(consoleDone)
+	}()
+
+	status := 0
+	sensorEng := sensors.NewEngine(nil, errorChan)
+	detected, err := sensorEng.ScanI2C()
+	if err != nil {
+		errorChan <- Error.Err(Error.High, err)
+		status = 1
+	} else if len(detected) == 0 {
+		errorChan <- Error.New(Error.Info, "no supported i2c devices found")
+	} else {
+		out := os.Stdout
+		if output != "" {
+			out, err = os.Create(output)
+		}
+		if err == nil {
+			err = sensors.WriteDetected(out, detected)
+			if output != "" {
+				if closeErr := out.Close(); err == nil {
+					err = closeErr
+				}
+			}
+		}
+		if err != nil {
+			errorChan <- Error.Err(Error.High, err)
+			status = 1
+		}
+	}
+
+	if err := sensorEng.Stop(shutdownTimeout); err != nil {
+		errorChan <- Error.Err(Error.Low, err)
+	}
+	close(errorChan)
+	<-consoleDone
+	return status
+}
+
+func errorConsole(channels *ChannelList) {
+	for {
+		select {
+		case err := <-channels.Error:
+			printError(err)
+		case <-channels.StopConsole:
+			for len(channels.Error) > 0 {
+				printError(<-channels.Error)
+			}
+			close(channels.ConsoleDone)
+			return
+		}
+	}
+}
+
+func printError(err *Error.Error) {
+	switch err.Lvl {
+	case Error.Debug:
+		println("[DEBUG] " + err.Text)
+	case Error.Info:
+		println("[INFO]  " + err.Text)
+	case Error.Warning:
+		println("[WARN]  " + err.Text)
+	case Error.Low:
+		println("[LOW]   " + err.Text)
+	case Error.High:
+		println("[HIGH]  " + err.Text)
+	case Error.Fatal:
+		println("[FATAL] " + err.Text)
+	default:
+		println("[UNKWN] " + err.Text)
+	}
+}
+
+// nmeaDispatcher is the only sender on the output channels, so it closes them
+// once it is told to stop. Without a database records only go to the
+// outputs, a record still waiting for the database when the dispatcher is
+// stopped is dropped.
+func nmeaDispatcher(channels *ChannelList, outputs []*output.Engine, database bool) {
+	defer close(channels.DispatcherDone)
+	defer close(channels.MongoDb)
+	for {
+		select {
+		case data := <-channels.In:
+			if database {
+				select {
+				case channels.MongoDb <- data:
+				case <-channels.StopDispatcher:
+					channels.Error <- Error.New(Error.Low, "dispatcher stopped: a record for the database was dropped")
+					return
+				}
+			}
+			for _, out := range outputs {
+				out.Send(data)
+			}
+		case <-channels.StopDispatcher:
+			return
+		}
 	}
 }
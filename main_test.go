@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRebuildTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone database: " + err.Error())
+	}
+	tests := []struct {
+		name     string
+		value    string
+		fallback int64
+		location *time.Location
+		want     int64
+		err      bool
+	}{
+		{name: "empty", value: "", fallback: 42, location: time.UTC, want: 42},
+		{name: "date utc", value: "2024-03-31", location: time.UTC, want: 1711843200},
+		// midnight in Berlin is still winter time, an hour before UTC
+		{name: "date berlin", value: "2024-03-31", location: berlin, want: 1711839600},
+		{name: "rfc 3339", value: "2024-03-31T02:30:00+02:00", location: berlin, want: 1711845000},
+		{name: "invalid", value: "31.03.2024", location: time.UTC, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRebuildTime(test.value, test.fallback, test.location)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v", err)
+			}
+			if !test.err && got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRebuildRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  string
+		to    string
+		start int64
+		end   int64
+		err   string
+	}{
+		{name: "everything", start: 0, end: math.MaxInt64},
+		{name: "from", from: "2024-03-31", start: 1711843200, end: math.MaxInt64},
+		{name: "to", to: "2024-03-31", start: 0, end: 1711843200},
+		{name: "invalid start", from: "yesterday", to: "2024-03-31", err: "invalid time yesterday"},
+		{name: "invalid end", from: "2024-03-31", to: "tomorrow", err: "invalid time tomorrow"},
+		{name: "end before start", from: "2024-03-31", to: "2024-03-01", err: "after its start"},
+		{name: "empty range", from: "2024-03-31", to: "2024-03-31", err: "after its start"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, err := parseRebuildRange(test.from, test.to, time.UTC)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != test.start || end != test.end {
+				t.Errorf("got %d to %d, want %d to %d", start, end, test.start, test.end)
+			}
+		})
+	}
+}
@@ -9,6 +9,16 @@ import (
 
 const (
 	ZeroCelsiusInKelvin float64 = 273.15
+
+	// records written by the sensors watchdog instead of a device
+	TypeOutage string = "OUTAGE"
+
+	// device id of aggregates that combine several devices
+	DeviceCombined int64 = -1
+
+	// stored by FromRMCString for fields the sentence left empty
+	MissingCourse    float64 = -1.0
+	MissingVariation float64 = 1024.0
 )
 
 type DataMap map[string]float64
@@ -18,7 +28,9 @@ type Data struct {
 	// uint16max*2 < devID				others
 	Timestamp int64
 	Type      string
-	Data      DataMap `bson:"data"`
+	// talker id of NMEA sentences, e.g. GP, empty for other devices
+	Talker string  `bson:"talker,omitempty"`
+	Data   DataMap `bson:"data"`
 }
 
 func NewData(sentence string, deviceID int64) (*Data, error) {
@@ -27,12 +39,13 @@ func NewData(sentence string, deviceID int64) (*Data, error) {
 	d.Data = make(DataMap)
 	d.Data["deviceid"] = float64(deviceID)
 	buffer := strings.Split(sentence, ",")
+	d.Talker = talker(buffer[0])
 
 	var err error
-	switch buffer[0] {
-	case "$--PAD":
+	switch {
+	case buffer[0] == "$--PAD":
 		err = d.FromPADString(buffer)
-	case "$GPRMC", "$--RMC":
+	case sentenceType(buffer[0]) == "RMC":
 		err = d.FromRMCString(buffer)
 	default:
 		err = d.FromRAWString(buffer)
@@ -41,20 +54,32 @@ func NewData(sentence string, deviceID int64) (*Data, error) {
 	return &d, err
 }
 
-func Average(data []DataMap) (*DataMap, error) {
-	var result DataMap
-	result = make(DataMap)
-	amounts := make(map[string]int)
-	for _, currentMap := range data {
-		for key, value := range currentMap {
-			result[key] += value
-			amounts[key] += 1
-		}
-	}
-	for key, value := range result {
-		result[key] = value / float64(amounts[key])
+// NewSensorData wraps readings of a device that does not talk NMEA, the type
+// decides which collection the readings end up in
+func NewSensorData(dataType string, deviceID int64, fields DataMap) *Data {
+	var d Data
+	d.Timestamp = time.Now().Unix()
+	d.Type = dataType
+	d.Data = make(DataMap)
+	for key, value := range fields {
+		d.Data[key] = value
 	}
-	return &result, nil
+	d.Data["deviceid"] = float64(deviceID)
+	return &d
+}
+
+// NewOutage describes a period in which a device did not deliver data, so
+// gaps in the log can be explained
+func NewOutage(deviceID int64, start time.Time, end time.Time) *Data {
+	var d Data
+	d.Timestamp = start.Unix()
+	d.Type = TypeOutage
+	d.Data = make(DataMap)
+	d.Data["deviceid"] = float64(deviceID)
+	d.Data["start"] = float64(start.Unix())
+	d.Data["end"] = float64(end.Unix())
+	d.Data["duration"] = end.Sub(start).Seconds()
+	return &d
 }
 
 func (d *Data) DeviceID() int64 {
@@ -70,7 +95,7 @@ func (d *Data) FromRMCString(buffer []string) error {
 	}
 
 	// check if really a RMC sentence
-	if buffer[0] != "$GPRMC" && buffer[0] != "$--RMC" {
+	if sentenceType(buffer[0]) != "RMC" {
 		return errors.New("invalid RMC sentence received")
 	}
 
@@ -117,17 +142,19 @@ func (d *Data) FromRMCString(buffer []string) error {
 		tc, err = strconv.ParseFloat(buffer[8], 64)
 	}
 	if err != nil || buffer[8] == "" {
-		tc = -1.0
+		tc = MissingCourse
 	}
 	err = nil
 
-	// check if magnetic variation was given and read it
+	// check if magnetic variation was given and read it, west is negative
 	var mv float64
-	if buffer[8] != "" {
-		mv, err = strconv.ParseFloat(buffer[8], 64)
+	if buffer[10] != "" {
+		mv, err = strconv.ParseFloat(buffer[10], 64)
 	}
-	if err != nil || buffer[8] == "" {
-		mv = 1024.0
+	if err != nil || buffer[10] == "" {
+		mv = MissingVariation
+	} else if buffer[11] == "W" {
+		mv *= -1
 	}
 	err = nil
 
@@ -197,6 +224,27 @@ func (d *Data) FromRAWString(buffer []string) error {
 	return nil
 }
 
+// talker returns the talker id of an address field like $GPRMC, sentences
+// without one, like $--PAD, have none
+func talker(address string) string {
+	if len(address) < 6 || (address[0] != '$' && address[0] != '!') {
+		return ""
+	}
+	if id := address[1:3]; id != "--" {
+		return id
+	}
+	return ""
+}
+
+// sentenceType returns the sentence formatter of an address field, RMC for
+// $GPRMC and $GNRMC alike
+func sentenceType(address string) string {
+	if len(address) != 6 || (address[0] != '$' && address[0] != '!') {
+		return ""
+	}
+	return address[3:]
+}
+
 func GetType(s string) string {
 	sub := strings.Split(s, ",")
 	if len(sub) > 0 {
@@ -0,0 +1,85 @@
+package nmea
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFromRMCString(t *testing.T) {
+	tests := []struct {
+		name     string
+		sentence string
+		talker   string
+		want     DataMap
+		err      string
+	}{
+		{
+			name:     "east variation",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,E,A*6A",
+			talker:   "GP",
+			want: DataMap{"latitude": 4807.038, "longitude": 1131, "speed": 22.4,
+				"truecourse": 84.4, "magneticvariation": 3.1},
+		},
+		{
+			name:     "west variation",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W,A*6A",
+			talker:   "GP",
+			want: DataMap{"latitude": 4807.038, "longitude": 1131, "speed": 22.4,
+				"truecourse": 84.4, "magneticvariation": -3.1},
+		},
+		{
+			name:     "south and west",
+			sentence: "$GPRMC,081836,A,3751.65,S,14507.36,W,000.0,360.0,130998,011.3,E,A*62",
+			talker:   "GP",
+			want: DataMap{"latitude": -3751.65, "longitude": -14507.36, "speed": 0,
+				"truecourse": 360, "magneticvariation": 11.3},
+		},
+		{
+			name:     "empty fields",
+			sentence: "$GPRMC,081836,A,3751.65,N,14507.36,E,,,130998,,,A*62",
+			talker:   "GP",
+			want: DataMap{"latitude": 3751.65, "longitude": 14507.36, "speed": -1,
+				"truecourse": MissingCourse, "magneticvariation": MissingVariation},
+		},
+		{
+			name:     "gnss talker",
+			sentence: "$GNRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,E,A*74",
+			talker:   "GN",
+			want: DataMap{"latitude": 4807.038, "longitude": 1131, "speed": 22.4,
+				"truecourse": 84.4, "magneticvariation": 3.1},
+		},
+		{
+			name:     "no talker",
+			sentence: "$--RMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,E,A*6A",
+			talker:   "",
+			want: DataMap{"latitude": 4807.038, "longitude": 1131, "speed": 22.4,
+				"truecourse": 84.4, "magneticvariation": 3.1},
+		},
+		{name: "no fix", sentence: "$GPRMC,081836,V,,,,,,,130998,,,N*62", err: "gps fix"},
+		{name: "too short", sentence: "$GPRMC,081836,A,3751.65,S,14507.36,E", err: "length: 7"},
+		{name: "invalid hemisphere", sentence: "$GPRMC,081836,A,3751.65,X,14507.36,E,,,130998,,,A*62",
+			err: "latitude heading"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := NewData(test.sentence, 65536)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				if data.Type != "MALFORMED" {
+					t.Errorf("type %s of a rejected sentence", data.Type)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.want["deviceid"] = 65536
+			if data.Type != "RMC" || data.Talker != test.talker || !reflect.DeepEqual(data.Data, test.want) {
+				t.Errorf("got %s %s %v, want %v", data.Talker, data.Type, data.Data, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package nmea
+
+import (
+	"math"
+	"strings"
+)
+
+// an aggregate keeps the mean of a field under its own name and the other
+// statistics under the name with one of these suffixes
+const (
+	SuffixMin       string = "_min"
+	SuffixMax       string = "_max"
+	SuffixStdDev    string = "_stddev"
+	SuffixCount     string = "_count"
+	SuffixFirst     string = "_first"
+	SuffixLast      string = "_last"
+	SuffixResultant string = "_resultant"
+
+	FieldLatitude  string = "latitude"
+	FieldLongitude string = "longitude"
+)
+
+var statisticsSuffixes = []string{SuffixMin, SuffixMax, SuffixStdDev, SuffixCount,
+	SuffixFirst, SuffixLast, SuffixResultant}
+
+// fields that are keys rather than values
+var statisticsSkipped = map[string]bool{"deviceid": true}
+
+type AngleRange int
+
+const (
+	// 0 <= angle < 360
+	AngleUnsigned AngleRange = iota
+	// -180 < angle <= 180
+	AngleSigned
+)
+
+// AngleFields are averaged as unit vectors in degrees, so the mean of 350 and
+// 10 is 0. Their stddev is the circular standard deviation and resultant the
+// mean resultant length R, 1 if all angles are equal and near 0 if they
+// spread around the circle. They have no min and max, those of 350 and 10
+// would be 10 and 350, first and last are the angles read.
+var AngleFields = map[string]AngleRange{
+	"truecourse":        AngleUnsigned,
+	"heading":           AngleUnsigned,
+	"winddirection":     AngleUnsigned,
+	"windangle":         AngleSigned,
+	"magneticvariation": AngleSigned,
+}
+
+// missingValues are the placeholders parsers store for fields a sentence
+// left empty, they are not accumulated
+var missingValues = map[string]float64{
+	"truecourse":        MissingCourse,
+	"magneticvariation": MissingVariation,
+}
+
+// FieldStatistics accumulates the values of one field. Mean and the sum of
+// squared deviations m2 are updated with Welford's method, so two
+// accumulators merge into exactly the one of all their values. The unit
+// vectors are summed for every field, only those of AngleFields use them.
+type FieldStatistics struct {
+	Count  int64
+	Mean   float64
+	M2     float64
+	Min    float64
+	Max    float64
+	First  float64
+	Last   float64
+	SumSin float64
+	SumCos float64
+}
+
+func (fs *FieldStatistics) Add(value float64) {
+	if fs.Count == 0 {
+		*fs = FieldStatistics{Count: 1, Mean: value, Min: value, Max: value, First: value, Last: value}
+	} else {
+		fs.Count++
+		delta := value - fs.Mean
+		fs.Mean += delta / float64(fs.Count)
+		fs.M2 += delta * (value - fs.Mean)
+		fs.Min = math.Min(fs.Min, value)
+		fs.Max = math.Max(fs.Max, value)
+		fs.Last = value
+	}
+	sin, cos := math.Sincos(value * math.Pi / 180)
+	fs.SumSin += sin
+	fs.SumCos += cos
+}
+
+// Merge adds the values of other, which have to come after those of fs
+func (fs *FieldStatistics) Merge(other *FieldStatistics) {
+	if other.Count == 0 {
+		return
+	}
+	if fs.Count == 0 {
+		*fs = *other
+		return
+	}
+	count := fs.Count + other.Count
+	delta := other.Mean - fs.Mean
+	fs.Mean += delta * float64(other.Count) / float64(count)
+	fs.M2 += other.M2 + delta*delta*float64(fs.Count)*float64(other.Count)/float64(count)
+	fs.Count = count
+	fs.Min = math.Min(fs.Min, other.Min)
+	fs.Max = math.Max(fs.Max, other.Max)
+	fs.Last = other.Last
+	fs.SumSin += other.SumSin
+	fs.SumCos += other.SumCos
+}
+
+// StdDev is the population standard deviation
+func (fs *FieldStatistics) StdDev() float64 {
+	if fs.Count == 0 {
+		return 0
+	}
+	return math.Sqrt(fs.M2 / float64(fs.Count))
+}
+
+// Resultant is the mean resultant length R of the angles
+func (fs *FieldStatistics) Resultant() float64 {
+	if fs.Count == 0 {
+		return 0
+	}
+	return math.Min(math.Hypot(fs.SumSin, fs.SumCos)/float64(fs.Count), 1)
+}
+
+// CircularMean is the direction of the summed unit vectors
+func (fs *FieldStatistics) CircularMean(angleRange AngleRange) float64 {
+	mean := math.Atan2(fs.SumSin, fs.SumCos) * 180 / math.Pi
+	if angleRange == AngleUnsigned && mean < 0 {
+		// a tiny negative mean would be rounded up to 360
+		if mean += 360; mean >= 360 {
+			mean = 0
+		}
+	} else if angleRange == AngleSigned && mean == -180 {
+		mean = 180
+	}
+	return mean
+}
+
+// CircularStdDev is sqrt(-2 ln R) in degrees, capped at 180 for angles that
+// spread evenly around the circle
+func (fs *FieldStatistics) CircularStdDev() float64 {
+	resultant := fs.Resultant()
+	if resultant <= 0 {
+		return 180
+	}
+	return math.Min(math.Sqrt(-2*math.Log(resultant))*180/math.Pi, 180)
+}
+
+// PositionStatistics sums the positions as unit vectors from the centre of
+// the earth. Their mean is the point on the sphere below the mean vector,
+// which is not thrown off by the date line or the poles like the mean of
+// latitude and longitude.
+type PositionStatistics struct {
+	Count int64
+	SumX  float64
+	SumY  float64
+	SumZ  float64
+}
+
+// Add takes latitude and longitude in the NMEA form ddmm.mmmm
+func (ps *PositionStatistics) Add(latitude float64, longitude float64) {
+	lat := NmeaToDegrees(latitude) * math.Pi / 180
+	lon := NmeaToDegrees(longitude) * math.Pi / 180
+	ps.Count++
+	ps.SumX += math.Cos(lat) * math.Cos(lon)
+	ps.SumY += math.Cos(lat) * math.Sin(lon)
+	ps.SumZ += math.Sin(lat)
+}
+
+func (ps *PositionStatistics) Merge(other *PositionStatistics) {
+	ps.Count += other.Count
+	ps.SumX += other.SumX
+	ps.SumY += other.SumY
+	ps.SumZ += other.SumZ
+}
+
+// Mean returns latitude and longitude in the NMEA form
+func (ps *PositionStatistics) Mean() (float64, float64) {
+	lat := math.Atan2(ps.SumZ, math.Hypot(ps.SumX, ps.SumY)) * 180 / math.Pi
+	lon := math.Atan2(ps.SumY, ps.SumX) * 180 / math.Pi
+	return DegreesToNmea(lat), DegreesToNmea(lon)
+}
+
+// Resultant is the length of the mean vector, 1 if all positions are equal
+func (ps *PositionStatistics) Resultant() float64 {
+	if ps.Count == 0 {
+		return 0
+	}
+	length := math.Sqrt(ps.SumX*ps.SumX + ps.SumY*ps.SumY + ps.SumZ*ps.SumZ)
+	return math.Min(length/float64(ps.Count), 1)
+}
+
+// NmeaToDegrees converts ddmm.mmmm to decimal degrees, keeping the sign
+func NmeaToDegrees(value float64) float64 {
+	abs := math.Abs(value)
+	degrees := math.Floor(abs/100) + math.Mod(abs, 100)/60
+	return math.Copysign(degrees, value)
+}
+
+// DegreesToNmea converts decimal degrees to ddmm.mmmm, keeping the sign
+func DegreesToNmea(value float64) float64 {
+	abs := math.Abs(value)
+	degrees := math.Floor(abs)
+	return math.Copysign(degrees*100+(abs-degrees)*60, value)
+}
+
+// Statistics accumulates records field by field. Records and merged
+// statistics have to be added in the order of time for first and last.
+type Statistics struct {
+	fields   map[string]*FieldStatistics
+	position PositionStatistics
+}
+
+func NewStatistics() *Statistics {
+	return &Statistics{fields: make(map[string]*FieldStatistics)}
+}
+
+func (s *Statistics) field(key string) *FieldStatistics {
+	fs, ok := s.fields[key]
+	if !ok {
+		fs = &FieldStatistics{}
+		s.fields[key] = fs
+	}
+	return fs
+}
+
+// Add accumulates the fields of a record, values that are not finite,
+// missing values and the device id are skipped
+func (s *Statistics) Add(data DataMap) {
+	for key, value := range data {
+		if statisticsSkipped[key] || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		if missing, ok := missingValues[key]; ok && value == missing {
+			continue
+		}
+		s.field(key).Add(value)
+	}
+
+	latitude, latOk := data[FieldLatitude]
+	longitude, lonOk := data[FieldLongitude]
+	if latOk && lonOk && !math.IsNaN(latitude+longitude) && !math.IsInf(latitude+longitude, 0) {
+		s.position.Add(latitude, longitude)
+	}
+}
+
+// Merge accumulates statistics of values that come after those in s
+func (s *Statistics) Merge(other *Statistics) {
+	for key, otherFs := range other.fields {
+		s.field(key).Merge(otherFs)
+	}
+	s.position.Merge(&other.position)
+}
+
+// DataMap returns the statistics in the form stored as aggregate
+func (s *Statistics) DataMap() DataMap {
+	data := make(DataMap)
+	for key, fs := range s.fields {
+		if fs.Count == 0 {
+			continue
+		}
+		data[key+SuffixCount] = float64(fs.Count)
+		data[key+SuffixFirst] = fs.First
+		data[key+SuffixLast] = fs.Last
+		if angleRange, ok := AngleFields[key]; ok {
+			data[key] = fs.CircularMean(angleRange)
+			data[key+SuffixStdDev] = fs.CircularStdDev()
+			data[key+SuffixResultant] = fs.Resultant()
+			continue
+		}
+		data[key] = fs.Mean
+		data[key+SuffixMin] = fs.Min
+		data[key+SuffixMax] = fs.Max
+		data[key+SuffixStdDev] = fs.StdDev()
+	}
+
+	if s.position.Count > 0 {
+		data[FieldLatitude], data[FieldLongitude] = s.position.Mean()
+		data[FieldLatitude+SuffixResultant] = s.position.Resultant()
+	}
+	return data
+}
+
+// StatisticsFromDataMap restores the statistics of an aggregate, so it can be
+// merged into one of a longer period. Aggregates that only hold means count
+// as a single value each.
+func StatisticsFromDataMap(data DataMap) *Statistics {
+	s := NewStatistics()
+	for key, mean := range data {
+		if statisticsSkipped[key] || isStatisticsKey(data, key) {
+			continue
+		}
+		fs := &FieldStatistics{Count: 1, Mean: mean, Min: mean, Max: mean, First: mean, Last: mean}
+		count, ok := data[key+SuffixCount]
+		if ok && count >= 1 {
+			fs.Count = int64(count)
+			fs.Min = valueOr(data, key+SuffixMin, mean)
+			fs.Max = valueOr(data, key+SuffixMax, mean)
+			fs.First = valueOr(data, key+SuffixFirst, mean)
+			fs.Last = valueOr(data, key+SuffixLast, mean)
+		}
+		if _, angle := AngleFields[key]; angle {
+			// the linear mean and m2 are lost, only the vector sum is needed
+			length := float64(fs.Count) * valueOr(data, key+SuffixResultant, 1)
+			sin, cos := math.Sincos(mean * math.Pi / 180)
+			fs.SumSin = length * sin
+			fs.SumCos = length * cos
+		} else {
+			stdDev := valueOr(data, key+SuffixStdDev, 0)
+			fs.M2 = stdDev * stdDev * float64(fs.Count)
+		}
+		s.fields[key] = fs
+	}
+
+	latitude, latOk := data[FieldLatitude]
+	longitude, lonOk := data[FieldLongitude]
+	if latOk && lonOk {
+		count := valueOr(data, FieldLatitude+SuffixCount, 1)
+		length := count * valueOr(data, FieldLatitude+SuffixResultant, 1)
+		lat := NmeaToDegrees(latitude) * math.Pi / 180
+		lon := NmeaToDegrees(longitude) * math.Pi / 180
+		s.position = PositionStatistics{
+			Count: int64(count),
+			SumX:  length * math.Cos(lat) * math.Cos(lon),
+			SumY:  length * math.Cos(lat) * math.Sin(lon),
+			SumZ:  length * math.Sin(lat),
+		}
+	}
+	return s
+}
+
+// CombineStatistics merges the statistics of several devices into one entry
+// in which each device counts with its weight instead of its number of
+// values. It holds the weighted mean of each field, the circular mean for
+// angles and the mean on the sphere for the position, along with the total
+// count and, except for angles, the min and max of all devices. Devices
+// without a positive weight are left out.
+func CombineStatistics(devices []*Statistics, weights []float64) DataMap {
+	type combined struct {
+		weight, sum, sin, cos, min, max float64
+		count                           int64
+	}
+	fields := make(map[string]*combined)
+	var position PositionStatistics
+	var positionWeight float64
+
+	for i, device := range devices {
+		weight := weights[i]
+		if weight <= 0 {
+			continue
+		}
+		for key, fs := range device.fields {
+			if fs.Count == 0 {
+				continue
+			}
+			c, ok := fields[key]
+			if !ok {
+				c = &combined{min: fs.Min, max: fs.Max}
+				fields[key] = c
+			}
+			c.weight += weight
+			c.sum += weight * fs.Mean
+			if resultant := fs.Resultant(); resultant > 0 {
+				c.sin += weight * resultant * fs.SumSin / math.Hypot(fs.SumSin, fs.SumCos)
+				c.cos += weight * resultant * fs.SumCos / math.Hypot(fs.SumSin, fs.SumCos)
+			}
+			c.min = math.Min(c.min, fs.Min)
+			c.max = math.Max(c.max, fs.Max)
+			c.count += fs.Count
+		}
+		if device.position.Count > 0 {
+			scale := weight / float64(device.position.Count)
+			position.Count += device.position.Count
+			position.SumX += scale * device.position.SumX
+			position.SumY += scale * device.position.SumY
+			position.SumZ += scale * device.position.SumZ
+			positionWeight += weight
+		}
+	}
+
+	data := make(DataMap)
+	for key, c := range fields {
+		data[key+SuffixCount] = float64(c.count)
+		if angleRange, ok := AngleFields[key]; ok {
+			fs := FieldStatistics{SumSin: c.sin, SumCos: c.cos}
+			data[key] = fs.CircularMean(angleRange)
+			continue
+		}
+		data[key] = c.sum / c.weight
+		data[key+SuffixMin] = c.min
+		data[key+SuffixMax] = c.max
+	}
+	if positionWeight > 0 {
+		data[FieldLatitude], data[FieldLongitude] = position.Mean()
+	}
+	return data
+}
+
+// isStatisticsKey tells if key is one of the statistics of another field
+func isStatisticsKey(data DataMap, key string) bool {
+	for _, suffix := range statisticsSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			if _, ok := data[strings.TrimSuffix(key, suffix)]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func valueOr(data DataMap, key string, fallback float64) float64 {
+	if value, ok := data[key]; ok {
+		return value
+	}
+	return fallback
+}
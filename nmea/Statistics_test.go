@@ -0,0 +1,379 @@
+package nmea
+
+import (
+	"math"
+	"testing"
+)
+
+const tolerance = 1e-9
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= tolerance*math.Max(1, math.Abs(b))
+}
+
+func TestFieldStatisticsAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   FieldStatistics
+		stdDev float64
+	}{
+		{name: "empty", values: nil, want: FieldStatistics{}},
+		{name: "one value", values: []float64{4},
+			want: FieldStatistics{Count: 1, Mean: 4, Min: 4, Max: 4, First: 4, Last: 4}},
+		{name: "several values", values: []float64{2, 4, 4, 4, 5, 5, 7, 9},
+			want:   FieldStatistics{Count: 8, Mean: 5, M2: 32, Min: 2, Max: 9, First: 2, Last: 9},
+			stdDev: 2},
+		{name: "order kept", values: []float64{3, -1, 8, 0},
+			want:   FieldStatistics{Count: 4, Mean: 2.5, M2: 49, Min: -1, Max: 8, First: 3, Last: 0},
+			stdDev: 3.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fs FieldStatistics
+			for _, value := range test.values {
+				fs.Add(value)
+			}
+			if fs.Count != test.want.Count || !near(fs.Mean, test.want.Mean) || !near(fs.M2, test.want.M2) ||
+				fs.Min != test.want.Min || fs.Max != test.want.Max ||
+				fs.First != test.want.First || fs.Last != test.want.Last {
+				t.Errorf("got %+v, want %+v", fs, test.want)
+			}
+			if !near(fs.StdDev(), test.stdDev) {
+				t.Errorf("stddev %v, want %v", fs.StdDev(), test.stdDev)
+			}
+		})
+	}
+}
+
+// merging the accumulators of consecutive parts gives the accumulator of one
+// pass over all values
+func TestFieldStatisticsMerge(t *testing.T) {
+	values := []float64{12.5, 13, 11.75, 14.25, 1e3, 12, 12.5, -3, 12.25, 13.5}
+	var single FieldStatistics
+	for _, value := range values {
+		single.Add(value)
+	}
+
+	tests := []struct {
+		name  string
+		parts []int
+	}{
+		{name: "halves", parts: []int{5, 5}},
+		{name: "first alone", parts: []int{1, 9}},
+		{name: "last alone", parts: []int{9, 1}},
+		{name: "uneven", parts: []int{3, 4, 3}},
+		{name: "every value", parts: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{name: "empty parts", parts: []int{0, 4, 0, 6, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var merged FieldStatistics
+			start := 0
+			for _, size := range test.parts {
+				var part FieldStatistics
+				for _, value := range values[start : start+size] {
+					part.Add(value)
+				}
+				merged.Merge(&part)
+				start += size
+			}
+
+			if merged.Count != single.Count || !near(merged.Mean, single.Mean) ||
+				!near(merged.M2, single.M2) || merged.Min != single.Min || merged.Max != single.Max ||
+				merged.First != single.First || merged.Last != single.Last ||
+				!near(merged.SumSin, single.SumSin) || !near(merged.SumCos, single.SumCos) {
+				t.Errorf("merged %+v, want %+v", merged, single)
+			}
+		})
+	}
+}
+
+// aggregates restored from their stored form merge into the aggregate of the
+// longer period
+func TestStatisticsFromDataMap(t *testing.T) {
+	records := []DataMap{
+		{"temperature": 18.5, "pressure": 1013.2, "deviceid": 7},
+		{"temperature": 19.25, "pressure": 1012.8, "deviceid": 7},
+		{"temperature": 21, "pressure": 1012.1, "deviceid": 7},
+		{"temperature": 20.5, "deviceid": 7},
+		{"temperature": 17.75, "pressure": 1011.9, "deviceid": 7},
+	}
+	single := NewStatistics()
+	for _, record := range records {
+		single.Add(record)
+	}
+	want := single.DataMap()
+
+	for split := 1; split < len(records); split++ {
+		first, second := NewStatistics(), NewStatistics()
+		for _, record := range records[:split] {
+			first.Add(record)
+		}
+		for _, record := range records[split:] {
+			second.Add(record)
+		}
+		merged := StatisticsFromDataMap(first.DataMap())
+		merged.Merge(StatisticsFromDataMap(second.DataMap()))
+		got := merged.DataMap()
+
+		if len(got) != len(want) {
+			t.Errorf("split %d: got %v, want %v", split, got, want)
+			continue
+		}
+		for key, value := range want {
+			if !near(got[key], value) {
+				t.Errorf("split %d: %s is %v, want %v", split, key, got[key], value)
+			}
+		}
+	}
+}
+
+func TestStatisticsFromDataMapMeansOnly(t *testing.T) {
+	// aggregates written before the statistics were kept hold only means
+	s := StatisticsFromDataMap(DataMap{"temperature": 20, "deviceid": 7})
+	s.Merge(StatisticsFromDataMap(DataMap{"temperature": 22, "deviceid": 7}))
+	got := s.DataMap()
+
+	want := DataMap{
+		"temperature":                21,
+		"temperature" + SuffixMin:    20,
+		"temperature" + SuffixMax:    22,
+		"temperature" + SuffixStdDev: 1,
+		"temperature" + SuffixCount:  2,
+		"temperature" + SuffixFirst:  20,
+		"temperature" + SuffixLast:   22,
+	}
+	for key, value := range want {
+		if !near(got[key], value) {
+			t.Errorf("%s is %v, want %v", key, got[key], value)
+		}
+	}
+	if _, ok := got["deviceid"]; ok {
+		t.Error("the device id is not a value")
+	}
+}
+
+// unchecked marks values a test case does not check
+var unchecked = math.NaN()
+
+func TestCircularMean(t *testing.T) {
+	tests := []struct {
+		name       string
+		angles     []float64
+		angleRange AngleRange
+		mean       float64
+		resultant  float64
+		stdDev     float64
+	}{
+		{name: "across north", angles: []float64{350, 10}, angleRange: AngleUnsigned,
+			mean: 0, resultant: math.Cos(10 * math.Pi / 180), stdDev: unchecked},
+		{name: "across north unbalanced", angles: []float64{340, 350, 20}, angleRange: AngleUnsigned,
+			mean: 356.530560, resultant: unchecked, stdDev: unchecked},
+		{name: "equal", angles: []float64{90, 90, 90}, angleRange: AngleUnsigned,
+			mean: 90, resultant: 1, stdDev: 0},
+		{name: "west of north", angles: []float64{300, 320}, angleRange: AngleUnsigned,
+			mean: 310, resultant: unchecked, stdDev: unchecked},
+		{name: "signed port", angles: []float64{-30, -50}, angleRange: AngleSigned,
+			mean: -40, resultant: unchecked, stdDev: unchecked},
+		{name: "signed astern", angles: []float64{170, -170}, angleRange: AngleSigned,
+			mean: 180, resultant: unchecked, stdDev: unchecked},
+		{name: "opposite", angles: []float64{0, 180}, angleRange: AngleUnsigned,
+			mean: unchecked, resultant: 0, stdDev: 180},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fs FieldStatistics
+			for _, angle := range test.angles {
+				fs.Add(angle)
+			}
+			if mean := fs.CircularMean(test.angleRange); math.Abs(mean-test.mean) > 1e-6 {
+				t.Errorf("mean %v, want %v", mean, test.mean)
+			}
+			if resultant := fs.Resultant(); math.Abs(resultant-test.resultant) > 1e-9 {
+				t.Errorf("resultant %v, want %v", resultant, test.resultant)
+			}
+			if stdDev := fs.CircularStdDev(); math.Abs(stdDev-test.stdDev) > 1e-6 {
+				t.Errorf("stddev %v, want %v", stdDev, test.stdDev)
+			}
+		})
+	}
+}
+
+func TestStatisticsAngles(t *testing.T) {
+	s := NewStatistics()
+	for _, course := range []float64{350, 10, 355, 5} {
+		s.Add(DataMap{"truecourse": course, "speed": 6})
+	}
+	data := s.DataMap()
+	if mean := data["truecourse"]; math.Abs(mean) > 1e-9 {
+		t.Errorf("mean course %v, want 0", mean)
+	}
+	// the linear min and max would be 5 and 355
+	for _, suffix := range []string{SuffixMin, SuffixMax} {
+		if value, ok := data["truecourse"+suffix]; ok {
+			t.Errorf("course has %s %v", suffix, value)
+		}
+	}
+	if data["truecourse"+SuffixFirst] != 350 || data["truecourse"+SuffixLast] != 5 {
+		t.Errorf("first %v and last %v", data["truecourse"+SuffixFirst], data["truecourse"+SuffixLast])
+	}
+	if _, ok := data["speed"+SuffixResultant]; ok {
+		t.Error("speed is not an angle")
+	}
+
+	// the restored vector sum keeps the direction and the spread
+	restored := StatisticsFromDataMap(data).DataMap()
+	for _, key := range []string{"truecourse", "truecourse" + SuffixResultant, "truecourse" + SuffixStdDev} {
+		if !near(restored[key], data[key]) {
+			t.Errorf("restored %s %v, want %v", key, restored[key], data[key])
+		}
+	}
+}
+
+func TestStatisticsMissingValues(t *testing.T) {
+	s := NewStatistics()
+	s.Add(DataMap{"truecourse": 90, "magneticvariation": -3, "deviceid": 65536})
+	s.Add(DataMap{"truecourse": MissingCourse, "magneticvariation": MissingVariation, "deviceid": 65536})
+	s.Add(DataMap{"truecourse": math.NaN(), "magneticvariation": math.Inf(1), "deviceid": 65536})
+	data := s.DataMap()
+
+	tests := []struct {
+		key  string
+		want float64
+	}{
+		{"truecourse", 90},
+		{"truecourse" + SuffixCount, 1},
+		{"truecourse" + SuffixFirst, 90},
+		{"magneticvariation", -3},
+		{"magneticvariation" + SuffixCount, 1},
+		{"magneticvariation" + SuffixLast, -3},
+	}
+	for _, test := range tests {
+		if !near(data[test.key], test.want) {
+			t.Errorf("%s is %v, want %v", test.key, data[test.key], test.want)
+		}
+	}
+}
+
+func TestPositionMean(t *testing.T) {
+	tests := []struct {
+		name      string
+		positions [][2]float64
+		latitude  float64
+		longitude float64
+	}{
+		{name: "equal", positions: [][2]float64{{5430.5, 1010.25}, {5430.5, 1010.25}},
+			latitude: 5430.5, longitude: 1010.25},
+		// 179.5 E and 179.5 W are a degree apart, not 359
+		{name: "date line", positions: [][2]float64{{0, 17930}, {0, -17930}},
+			latitude: 0, longitude: 18000},
+		{name: "greenwich", positions: [][2]float64{{5130, 30}, {5130, -30}},
+			latitude: 5130.0343, longitude: 0},
+		{name: "south", positions: [][2]float64{{-3350, 15110}, {-3410, 15110}},
+			latitude: -3400.0, longitude: 15110},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ps PositionStatistics
+			for _, position := range test.positions {
+				ps.Add(position[0], position[1])
+			}
+			latitude, longitude := ps.Mean()
+			if math.Abs(latitude-test.latitude) > 0.05 {
+				t.Errorf("latitude %v, want %v", latitude, test.latitude)
+			}
+			// the date line is reached from either side
+			if math.Abs(math.Abs(longitude)-math.Abs(test.longitude)) > 0.05 {
+				t.Errorf("longitude %v, want %v", longitude, test.longitude)
+			}
+		})
+	}
+}
+
+func TestNmeaDegrees(t *testing.T) {
+	tests := []struct {
+		nmea    float64
+		degrees float64
+	}{
+		{5430.5, 54.508333333},
+		{-3751.65, -37.8608333333},
+		{0, 0},
+		{17959.94, 179.999},
+	}
+	for _, test := range tests {
+		if got := NmeaToDegrees(test.nmea); math.Abs(got-test.degrees) > 1e-8 {
+			t.Errorf("NmeaToDegrees(%v) = %v, want %v", test.nmea, got, test.degrees)
+		}
+		if got := DegreesToNmea(test.degrees); math.Abs(got-test.nmea) > 1e-6 {
+			t.Errorf("DegreesToNmea(%v) = %v, want %v", test.degrees, got, test.nmea)
+		}
+	}
+}
+
+func TestCombineStatistics(t *testing.T) {
+	device := func(records ...DataMap) *Statistics {
+		s := NewStatistics()
+		for _, record := range records {
+			s.Add(record)
+		}
+		return s
+	}
+	// a chatty device with many values and a quiet one with few
+	chatty := device(
+		DataMap{"temperature": 20, "heading": 350, "latitude": 5430, "longitude": 17959},
+		DataMap{"temperature": 20, "heading": 350, "latitude": 5430, "longitude": 17959},
+		DataMap{"temperature": 20, "heading": 350, "latitude": 5430, "longitude": 17959},
+	)
+	quiet := device(
+		DataMap{"temperature": 24, "heading": 10, "latitude": 5430, "longitude": -17959},
+	)
+
+	tests := []struct {
+		name    string
+		weights []float64
+		want    DataMap
+	}{
+		{name: "equal weights", weights: []float64{1, 1}, want: DataMap{
+			"temperature": 22, "temperature" + SuffixMin: 20, "temperature" + SuffixMax: 24,
+			"temperature" + SuffixCount: 4, "heading": 0, "heading" + SuffixCount: 4,
+			"latitude": 5430,
+		}},
+		{name: "weighted", weights: []float64{3, 1}, want: DataMap{
+			"temperature": 21, "temperature" + SuffixMin: 20, "temperature" + SuffixMax: 24,
+			"temperature" + SuffixCount: 4, "heading" + SuffixCount: 4, "latitude": 5430,
+		}},
+		{name: "device left out", weights: []float64{0, 1}, want: DataMap{
+			"temperature": 24, "temperature" + SuffixMin: 24, "temperature" + SuffixMax: 24,
+			"temperature" + SuffixCount: 1, "heading": 10, "heading" + SuffixCount: 1,
+			"latitude": 5430, "longitude": -17959,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := CombineStatistics([]*Statistics{chatty, quiet}, test.weights)
+			// the mean on the sphere lies a little closer to the pole
+			for key, value := range test.want {
+				if math.Abs(got[key]-value) > 1e-3 {
+					t.Errorf("%s is %v, want %v", key, got[key], value)
+				}
+			}
+			if _, ok := got["heading"+SuffixMin]; ok {
+				t.Error("heading has a min")
+			}
+			// both longitudes are next to the date line, so is their mean
+			if longitude := math.Abs(got["longitude"]); longitude < 17959-1e-6 {
+				t.Errorf("longitude %v, want near the date line", got["longitude"])
+			}
+		})
+	}
+
+	// the heading leans towards the device with more weight, across north
+	weighted := CombineStatistics([]*Statistics{chatty, quiet}, []float64{3, 1})
+	if heading := weighted["heading"]; heading < 350 || heading > 360 {
+		t.Errorf("weighted heading %v, want between 350 and 360", heading)
+	}
+	if empty := CombineStatistics([]*Statistics{chatty}, []float64{0}); len(empty) != 0 {
+		t.Errorf("got %v without any weight", empty)
+	}
+}
@@ -0,0 +1,129 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../nmea"
+)
+
+type InfluxConfig struct {
+	// base url of the server, e.g. http://shore:8086
+	URL string
+	// database of InfluxDB 1.x
+	Database string
+	// organisation, bucket and token of InfluxDB 2.x, the bucket selects
+	// the 2.x api
+	Org    string
+	Bucket string
+	Token  string
+}
+
+// Influx writes InfluxDB line protocol: the measurement is the type of a
+// record, device and talker are tags and all other entries are fields
+type Influx struct {
+	writeURL string
+	token    string
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func NewInflux(config InfluxConfig) (*Influx, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, errors.New(ErrFlag + ": invalid influxdb url " + config.URL)
+	}
+
+	query := url.Values{}
+	query.Set("precision", "s")
+	if config.Bucket != "" {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/write"
+		query.Set("org", config.Org)
+		query.Set("bucket", config.Bucket)
+	} else {
+		if config.Database == "" {
+			return nil, errors.New(ErrFlag + ": influxdb needs a database or a bucket")
+		}
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/write"
+		query.Set("db", config.Database)
+	}
+	base.RawQuery = query.Encode()
+
+	return &Influx{
+		writeURL: base.String(),
+		token:    config.Token,
+	}, nil
+}
+
+func (ix *Influx) Name() string {
+	return "influxdb"
+}
+
+func (ix *Influx) Encode(records []*nmea.Data) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, data := range records {
+		appendInfluxLine(&buffer, data)
+	}
+	if buffer.Len() == 0 {
+		return nil, nil
+	}
+	return buffer.Bytes(), nil
+}
+
+func (ix *Influx) Request(ctx context.Context, body []byte) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, ix.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if ix.token != "" {
+		request.Header.Set("Authorization", "Token "+ix.token)
+	}
+	return request, nil
+}
+
+// appendInfluxLine writes one line per record, records without a finite
+// value are skipped because a line needs at least one field
+func appendInfluxLine(buffer *bytes.Buffer, data *nmea.Data) {
+	keys := make([]string, 0, len(data.Data))
+	for key, value := range data.Data {
+		if key != "deviceid" && !math.IsNaN(value) && !math.IsInf(value, 0) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 || data.Type == "" {
+		return
+	}
+	sort.Strings(keys)
+
+	buffer.WriteString(influxMeasurementEscaper.Replace(data.Type))
+	buffer.WriteString(",device=")
+	buffer.WriteString(strconv.FormatInt(data.DeviceID(), 10))
+	if data.Talker != "" {
+		buffer.WriteString(",talker=")
+		buffer.WriteString(influxTagEscaper.Replace(data.Talker))
+	}
+	for i, key := range keys {
+		if i == 0 {
+			buffer.WriteByte(' ')
+		} else {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(influxTagEscaper.Replace(key))
+		buffer.WriteByte('=')
+		buffer.WriteString(strconv.FormatFloat(data.Data[key], 'g', -1, 64))
+	}
+	buffer.WriteByte(' ')
+	buffer.WriteString(strconv.FormatInt(data.Timestamp, 10))
+	buffer.WriteByte('\n')
+}
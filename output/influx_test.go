@@ -0,0 +1,129 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	"../nmea"
+)
+
+func influxRecord(dataType string, talker string, timestamp int64, fields nmea.DataMap) *nmea.Data {
+	data := nmea.NewSensorData(dataType, 7, fields)
+	data.Talker = talker
+	data.Timestamp = timestamp
+	return data
+}
+
+func TestAppendInfluxLine(t *testing.T) {
+	tests := []struct {
+		name string
+		data *nmea.Data
+		want string
+	}{
+		{
+			name: "fields sorted, device id as tag",
+			data: influxRecord("RMC", "GP", 100, nmea.DataMap{"speed": 5.5, "latitude": 54.25}),
+			want: "RMC,device=7,talker=GP latitude=54.25,speed=5.5 100\n",
+		},
+		{
+			name: "without talker",
+			data: influxRecord("BME280", "", 100, nmea.DataMap{"pressure": 1013}),
+			want: "BME280,device=7 pressure=1013 100\n",
+		},
+		{
+			name: "measurement escaped",
+			data: influxRecord("a b,c", "", 1, nmea.DataMap{"v": 1}),
+			want: "a\\ b\\,c,device=7 v=1 1\n",
+		},
+		{
+			name: "tags and field keys escaped",
+			data: influxRecord("T", "x=y z", 1, nmea.DataMap{"a,b=c d": 2}),
+			want: "T,device=7,talker=x\\=y\\ z a\\,b\\=c\\ d=2 1\n",
+		},
+		{
+			name: "values that are not finite are left out",
+			data: influxRecord("T", "", 1, nmea.DataMap{"nan": math.NaN(), "inf": math.Inf(1), "v": -0.125}),
+			want: "T,device=7 v=-0.125 1\n",
+		},
+		{
+			name: "record without a finite value is skipped",
+			data: influxRecord("T", "", 1, nmea.DataMap{"nan": math.NaN()}),
+			want: "",
+		},
+		{
+			name: "record without a type is skipped",
+			data: influxRecord("", "", 1, nmea.DataMap{"v": 1}),
+			want: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			appendInfluxLine(&buffer, test.data)
+			if got := buffer.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInfluxEncodeEmpty(t *testing.T) {
+	ix, err := NewInflux(InfluxConfig{URL: "http://shore:8086", Database: "nmea"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ix.Encode([]*nmea.Data{influxRecord("T", "", 1, nmea.DataMap{})})
+	if err != nil || body != nil {
+		t.Errorf("got %q, error %v, want nil", body, err)
+	}
+}
+
+func TestNewInflux(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  InfluxConfig
+		url     string
+		auth    string
+		invalid bool
+	}{
+		{
+			name:   "1.x database",
+			config: InfluxConfig{URL: "http://shore:8086/", Database: "nmea"},
+			url:    "http://shore:8086/write?db=nmea&precision=s",
+		},
+		{
+			name:   "2.x bucket",
+			config: InfluxConfig{URL: "https://shore", Org: "boat", Bucket: "log", Token: "secret"},
+			url:    "https://shore/api/v2/write?bucket=log&org=boat&precision=s",
+			auth:   "Token secret",
+		},
+		{name: "no database", config: InfluxConfig{URL: "http://shore:8086"}, invalid: true},
+		{name: "no scheme", config: InfluxConfig{URL: "shore:8086", Database: "nmea"}, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ix, err := NewInflux(test.config)
+			if test.invalid {
+				if err == nil {
+					t.Error("invalid config accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, err := ix.Request(context.Background(), []byte("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := request.URL.String(); got != test.url {
+				t.Errorf("url %q, want %q", got, test.url)
+			}
+			if got := request.Header.Get("Authorization"); got != test.auth {
+				t.Errorf("authorization %q, want %q", got, test.auth)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"../Error"
+	"../nmea"
+)
+
+const (
+	ErrFlag string = "[output]"
+
+	defaultQueueSize     int = 1024
+	defaultBatchSize     int = 500
+	defaultMaxPending    int = 100000
+	defaultBatchInterval     = time.Second
+	defaultRetryMin          = time.Second
+	defaultRetryMax          = time.Minute
+	requestTimeout           = 10 * time.Second
+)
+
+// Sink turns records into requests of one remote service
+type Sink interface {
+	Name() string
+	// Encode returns the request body, nil if no record holds a value
+	Encode(records []*nmea.Data) ([]byte, error)
+	Request(ctx context.Context, body []byte) (*http.Request, error)
+}
+
+// Engine forwards records to a sink in batches. Records keep coming in
+// while the remote service is unreachable, they are sent once it answers
+// again, the oldest are dropped once maxPending of them wait.
+type Engine struct {
+	sink      Sink
+	client    *http.Client
+	errorChan chan<- *Error.Error
+	queue     chan *nmea.Data
+	done      chan bool
+	deadline  time.Time
+
+	batchSize     int
+	batchInterval time.Duration
+	maxPending    int
+	retryMin      time.Duration
+	retryMax      time.Duration
+
+	sent    int64
+	dropped int64
+}
+
+// New starts forwarding to sink, client may be nil for the default client
+func New(sink Sink, client *http.Client, errorChan chan<- *Error.Error) *Engine {
+	if client == nil {
+		client = &http.Client{Timeout: requestTimeout}
+	}
+	e := &Engine{
+		sink:          sink,
+		client:        client,
+		errorChan:     errorChan,
+		queue:         make(chan *nmea.Data, defaultQueueSize),
+		done:          make(chan bool),
+		batchSize:     defaultBatchSize,
+		batchInterval: defaultBatchInterval,
+		maxPending:    defaultMaxPending,
+		retryMin:      defaultRetryMin,
+		retryMax:      defaultRetryMax,
+	}
+	go e.routine()
+	return e
+}
+
+// Send hands a record to the output without blocking, a slow remote service
+// must not hold back the logger. The record is dropped if the queue is full.
+func (e *Engine) Send(data *nmea.Data) {
+	select {
+	case e.queue <- data:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Stop sends what is pending until timeout passed. It must not be called
+// before the last Send returned. It returns false if records were dropped.
+func (e *Engine) Stop(timeout time.Duration) bool {
+	e.deadline = time.Now().Add(timeout)
+	close(e.queue)
+	<-e.done
+
+	sent := atomic.LoadInt64(&e.sent)
+	dropped := atomic.LoadInt64(&e.dropped)
+	e.errorChan <- Error.New(Error.Info,
+		e.sink.Name()+": "+strconv.FormatInt(sent, 10)+" records sent, "+
+			strconv.FormatInt(dropped, 10)+" dropped",
+		ErrFlag)
+	return dropped == 0
+}
+
+func (e *Engine) routine() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.batchInterval)
+	defer ticker.Stop()
+
+	pending := make([]*nmea.Data, 0)
+	var retryAt time.Time
+	backoff := e.retryMin
+
+	flush := func() {
+		for len(pending) > 0 && !time.Now().Before(retryAt) {
+			n := len(pending)
+			if n > e.batchSize {
+				n = e.batchSize
+			}
+			retry, err := e.send(pending[:n])
+			switch {
+			case err == nil:
+				if backoff > e.retryMin {
+					e.errorChan <- Error.New(Error.Info,
+						e.sink.Name()+" is reachable again",
+						ErrFlag)
+				}
+				backoff = e.retryMin
+			case retry:
+				if backoff == e.retryMin {
+					e.errorChan <- Error.New(Error.Warning,
+						e.sink.Name()+" unreachable, retrying: "+err.Error(),
+						ErrFlag)
+				}
+				retryAt = time.Now().Add(backoff)
+				if backoff *= 2; backoff > e.retryMax {
+					backoff = e.retryMax
+				}
+				return
+			default:
+				e.errorChan <- Error.New(Error.Low,
+					e.sink.Name()+" refused "+strconv.Itoa(n)+" records: "+err.Error(),
+					ErrFlag)
+				atomic.AddInt64(&e.dropped, int64(n))
+			}
+			pending = pending[n:]
+		}
+	}
+
+	for {
+		select {
+		case data, ok := <-e.queue:
+			if !ok {
+				// send the rest until the deadline of Stop
+				for flush(); len(pending) > 0 && retryAt.Before(e.deadline); flush() {
+					time.Sleep(time.Until(retryAt))
+				}
+				atomic.AddInt64(&e.dropped, int64(len(pending)))
+				return
+			}
+			pending = append(pending, data)
+			if over := len(pending) - e.maxPending; over > 0 {
+				pending = pending[over:]
+				atomic.AddInt64(&e.dropped, int64(over))
+			}
+			if len(pending) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send returns if a failed request is worth retrying and the error
+func (e *Engine) send(records []*nmea.Data) (bool, error) {
+	body, err := e.sink.Encode(records)
+	if err != nil {
+		return false, err
+	}
+	if body == nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	request, err := e.sink.Request(ctx, body)
+	if err != nil {
+		return false, err
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		io.Copy(ioutil.Discard, response.Body)
+		atomic.AddInt64(&e.sent, int64(len(records)))
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 256))
+	err = errors.New(response.Status + ": " + string(message))
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, err
+}
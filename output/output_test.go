@@ -0,0 +1,185 @@
+package output
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+)
+
+// standIn answers the writes with the given status codes in turn, the last
+// one for all further requests, and keeps the bodies
+type standIn struct {
+	server   *httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	bodies   []string
+	times    []time.Time
+}
+
+func newStandIn(statuses ...int) *standIn {
+	s := &standIn{statuses: statuses}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.lock.Lock()
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		s.bodies = append(s.bodies, string(body))
+		s.times = append(s.times, time.Now())
+		s.lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *standIn) requests() ([]string, []time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.bodies...), append([]time.Time(nil), s.times...)
+}
+
+// newTestEngine starts an engine with a short retry delay that writes line
+// protocol to the stand-in
+func newTestEngine(t *testing.T, s *standIn, batchSize int, batchInterval time.Duration) (*Engine, chan *Error.Error) {
+	sink, err := NewInflux(InfluxConfig{URL: s.server.URL, Database: "nmea"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorChan := make(chan *Error.Error, 1024)
+	e := &Engine{
+		sink:          sink,
+		client:        s.server.Client(),
+		errorChan:     errorChan,
+		queue:         make(chan *nmea.Data, defaultQueueSize),
+		done:          make(chan bool),
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		maxPending:    defaultMaxPending,
+		retryMin:      20 * time.Millisecond,
+		retryMax:      time.Second,
+	}
+	go e.routine()
+	return e, errorChan
+}
+
+func sendRecords(e *Engine, count int) {
+	for i := 0; i < count; i++ {
+		e.Send(influxRecord("T", "", int64(i), nmea.DataMap{"v": float64(i)}))
+	}
+}
+
+func countLines(bodies []string) int {
+	lines := 0
+	for _, body := range bodies {
+		lines += strings.Count(body, "\n")
+	}
+	return lines
+}
+
+func TestEngineBatches(t *testing.T) {
+	s := newStandIn(http.StatusNoContent)
+	defer s.server.Close()
+	e, _ := newTestEngine(t, s, 3, time.Hour)
+
+	sendRecords(e, 7)
+	if !e.Stop(time.Second) {
+		t.Error("records dropped")
+	}
+	bodies, _ := s.requests()
+	if len(bodies) != 3 {
+		t.Fatalf("got %d requests, want 3", len(bodies))
+	}
+	for i, want := range []int{3, 3, 1} {
+		if got := strings.Count(bodies[i], "\n"); got != want {
+			t.Errorf("request %d holds %d records, want %d", i, got, want)
+		}
+	}
+	if !strings.HasPrefix(bodies[0], "T,device=7 v=0 0\n") {
+		t.Errorf("unexpected body %q", bodies[0])
+	}
+	if sent := atomic.LoadInt64(&e.sent); sent != 7 {
+		t.Errorf("sent %d, want 7", sent)
+	}
+}
+
+func TestEngineRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+	}{
+		{"server error", []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusNoContent}},
+		{"too many requests", []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusNoContent}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStandIn(test.statuses...)
+			defer s.server.Close()
+			e, _ := newTestEngine(t, s, 10, 5*time.Millisecond)
+
+			sendRecords(e, 4)
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt64(&e.sent) < 4 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if !e.Stop(time.Second) {
+				t.Error("records dropped")
+			}
+
+			bodies, times := s.requests()
+			if len(bodies) != 3 {
+				t.Fatalf("got %d requests, want 3", len(bodies))
+			}
+			for _, body := range bodies[1:] {
+				if body != bodies[0] {
+					t.Errorf("retry sent %q, want %q", body, bodies[0])
+				}
+			}
+			// the delay doubles from retryMin
+			if gap := times[1].Sub(times[0]); gap < e.retryMin {
+				t.Errorf("first retry after %v, want at least %v", gap, e.retryMin)
+			}
+			if gap := times[2].Sub(times[1]); gap < 2*e.retryMin {
+				t.Errorf("second retry after %v, want at least %v", gap, 2*e.retryMin)
+			}
+		})
+	}
+}
+
+func TestEngineDoesNotRetryClientErrors(t *testing.T) {
+	s := newStandIn(http.StatusBadRequest, http.StatusNoContent)
+	defer s.server.Close()
+	e, errorChan := newTestEngine(t, s, 10, 5*time.Millisecond)
+
+	sendRecords(e, 4)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&e.dropped) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(5 * e.retryMin)
+	if e.Stop(time.Second) {
+		t.Error("refused records not reported as dropped")
+	}
+
+	bodies, _ := s.requests()
+	if len(bodies) != 1 || countLines(bodies) != 4 {
+		t.Errorf("got %d requests with %d records, want 1 with 4", len(bodies), countLines(bodies))
+	}
+	refused := false
+	for len(errorChan) > 0 {
+		if err := <-errorChan; err.Lvl == Error.Low && strings.Contains(err.Text, "refused 4 records") {
+			refused = true
+		}
+	}
+	if !refused {
+		t.Error("refusal not reported")
+	}
+}
@@ -0,0 +1,162 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/golang/snappy"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../nmea"
+)
+
+// Prometheus sends records with the remote write protocol. Every field
+// becomes a series named nmea_<type>_<field> with the labels device and
+// talker. The protobuf messages are small enough to be encoded here:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+type Prometheus struct {
+	writeURL string
+}
+
+func NewPrometheus(writeURL string) (*Prometheus, error) {
+	parsed, err := url.Parse(writeURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return nil, errors.New(ErrFlag + ": invalid prometheus remote write url " + writeURL)
+	}
+	return &Prometheus{writeURL: writeURL}, nil
+}
+
+func (p *Prometheus) Name() string {
+	return "prometheus"
+}
+
+// prometheusSeries collects the samples of one series in a batch, records
+// only have a resolution of a second, so of several samples with the same
+// timestamp the last one is kept. Prometheus rejects the whole request
+// otherwise.
+type prometheusSeries struct {
+	labels     [][2]string
+	timestamps []int64
+	values     map[int64]float64
+}
+
+func (p *Prometheus) Encode(records []*nmea.Data) ([]byte, error) {
+	series := make(map[string]*prometheusSeries)
+	order := make([]string, 0)
+	for _, data := range records {
+		for key, value := range data.Data {
+			if key == "deviceid" || math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			// labels sorted by name
+			labels := [][2]string{
+				{"__name__", prometheusName(data.Type, key)},
+				{"device", strconv.FormatInt(data.DeviceID(), 10)},
+			}
+			if data.Talker != "" {
+				labels = append(labels, [2]string{"talker", data.Talker})
+			}
+			id := labels[0][1] + "\xff" + labels[1][1] + "\xff" + data.Talker
+
+			current, ok := series[id]
+			if !ok {
+				current = &prometheusSeries{labels: labels, values: make(map[int64]float64)}
+				series[id] = current
+				order = append(order, id)
+			}
+			if _, ok := current.values[data.Timestamp]; !ok {
+				current.timestamps = append(current.timestamps, data.Timestamp)
+			}
+			current.values[data.Timestamp] = value
+		}
+	}
+	if len(order) == 0 {
+		return nil, nil
+	}
+	sort.Strings(order)
+
+	request := make([]byte, 0, 64*len(records))
+	for _, id := range order {
+		current := series[id]
+		var encoded []byte
+		for _, label := range current.labels {
+			var pair []byte
+			pair = protoString(pair, 1, label[0])
+			pair = protoString(pair, 2, label[1])
+			encoded = protoBytes(encoded, 1, pair)
+		}
+		sort.Slice(current.timestamps, func(i, j int) bool { return current.timestamps[i] < current.timestamps[j] })
+		for _, timestamp := range current.timestamps {
+			var sample []byte
+			sample = protoDouble(sample, 1, current.values[timestamp])
+			sample = protoVarint(sample, 2, uint64(timestamp*1000))
+			encoded = protoBytes(encoded, 2, sample)
+		}
+		request = protoBytes(request, 1, encoded)
+	}
+	return snappy.Encode(nil, request), nil
+}
+
+func (p *Prometheus) Request(ctx context.Context, body []byte) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return request, nil
+}
+
+// prometheusName builds a metric name, characters other than letters,
+// digits and underscores are replaced
+func prometheusName(dataType string, field string) string {
+	name := strings.ToLower("nmea_" + dataType + "_" + field)
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func protoUvarint(buffer []byte, value uint64) []byte {
+	for value >= 0x80 {
+		buffer = append(buffer, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(buffer, byte(value))
+}
+
+func protoKey(buffer []byte, field uint64, wireType uint64) []byte {
+	return protoUvarint(buffer, field<<3|wireType)
+}
+
+func protoVarint(buffer []byte, field uint64, value uint64) []byte {
+	return protoUvarint(protoKey(buffer, field, 0), value)
+}
+
+func protoDouble(buffer []byte, field uint64, value float64) []byte {
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], math.Float64bits(value))
+	return append(protoKey(buffer, field, 1), encoded[:]...)
+}
+
+func protoBytes(buffer []byte, field uint64, value []byte) []byte {
+	buffer = protoUvarint(protoKey(buffer, field, 2), uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func protoString(buffer []byte, field uint64, value string) []byte {
+	return protoBytes(buffer, field, []byte(value))
+}
@@ -0,0 +1,260 @@
+package output
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"../Error"
+	"../nmea"
+)
+
+type decodedSample struct {
+	value     float64
+	timestamp int64
+}
+
+type decodedSeries struct {
+	labels  map[string]string
+	samples []decodedSample
+}
+
+// decodeWriteRequest reads the remote write body back, it only knows the
+// fields Encode writes
+func decodeWriteRequest(body []byte) ([]decodedSeries, error) {
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	series := make([]decodedSeries, 0)
+	err = decodeFields(request, func(field uint64, value []byte, _ uint64) error {
+		current := decodedSeries{labels: map[string]string{}}
+		err := decodeFields(value, func(field uint64, value []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var name, labelValue string
+				err := decodeFields(value, func(field uint64, value []byte, _ uint64) error {
+					if field == 1 {
+						name = string(value)
+					} else {
+						labelValue = string(value)
+					}
+					return nil
+				})
+				current.labels[name] = labelValue
+				return err
+			default:
+				var sample decodedSample
+				err := decodeFields(value, func(field uint64, value []byte, number uint64) error {
+					if field == 1 {
+						sample.value = math.Float64frombits(number)
+					} else {
+						sample.timestamp = int64(number)
+					}
+					return nil
+				})
+				current.samples = append(current.samples, sample)
+				return err
+			}
+		})
+		series = append(series, current)
+		return err
+	})
+	return series, err
+}
+
+// decodeFields calls fn with the bytes of length delimited fields and the
+// number of varint and fixed64 fields
+func decodeFields(buffer []byte, fn func(field uint64, value []byte, number uint64) error) error {
+	for len(buffer) > 0 {
+		key, n := binary.Uvarint(buffer)
+		if n <= 0 {
+			return errors.New("bad key")
+		}
+		buffer = buffer[n:]
+		var err error
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(buffer)
+			if n <= 0 {
+				return errors.New("bad varint")
+			}
+			buffer = buffer[n:]
+			err = fn(key>>3, nil, value)
+		case 1:
+			if len(buffer) < 8 {
+				return errors.New("short fixed64")
+			}
+			err = fn(key>>3, nil, binary.LittleEndian.Uint64(buffer))
+			buffer = buffer[8:]
+		case 2:
+			length, n := binary.Uvarint(buffer)
+			if n <= 0 || uint64(len(buffer)-n) < length {
+				return errors.New("bad length")
+			}
+			err = fn(key>>3, buffer[n:n+int(length)], 0)
+			buffer = buffer[n+int(length):]
+		default:
+			return errors.New("unexpected wire type")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prometheusRecord(timestamp int64, deviceID int64, talker string, fields nmea.DataMap) *nmea.Data {
+	data := nmea.NewSensorData("RMC", deviceID, fields)
+	data.Talker = talker
+	data.Timestamp = timestamp
+	return data
+}
+
+func TestPrometheusEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []*nmea.Data
+		want    []decodedSeries
+	}{
+		{
+			name:    "one series per field",
+			records: []*nmea.Data{prometheusRecord(100, 1, "GP", nmea.DataMap{"speed": 5, "truecourse": 90})},
+			want: []decodedSeries{
+				{
+					labels:  map[string]string{"__name__": "nmea_rmc_speed", "device": "1", "talker": "GP"},
+					samples: []decodedSample{{5, 100000}},
+				},
+				{
+					labels:  map[string]string{"__name__": "nmea_rmc_truecourse", "device": "1", "talker": "GP"},
+					samples: []decodedSample{{90, 100000}},
+				},
+			},
+		},
+		{
+			name: "last sample of a second wins",
+			records: []*nmea.Data{
+				prometheusRecord(101, 1, "", nmea.DataMap{"speed": 2}),
+				prometheusRecord(100, 1, "", nmea.DataMap{"speed": 1}),
+				prometheusRecord(101, 1, "", nmea.DataMap{"speed": 3}),
+			},
+			want: []decodedSeries{
+				{
+					labels:  map[string]string{"__name__": "nmea_rmc_speed", "device": "1"},
+					samples: []decodedSample{{1, 100000}, {3, 101000}},
+				},
+			},
+		},
+		{
+			name: "devices are separate series",
+			records: []*nmea.Data{
+				prometheusRecord(100, 2, "", nmea.DataMap{"speed": 2}),
+				prometheusRecord(100, 1, "", nmea.DataMap{"speed": 1, "nan": math.NaN()}),
+			},
+			want: []decodedSeries{
+				{
+					labels:  map[string]string{"__name__": "nmea_rmc_speed", "device": "1"},
+					samples: []decodedSample{{1, 100000}},
+				},
+				{
+					labels:  map[string]string{"__name__": "nmea_rmc_speed", "device": "2"},
+					samples: []decodedSample{{2, 100000}},
+				},
+			},
+		},
+	}
+
+	p, err := NewPrometheus("http://shore:9090/api/v1/write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := p.Encode(test.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeWriteRequest(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusEncodeEmpty(t *testing.T) {
+	p, _ := NewPrometheus("http://shore:9090/api/v1/write")
+	body, err := p.Encode([]*nmea.Data{prometheusRecord(1, 1, "", nmea.DataMap{"nan": math.NaN()})})
+	if err != nil || body != nil {
+		t.Errorf("got %q, error %v, want nil", body, err)
+	}
+}
+
+func TestPrometheusName(t *testing.T) {
+	tests := []struct{ dataType, field, want string }{
+		{"RMC", "speed", "nmea_rmc_speed"},
+		{"RAWGPGGA", "field-1", "nmea_rawgpgga_field_1"},
+		{"BME280", "temp.°C", "nmea_bme280_temp__c"},
+	}
+	for _, test := range tests {
+		if got := prometheusName(test.dataType, test.field); got != test.want {
+			t.Errorf("prometheusName(%q, %q) = %q, want %q", test.dataType, test.field, got, test.want)
+		}
+	}
+}
+
+func TestPrometheusRemoteWrite(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewPrometheus(server.URL + "/api/v1/write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorChan := make(chan *Error.Error, 16)
+	e := New(sink, server.Client(), errorChan)
+	e.Send(prometheusRecord(100, 1, "GP", nmea.DataMap{"speed": 5}))
+	if !e.Stop(time.Second) {
+		t.Error("records dropped")
+	}
+
+	request := <-received
+	for header, want := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := request.Header.Get(header); got != want {
+			t.Errorf("%s: %q, want %q", header, got, want)
+		}
+	}
+	series, err := decodeWriteRequest(<-bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []decodedSeries{{
+		labels:  map[string]string{"__name__": "nmea_rmc_speed", "device": "1", "talker": "GP"},
+		samples: []decodedSample{{5, 100000}},
+	}}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("got %+v, want %+v", series, want)
+	}
+}
@@ -0,0 +1,141 @@
+package sensors
+
+import (
+	"../nmea"
+	"./config"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ads1115RegConversion byte = 0x00
+	ads1115RegConfig     byte = 0x01
+
+	// start a single conversion, compared to ground, comparator disabled
+	ads1115StartSingle uint16 = 0x8000
+	ads1115SingleEnded uint16 = 0x4000
+	ads1115ModeSingle  uint16 = 0x0100
+	ads1115CompDisable uint16 = 0x0003
+
+	ads1115DefaultGain string = "4.096"
+	ads1115DefaultRate string = "128"
+
+	dataTypeTank string = "TANK"
+)
+
+// register codes by full scale voltage and samples per second
+var (
+	ads1115Gains = map[string]uint16{
+		"6.144": 0, "4.096": 1, "2.048": 2, "1.024": 3, "0.512": 4, "0.256": 5,
+	}
+	ads1115Rates = map[string]uint16{
+		"8": 0, "16": 1, "32": 2, "64": 3, "128": 4, "250": 5, "475": 6, "860": 7,
+	}
+)
+
+type ads1115Channel struct {
+	input      uint16
+	name       string
+	config     uint16
+	conversion time.Duration
+	curve      curve
+}
+
+type ads1115 struct {
+	conn     *I2CConnection
+	channels []ads1115Channel
+}
+
+func readAds1115(conn *I2CConnection) error {
+	dev := &ads1115{conn: conn}
+	for _, input := range strings.Split(conn.config.String(config.ParamChannels, "0"), ",") {
+		channel, err := newAds1115Channel(conn.config, strings.TrimSpace(input))
+		if err != nil {
+			return err
+		}
+		dev.channels = append(dev.channels, *channel)
+	}
+
+	conn.poll(dataTypeTank, conn.interval(), dev.sense)
+	return nil
+}
+
+func newAds1115Channel(cfg *config.I2CConfig, input string) (*ads1115Channel, error) {
+	number, err := strconv.ParseUint(input, 10, 8)
+	if err != nil || number > 3 {
+		return nil, errors.New("ads1115: invalid channel " + input)
+	}
+	gain, ok := ads1115Gains[cfg.String(config.ParamGain+input, ads1115DefaultGain)]
+	if !ok {
+		return nil, errors.New("ads1115: invalid gain for channel " + input)
+	}
+	rateValue := cfg.String(config.ParamRate+input, ads1115DefaultRate)
+	rate, ok := ads1115Rates[rateValue]
+	if !ok {
+		return nil, errors.New("ads1115: invalid rate for channel " + input)
+	}
+	samplesPerSecond, _ := strconv.Atoi(rateValue)
+
+	channel := &ads1115Channel{
+		input: uint16(number),
+		name:  cfg.String(config.ParamName+input, "channel"+input),
+		config: ads1115StartSingle | ads1115SingleEnded | uint16(number)<<12 |
+			gain<<9 | ads1115ModeSingle | rate<<5 | ads1115CompDisable,
+		conversion: time.Second/time.Duration(samplesPerSecond) + time.Millisecond,
+	}
+	if curveValue := cfg.String(config.ParamCurve+input, ""); curveValue != "" {
+		channel.curve, err = parseCurve(curveValue)
+		if err != nil {
+			return nil, errors.New("ads1115: channel " + input + ": " + err.Error())
+		}
+	}
+	return channel, nil
+}
+
+// sense converts the channels one after another, each reading is stored raw
+// and, if the channel has a calibration curve, as calibrated value
+func (dev *ads1115) sense() (nmea.DataMap, error) {
+	fields := nmea.DataMap{}
+	for _, channel := range dev.channels {
+		raw, err := dev.convert(channel)
+		if err != nil {
+			return nil, err
+		}
+		fields[channel.name+transformRawSuffix] = raw
+		if channel.curve != nil {
+			fields[channel.name] = channel.curve.apply(raw)
+		}
+	}
+	return fields, nil
+}
+
+func (dev *ads1115) convert(channel ads1115Channel) (float64, error) {
+	i2cDev := dev.conn.dev()
+	err := i2cDev.Tx([]byte{ads1115RegConfig, byte(channel.config >> 8), byte(channel.config)}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	buffer := make([]byte, 2)
+	for i := 0; ; i++ {
+		time.Sleep(channel.conversion)
+		if err = i2cDev.Tx([]byte{ads1115RegConfig}, buffer); err != nil {
+			return 0, err
+		}
+		// the start bit reads 1 again when the conversion is done
+		if buffer[0]&0x80 != 0 {
+			break
+		}
+		if i == 10 {
+			return 0, errors.New("ads1115: conversion of channel " +
+				strconv.Itoa(int(channel.input)) + " did not finish")
+		}
+	}
+
+	if err = i2cDev.Tx([]byte{ads1115RegConversion}, buffer); err != nil {
+		return 0, err
+	}
+	return float64(int16(uint16(buffer[0])<<8 | uint16(buffer[1]))), nil
+}
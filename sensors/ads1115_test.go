@@ -0,0 +1,53 @@
+package sensors
+
+import (
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"reflect"
+	"testing"
+	"time"
+
+	"../nmea"
+	"./config"
+)
+
+func TestAds1115Sense(t *testing.T) {
+	cfg, err := config.NewI2C(map[string]string{
+		config.ParamDevice:      devAds1115,
+		config.ParamAddress:     "0x48",
+		config.ParamChannels:    "0",
+		config.ParamName + "0":  "fresh",
+		config.ParamRate + "0":  "860",
+		config.ParamCurve + "0": "0:0,9320:100",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := newAds1115Channel(cfg, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// single shot on input 0 against ground, 4.096 V, 860 samples per second
+	playback := &i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			{Addr: 0x48, W: []byte{ads1115RegConfig, 0xc3, 0xe3}},
+			{Addr: 0x48, W: []byte{ads1115RegConfig}, R: []byte{0x43, 0xe3}},
+			{Addr: 0x48, W: []byte{ads1115RegConfig}, R: []byte{0xc3, 0xe3}},
+			{Addr: 0x48, W: []byte{ads1115RegConversion}, R: []byte{0x12, 0x34}},
+		},
+	}
+	conn := &I2CConnection{bus: playback, config: cfg, connStats: newConnStats(time.Second)}
+	dev := &ads1115{conn: conn, channels: []ads1115Channel{*channel}}
+
+	fields, err := dev.sense()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := nmea.DataMap{"fresh_raw": 0x1234, "fresh": 50}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got %v, want %v", fields, want)
+	}
+	if err := playback.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,287 @@
+package sensors
+
+import (
+	"../nmea"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	bme680ChipID byte = 0x61
+
+	bme680RegStatus    byte = 0x1d
+	bme680RegResHeat0  byte = 0x5a
+	bme680RegGasWait0  byte = 0x64
+	bme680RegCtrlGas1  byte = 0x71
+	bme680RegCtrlHum   byte = 0x72
+	bme680RegCtrlMeas  byte = 0x74
+	bme680RegConfig    byte = 0x75
+	bme680RegCoeff1    byte = 0x89
+	bme680RegChipID    byte = 0xd0
+	bme680RegReset     byte = 0xe0
+	bme680RegCoeff2    byte = 0xe1
+	bme680RegResHeatV  byte = 0x00
+	bme680RegResHeatR  byte = 0x02
+	bme680RegRangeErr  byte = 0x04
+	bme680SoftReset    byte = 0xb6
+	bme680ModeForced   byte = 0x01
+	bme680NewData      byte = 0x80
+	bme680GasValid     byte = 0x20
+	bme680HeaterStable byte = 0x10
+	bme680RunGas       byte = 0x10
+
+	// oversampling 2x temperature, 16x pressure, 1x humidity, filter 3
+	bme680OsrsT  byte = 0x02
+	bme680OsrsP  byte = 0x05
+	bme680OsrsH  byte = 0x01
+	bme680Filter byte = 0x02
+
+	bme680HeaterTemp     float64 = 320 // °C
+	bme680HeaterDuration         = 150 * time.Millisecond
+
+	dataTypeBme680 string = "BME680"
+)
+
+// gas range correction tables of the data sheet
+var (
+	bme680GasK1 = [16]float64{0, 0, 0, 0, 0, -1, 0, -0.8, 0, 0, -0.2, -0.5, 0, -1, 0, 0}
+	bme680GasK2 = [16]float64{0, 0, 0, 0, 0.1, 0.7, 0, -0.8, -0.1, 0, 0, 0, 0, 0, 0, 0}
+)
+
+type bme680Calibration struct {
+	t1, p1, h1, h2                 float64
+	t2, t3                         float64
+	p2, p3, p4, p5, p6, p7, p8, p9 float64
+	p10                            float64
+	h3, h4, h5, h6, h7             float64
+	gh1, gh2, gh3                  float64
+	resHeatRange, resHeatVal       float64
+	rangeSwitchingError            float64
+}
+
+// bme680 is read in forced mode, one measurement including the gas heater
+// per poll. The BMxx80 driver of periph does not know this chip.
+type bme680 struct {
+	conn        *I2CConnection
+	calib       bme680Calibration
+	ambientTemp float64
+}
+
+func readBme680(conn *I2CConnection) error {
+	dev := &bme680{conn: conn, ambientTemp: 25}
+
+	id, err := dev.readReg(bme680RegChipID, 1)
+	if err != nil {
+		return err
+	}
+	if id[0] != bme680ChipID {
+		return errors.New("unexpected bme680 chip id " + strconv.Itoa(int(id[0])))
+	}
+	if err = dev.writeReg(bme680RegReset, bme680SoftReset); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = dev.readCalibration(); err != nil {
+		return err
+	}
+
+	err = dev.writeReg(bme680RegCtrlHum, bme680OsrsH)
+	if err == nil {
+		err = dev.writeReg(bme680RegConfig, bme680Filter<<2)
+	}
+	if err == nil {
+		err = dev.writeReg(bme680RegGasWait0, bme680DurationCode(bme680HeaterDuration))
+	}
+	if err == nil {
+		err = dev.writeReg(bme680RegCtrlGas1, bme680RunGas)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.poll(dataTypeBme680, conn.interval(), dev.sense)
+	return nil
+}
+
+func (dev *bme680) readReg(reg byte, length int) ([]byte, error) {
+	buffer := make([]byte, length)
+	err := dev.conn.dev().Tx([]byte{reg}, buffer)
+	return buffer, err
+}
+
+func (dev *bme680) writeReg(reg byte, value byte) error {
+	return dev.conn.dev().Tx([]byte{reg, value}, nil)
+}
+
+func (dev *bme680) readCalibration() error {
+	coeff1, err := dev.readReg(bme680RegCoeff1, 25)
+	if err != nil {
+		return err
+	}
+	coeff2, err := dev.readReg(bme680RegCoeff2, 16)
+	if err != nil {
+		return err
+	}
+	c := append(coeff1, coeff2...)
+	heat, err := dev.readReg(bme680RegResHeatV, 5)
+	if err != nil {
+		return err
+	}
+
+	u16 := func(msb, lsb byte) float64 { return float64(uint16(msb)<<8 | uint16(lsb)) }
+	s16 := func(msb, lsb byte) float64 { return float64(int16(uint16(msb)<<8 | uint16(lsb))) }
+	s8 := func(b byte) float64 { return float64(int8(b)) }
+
+	dev.calib = bme680Calibration{
+		t1:  u16(c[34], c[33]),
+		t2:  s16(c[2], c[1]),
+		t3:  s8(c[3]),
+		p1:  u16(c[6], c[5]),
+		p2:  s16(c[8], c[7]),
+		p3:  s8(c[9]),
+		p4:  s16(c[12], c[11]),
+		p5:  s16(c[14], c[13]),
+		p6:  s8(c[16]),
+		p7:  s8(c[15]),
+		p8:  s16(c[20], c[19]),
+		p9:  s16(c[22], c[21]),
+		p10: float64(c[23]),
+		h1:  float64(uint16(c[27])<<4 | uint16(c[26]&0x0f)),
+		h2:  float64(uint16(c[25])<<4 | uint16(c[26]>>4)),
+		h3:  s8(c[28]),
+		h4:  s8(c[29]),
+		h5:  s8(c[30]),
+		h6:  float64(c[31]),
+		h7:  s8(c[32]),
+		gh1: s8(c[37]),
+		gh2: s16(c[36], c[35]),
+		gh3: s8(c[38]),
+
+		resHeatVal:          s8(heat[0]),
+		resHeatRange:        float64((heat[2] & 0x30) >> 4),
+		rangeSwitchingError: float64(int8(heat[4]&0xf0) >> 4),
+	}
+	return nil
+}
+
+func (dev *bme680) sense() (nmea.DataMap, error) {
+	// the heater target depends on the ambient temperature of the last run
+	err := dev.writeReg(bme680RegResHeat0, dev.heaterResistance(bme680HeaterTemp))
+	if err == nil {
+		err = dev.writeReg(bme680RegCtrlMeas, bme680OsrsT<<5|bme680OsrsP<<2|bme680ModeForced)
+	}
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(bme680HeaterDuration)
+
+	var buffer []byte
+	for i := 0; ; i++ {
+		buffer, err = dev.readReg(bme680RegStatus, 15)
+		if err != nil {
+			return nil, err
+		}
+		if buffer[0]&bme680NewData != 0 {
+			break
+		}
+		if i == 20 {
+			return nil, errors.New("bme680 measurement did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	adcPres := float64(uint32(buffer[2])<<12 | uint32(buffer[3])<<4 | uint32(buffer[4])>>4)
+	adcTemp := float64(uint32(buffer[5])<<12 | uint32(buffer[6])<<4 | uint32(buffer[7])>>4)
+	adcHumi := float64(uint16(buffer[8])<<8 | uint16(buffer[9]))
+	adcGas := float64(uint16(buffer[13])<<2 | uint16(buffer[14])>>6)
+	gasRange := buffer[14] & 0x0f
+
+	tFine := dev.temperatureFine(adcTemp)
+	temperature := tFine / 5120.0
+	dev.ambientTemp = temperature
+
+	fields := nmea.DataMap{
+		"temperature": temperature,
+		"humidity":    dev.humidity(adcHumi, temperature),
+		"pressure":    dev.pressure(adcPres, tFine) / 100.0,
+	}
+	if buffer[14]&bme680GasValid != 0 && buffer[14]&bme680HeaterStable != 0 {
+		fields["gasresistance"] = dev.gasResistance(adcGas, gasRange)
+	}
+	return fields, nil
+}
+
+// compensation formulas of the data sheet, floating point variant
+
+func (dev *bme680) temperatureFine(adc float64) float64 {
+	c := &dev.calib
+	var1 := (adc/16384.0 - c.t1/1024.0) * c.t2
+	var2 := (adc/131072.0 - c.t1/8192.0) * (adc/131072.0 - c.t1/8192.0) * (c.t3 * 16.0)
+	return var1 + var2
+}
+
+func (dev *bme680) pressure(adc float64, tFine float64) float64 {
+	c := &dev.calib
+	var1 := tFine/2.0 - 64000.0
+	var2 := var1 * var1 * (c.p6 / 131072.0)
+	var2 = var2 + var1*c.p5*2.0
+	var2 = var2/4.0 + c.p4*65536.0
+	var1 = (c.p3*var1*var1/16384.0 + c.p2*var1) / 524288.0
+	var1 = (1.0 + var1/32768.0) * c.p1
+	if var1 == 0 {
+		return 0
+	}
+
+	pressure := 1048576.0 - adc
+	pressure = (pressure - var2/4096.0) * 6250.0 / var1
+	var1 = c.p9 * pressure * pressure / 2147483648.0
+	var2 = pressure * (c.p8 / 32768.0)
+	var3 := math.Pow(pressure/256.0, 3) * (c.p10 / 131072.0)
+	return pressure + (var1+var2+var3+c.p7*128.0)/16.0
+}
+
+func (dev *bme680) humidity(adc float64, temperature float64) float64 {
+	c := &dev.calib
+	var1 := adc - (c.h1*16.0 + c.h3/2.0*temperature)
+	var2 := var1 * (c.h2 / 262144.0 * (1.0 + c.h4/16384.0*temperature +
+		c.h5/1048576.0*temperature*temperature))
+	var3 := c.h6 / 16384.0
+	var4 := c.h7 / 2097152.0
+	humidity := var2 + (var3+var4*temperature)*var2*var2
+	return math.Max(0, math.Min(100, humidity))
+}
+
+func (dev *bme680) gasResistance(adc float64, gasRange byte) float64 {
+	var1 := 1340.0 + 5.0*dev.calib.rangeSwitchingError
+	var2 := var1 * (1.0 + bme680GasK1[gasRange]/100.0)
+	var3 := 1.0 + bme680GasK2[gasRange]/100.0
+	return 1.0 / (var3 * 0.000000125 * float64(uint32(1)<<gasRange) * ((adc-512.0)/var2 + 1.0))
+}
+
+// heaterResistance returns the register value for the target temperature
+func (dev *bme680) heaterResistance(target float64) byte {
+	c := &dev.calib
+	var1 := c.gh1/16.0 + 49.0
+	var2 := c.gh2/32768.0*0.0005 + 0.00235
+	var3 := c.gh3 / 1024.0
+	var4 := var1 * (1.0 + var2*target)
+	var5 := var4 + var3*dev.ambientTemp
+	return byte(3.4 * (var5*(4.0/(4.0+c.resHeatRange))*(1.0/(1.0+c.resHeatVal*0.002)) - 25))
+}
+
+// bme680DurationCode encodes the heater duration as 6 bit value and 2 bit
+// multiplication factor of 1, 4, 16 or 64
+func bme680DurationCode(duration time.Duration) byte {
+	ms := duration.Milliseconds()
+	if ms >= 0xfc0 {
+		return 0xff
+	}
+	factor := byte(0)
+	for ms > 0x3f {
+		ms /= 4
+		factor++
+	}
+	return byte(ms) + factor*64
+}
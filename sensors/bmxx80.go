@@ -13,60 +13,153 @@ import (
 	"./config"
 )
 
+var bmxx80Oversampling = map[string]bmxx80.Oversampling{
+	"off": bmxx80.Off,
+	"0":   bmxx80.Off,
+	"1":   bmxx80.O1x,
+	"2":   bmxx80.O2x,
+	"4":   bmxx80.O4x,
+	"8":   bmxx80.O8x,
+	"16":  bmxx80.O16x,
+}
+
+var bmxx80Filter = map[string]bmxx80.Filter{
+	"off": bmxx80.NoFilter,
+	"0":   bmxx80.NoFilter,
+	"2":   bmxx80.F2,
+	"4":   bmxx80.F4,
+	"8":   bmxx80.F8,
+	"16":  bmxx80.F16,
+}
+
 func readBmxx80(conn *I2CConnection) error {
+	cfg := conn.config
 
-	cfg, err := config.I2CFromInterface(conn.config)
+	devOpts, err := bmxx80Options(cfg)
 	if err != nil {
 		return err
 	}
-
-	// define filter settings and oversampling
-	devOpts := bmxx80.Opts{
-		Temperature: bmxx80.O16x,
-		Pressure:    bmxx80.O16x,
-		Humidity:    bmxx80.O16x,
-		Filter:      bmxx80.F16,
+	mode := cfg.String(config.ParamMode, config.ModeContinuous)
+	if mode != config.ModeContinuous && mode != config.ModeForced {
+		return errors.New(ErrI2CFlag + ": invalid value for " + config.ParamMode + ": " + mode)
 	}
 
-	dev, err := bmxx80.NewI2C(conn.bus, cfg.Address(), &devOpts)
+	dev, err := bmxx80.NewI2C(conn.bus, cfg.Address(), devOpts)
 	if err != nil {
 		return err
 	}
 	conn.error(errors.New("devBmxx80 was opened"))
-	conn.stop = dev.Halt
 
-	envCh, err := dev.SenseContinuous(time.Second)
+	if mode == config.ModeForced {
+		conn.senseBmxx80Forced(dev)
+		return nil
+	}
+
+	conn.stop = dev.Halt
+	envCh, err := dev.SenseContinuous(conn.interval())
 	if err != nil {
 		return err
 	}
 	conn.error(errors.New("devBmxx80 is in continuous sense mode"))
+	conn.swapState(StateRunning)
+	conn.engine.routines.Add(1)
 	go func() {
+		defer conn.engine.routines.Done()
 		for !conn.IsStopped() {
 
 			select {
 			case env, chOpen := <-envCh:
 				if chOpen != true {
-					conn.error(errors.New("channel to devBmxx80 was closed"), Error.Low)
+					if !conn.IsStopped() {
+						conn.error(errors.New("channel to devBmxx80 was closed"), Error.Low)
+					}
 					return
 				}
+				conn.sendBmxx80(env)
+			}
+		}
+	}()
+	return nil
+}
+
+// senseBmxx80Forced triggers a single measurement every interval, the sensor
+// sleeps in between
+func (ic *I2CConnection) senseBmxx80Forced(dev *bmxx80.Dev) {
+	stopChan := make(chan bool)
+	ic.stop = func() error {
+		close(stopChan)
+		return dev.Halt()
+	}
+	ic.error(errors.New("devBmxx80 is in forced sense mode"))
+	ic.swapState(StateRunning)
 
-				temp := int(env.Temperature / (physic.MilliKelvin)) // milli kelvin
-				humi := int(env.Humidity / physic.MilliRH)          // tenth percent rH
-				pres := int(env.Pressure / (physic.Pascal))         // pascals
-				nmeaSentence := "$--PAD,"
-				nmeaSentence += strconv.Itoa(temp) + ","
-				nmeaSentence += strconv.Itoa(humi) + ","
-				nmeaSentence += strconv.Itoa(pres) + ",*PP" //TODO implement NMEA checksum
-
-				nmeaData, err := nmea.NewData(nmeaSentence, cfg.DeviceID())
-				if err != nil {
-					conn.error(err, Error.Low)
-				} else {
-					conn.send(nmeaData)
+	ic.engine.routines.Add(1)
+	go func() {
+		defer ic.engine.routines.Done()
+		ticker := time.NewTicker(ic.interval())
+		defer ticker.Stop()
+
+		for {
+			env := physic.Env{}
+			if err := dev.Sense(&env); err != nil {
+				if !ic.IsStopped() {
+					ic.error(err, Error.Low)
 				}
+			} else {
+				ic.sendBmxx80(env)
+			}
 
+			select {
+			case <-ticker.C:
+			case <-stopChan:
+				return
 			}
 		}
 	}()
-	return nil
+}
+
+func (ic *I2CConnection) sendBmxx80(env physic.Env) {
+	temp := int(env.Temperature / (physic.MilliKelvin)) // milli kelvin
+	humi := int(env.Humidity / physic.MilliRH)          // tenth percent rH
+	pres := int(env.Pressure / (physic.Pascal))         // pascals
+	nmeaSentence := "$--PAD,"
+	nmeaSentence += strconv.Itoa(temp) + ","
+	nmeaSentence += strconv.Itoa(humi) + ","
+	nmeaSentence += strconv.Itoa(pres) + ",*PP" //TODO implement NMEA checksum
+
+	nmeaData, err := nmea.NewData(nmeaSentence, ic.DeviceID())
+	if err != nil {
+		ic.error(err, Error.Low)
+	} else {
+		ic.send(nmeaData)
+	}
+}
+
+// bmxx80Options reads oversampling and filter settings, all default to 16x
+func bmxx80Options(cfg *config.I2CConfig) (*bmxx80.Opts, error) {
+	opts := &bmxx80.Opts{}
+	oversampling := []struct {
+		key   string
+		value *bmxx80.Oversampling
+	}{
+		{config.ParamOversamplingTemperature, &opts.Temperature},
+		{config.ParamOversamplingPressure, &opts.Pressure},
+		{config.ParamOversamplingHumidity, &opts.Humidity},
+	}
+	for _, o := range oversampling {
+		value := cfg.String(o.key, "16")
+		setting, ok := bmxx80Oversampling[value]
+		if !ok {
+			return nil, errors.New(ErrI2CFlag + ": invalid value for " + o.key + ": " + value)
+		}
+		*o.value = setting
+	}
+
+	value := cfg.String(config.ParamFilter, "16")
+	filter, ok := bmxx80Filter[value]
+	if !ok {
+		return nil, errors.New(ErrI2CFlag + ": invalid value for " + config.ParamFilter + ": " + value)
+	}
+	opts.Filter = filter
+	return opts, nil
 }
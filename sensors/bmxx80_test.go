@@ -0,0 +1,109 @@
+package sensors
+
+import (
+	"periph.io/x/periph/devices/bmxx80"
+	"strings"
+	"testing"
+	"time"
+
+	"./config"
+)
+
+func TestBmxx80Options(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap map[string]string
+		want      bmxx80.Opts
+		err       string
+	}{
+		{name: "defaults", configMap: map[string]string{},
+			want: bmxx80.Opts{Temperature: bmxx80.O16x, Pressure: bmxx80.O16x, Humidity: bmxx80.O16x, Filter: bmxx80.F16}},
+		{name: "weather station",
+			configMap: map[string]string{
+				config.ParamOversamplingTemperature: "1",
+				config.ParamOversamplingPressure:    "1",
+				config.ParamOversamplingHumidity:    "1",
+				config.ParamFilter:                  "off",
+			},
+			want: bmxx80.Opts{Temperature: bmxx80.O1x, Pressure: bmxx80.O1x, Humidity: bmxx80.O1x, Filter: bmxx80.NoFilter}},
+		{name: "no humidity",
+			configMap: map[string]string{
+				config.ParamOversamplingTemperature: "2",
+				config.ParamOversamplingPressure:    "8",
+				config.ParamOversamplingHumidity:    "0",
+				config.ParamFilter:                  "4",
+			},
+			want: bmxx80.Opts{Temperature: bmxx80.O2x, Pressure: bmxx80.O8x, Humidity: bmxx80.Off, Filter: bmxx80.F4}},
+		{name: "invalid oversampling", configMap: map[string]string{config.ParamOversamplingPressure: "3"},
+			err: "invalid value for oversampling_pressure: 3"},
+		{name: "invalid filter", configMap: map[string]string{config.ParamFilter: "1"},
+			err: "invalid value for filter: 1"},
+		{name: "invalid mode", configMap: map[string]string{config.ParamMode: "normal"},
+			err: "invalid value for mode: normal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.configMap[config.ParamDevice] = devBmxx80
+			cfg, err := config.NewI2C(test.configMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" {
+				// the settings are checked before the bus is used
+				err = readBmxx80(&I2CConnection{config: cfg})
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			opts, err := bmxx80Options(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *opts != test.want {
+				t.Errorf("got %+v, want %+v", *opts, test.want)
+			}
+		})
+	}
+}
+
+func TestI2CInterval(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap map[string]string
+		interval  time.Duration
+		expected  time.Duration
+		err       string
+	}{
+		{name: "engine interval", configMap: map[string]string{}, interval: 2 * time.Second, expected: 2 * time.Second},
+		{name: "own interval", configMap: map[string]string{config.ParamInterval: "1m"},
+			interval: time.Minute, expected: time.Minute},
+		{name: "expected interval", configMap: map[string]string{config.ParamExpectedInterval: "5s"},
+			interval: 2 * time.Second, expected: 5 * time.Second},
+		{name: "both", configMap: map[string]string{config.ParamInterval: "1m", config.ParamExpectedInterval: "90s"},
+			interval: time.Minute, expected: 90 * time.Second},
+		{name: "zero interval", configMap: map[string]string{config.ParamInterval: "0s"}, err: "invalid value for interval"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.configMap[config.ParamDevice] = devBmxx80
+			cfg, err := config.NewI2C(test.configMap)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &I2CConnection{engine: &Engine{intervalInMs: 2000}, config: cfg}
+			if interval := conn.interval(); interval != test.interval {
+				t.Errorf("interval %v, want %v", interval, test.interval)
+			}
+			if expected := expectedI2CInterval(cfg, conn.engine.interval()); expected != test.expected {
+				t.Errorf("expected interval %v, want %v", expected, test.expected)
+			}
+		})
+	}
+}
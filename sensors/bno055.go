@@ -0,0 +1,163 @@
+package sensors
+
+import (
+	"../Error"
+	"../nmea"
+	"./config"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	bno055ChipID byte = 0xa0
+
+	bno055RegChipID      byte = 0x00
+	bno055RegPageID      byte = 0x07
+	bno055RegGyro        byte = 0x14
+	bno055RegEuler       byte = 0x1a
+	bno055RegCalibStat   byte = 0x35
+	bno055RegOprMode     byte = 0x3d
+	bno055RegPwrMode     byte = 0x3e
+	bno055RegSysTrigger  byte = 0x3f
+	bno055RegCalibration byte = 0x55
+
+	bno055ModeConfig  byte = 0x00
+	bno055ModeNdof    byte = 0x0c
+	bno055PowerNormal byte = 0x00
+	bno055Reset       byte = 0x20
+	// system, gyroscope, accelerometer and magnetometer fully calibrated
+	bno055Calibrated byte = 0xff
+
+	bno055CalibrationLength int = 22
+	// Euler angles and angular rates are given in 1/16 degree
+	bno055LSBPerDegree float64 = 16
+)
+
+// bno055 fuses its sensors itself, it runs in NDOF mode and is only asked for
+// Euler angles. Its calibration offsets are read once all sensors report full
+// calibration and written back on the next start.
+type bno055 struct {
+	conn        *I2CConnection
+	calibrating bool
+}
+
+func readBno055(conn *I2CConnection) error {
+	conn.restoreCalibration()
+	dev := &bno055{conn: conn}
+
+	if err := dev.writeReg(bno055RegSysTrigger, bno055Reset); err != nil {
+		return err
+	}
+	time.Sleep(650 * time.Millisecond)
+	id, err := dev.readReg(bno055RegChipID, 1)
+	if err != nil {
+		return err
+	}
+	if id[0] != bno055ChipID {
+		return errors.New("unexpected bno055 chip id " + strconv.Itoa(int(id[0])))
+	}
+
+	err = dev.writeReg(bno055RegPwrMode, bno055PowerNormal)
+	if err == nil {
+		err = dev.writeReg(bno055RegPageID, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	// offsets can only be written in config mode, which is active after reset
+	if stored := conn.config.String(config.ParamCalibration, ""); stored != "" {
+		offsets, err := hex.DecodeString(stored)
+		if err != nil || len(offsets) != bno055CalibrationLength {
+			return errors.New("bno055: invalid calibration " + stored)
+		}
+		err = conn.dev().Tx(append([]byte{bno055RegCalibration}, offsets...), nil)
+		if err != nil {
+			return err
+		}
+	}
+	if err = dev.setMode(bno055ModeNdof); err != nil {
+		return err
+	}
+
+	dev.calibrating, err = conn.config.Bool(config.ParamCalibrate, false)
+	if err != nil {
+		return err
+	}
+	if dev.calibrating {
+		conn.error(errors.New("bno055 calibration: move the sensor in all directions"), Error.Info)
+	}
+	interval, err := conn.config.Duration(config.ParamInterval, defaultImuInterval)
+	if err != nil {
+		return err
+	}
+
+	conn.poll(dataTypeAttitude, interval, dev.sense)
+	return nil
+}
+
+func (dev *bno055) readReg(reg byte, length int) ([]byte, error) {
+	buffer := make([]byte, length)
+	err := dev.conn.dev().Tx([]byte{reg}, buffer)
+	return buffer, err
+}
+
+func (dev *bno055) writeReg(reg byte, value byte) error {
+	return dev.conn.dev().Tx([]byte{reg, value}, nil)
+}
+
+func (dev *bno055) setMode(mode byte) error {
+	err := dev.writeReg(bno055RegOprMode, mode)
+	// switching takes 7 ms into and 19 ms out of config mode
+	time.Sleep(20 * time.Millisecond)
+	return err
+}
+
+func (dev *bno055) sense() (nmea.DataMap, error) {
+	euler, err := dev.readReg(bno055RegEuler, 6)
+	if err != nil {
+		return nil, err
+	}
+	gyro, err := dev.readReg(bno055RegGyro, 6)
+	if err != nil {
+		return nil, err
+	}
+	if dev.calibrating {
+		if err = dev.checkCalibration(); err != nil {
+			return nil, err
+		}
+	}
+
+	word := func(buffer []byte, i int) float64 {
+		return float64(int16(uint16(buffer[i+1])<<8|uint16(buffer[i]))) / bno055LSBPerDegree
+	}
+	// the z axis points up, a turn to starboard is a negative rotation
+	return attitude(word(euler, 2), word(euler, 4), word(euler, 0), -word(gyro, 4)), nil
+}
+
+// checkCalibration saves the offsets as soon as every sensor is fully
+// calibrated
+func (dev *bno055) checkCalibration() error {
+	status, err := dev.readReg(bno055RegCalibStat, 1)
+	if err != nil || status[0] != bno055Calibrated {
+		return err
+	}
+
+	if err = dev.setMode(bno055ModeConfig); err != nil {
+		return err
+	}
+	offsets, err := dev.readReg(bno055RegCalibration, bno055CalibrationLength)
+	if modeErr := dev.setMode(bno055ModeNdof); err == nil {
+		err = modeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	dev.calibrating = false
+	return dev.conn.saveCalibration(map[string]string{
+		config.ParamCalibration: hex.EncodeToString(offsets),
+	})
+}
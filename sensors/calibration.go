@@ -0,0 +1,148 @@
+package sensors
+
+import (
+	"./config"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CalibrationStore keeps the results of device calibrations, they are applied
+// to the device configuration whenever the device connects
+type CalibrationStore interface {
+	Load(deviceID int64) (map[string]string, error)
+	Save(deviceID int64, params map[string]string) error
+}
+
+// CalibrationFile stores calibrations in a file in the format of the device
+// configuration, every device starts with its deviceid:
+//
+//	deviceid = 1050
+//	gyro_bias = 0.12,-0.3,0.05
+type CalibrationFile struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewCalibrationFile(path string) *CalibrationFile {
+	return &CalibrationFile{path: path}
+}
+
+func (cf *CalibrationFile) String() string {
+	return cf.path
+}
+
+// Load returns the calibration of a device, nil if there is none
+func (cf *CalibrationFile) Load(deviceID int64) (map[string]string, error) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	devices, err := cf.read()
+	if err != nil {
+		return nil, err
+	}
+	return devices[deviceID], nil
+}
+
+// Save replaces the given parameters of a device and keeps the other ones
+func (cf *CalibrationFile) Save(deviceID int64, params map[string]string) error {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	devices, err := cf.read()
+	if err != nil {
+		return err
+	}
+	if devices[deviceID] == nil {
+		devices[deviceID] = map[string]string{}
+	}
+	for key, value := range params {
+		devices[deviceID][key] = value
+	}
+	return cf.write(devices)
+}
+
+func (cf *CalibrationFile) read() (map[int64]map[string]string, error) {
+	devices := map[int64]map[string]string{}
+	content, err := ioutil.ReadFile(cf.path)
+	if os.IsNotExist(err) {
+		return devices, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var current map[string]string
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		position := cf.path + ":" + strconv.Itoa(i+1)
+		separator := strings.Index(line, "=")
+		if separator < 0 {
+			return nil, errors.New(ErrFlag + " " + position + ": expected key = value")
+		}
+		key := strings.TrimSpace(line[:separator])
+		value := strings.TrimSpace(line[separator+1:])
+
+		if key == config.ParamDeviceID {
+			deviceID, err := strconv.ParseInt(value, 0, 64)
+			if err != nil {
+				return nil, errors.New(ErrFlag + " " + position + ": invalid deviceid " + value)
+			}
+			current = map[string]string{}
+			devices[deviceID] = current
+			continue
+		}
+		if current == nil {
+			return nil, errors.New(ErrFlag + " " + position + ": " + key + " before the first deviceid")
+		}
+		current[key] = value
+	}
+	return devices, nil
+}
+
+// write replaces the file at once, so a crash does not leave half of it
+func (cf *CalibrationFile) write(devices map[int64]map[string]string) error {
+	ids := make([]int64, 0, len(devices))
+	for deviceID := range devices {
+		ids = append(ids, deviceID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var content strings.Builder
+	for i, deviceID := range ids {
+		if i > 0 {
+			content.WriteString("\n")
+		}
+		content.WriteString(config.ParamDeviceID + " = " + strconv.FormatInt(deviceID, 10) + "\n")
+		keys := make([]string, 0, len(devices[deviceID]))
+		for key := range devices[deviceID] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			content.WriteString(key + " = " + devices[deviceID][key] + "\n")
+		}
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(cf.path), filepath.Base(cf.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.WriteString(content.String())
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), cf.path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
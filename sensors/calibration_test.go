@@ -0,0 +1,199 @@
+package sensors
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"./config"
+)
+
+func TestCalibrationFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calibration.conf")
+	file := NewCalibrationFile(path)
+
+	// a missing file holds no calibrations
+	params, err := file.Load(1050)
+	if err != nil || params != nil {
+		t.Fatalf("got %v, %v from a missing file", params, err)
+	}
+
+	steps := []struct {
+		deviceID int64
+		params   map[string]string
+	}{
+		{1050, map[string]string{config.ParamGyroBias: "0.1,0.2,0.3", config.ParamMagScale: "1,1,1"}},
+		{1040, map[string]string{config.ParamCalibration: "00ff"}},
+		{1050, map[string]string{config.ParamMagScale: "0.9,1.1,1"}},
+	}
+	for _, step := range steps {
+		if err := file.Save(step.deviceID, step.params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		deviceID int64
+		want     map[string]string
+	}{
+		{1050, map[string]string{config.ParamGyroBias: "0.1,0.2,0.3", config.ParamMagScale: "0.9,1.1,1"}},
+		{1040, map[string]string{config.ParamCalibration: "00ff"}},
+		{1060, nil},
+	}
+	for _, test := range tests {
+		got, err := NewCalibrationFile(path).Load(test.deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("device %d: got %v, want %v", test.deviceID, got, test.want)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "deviceid = 1040\ncalibration = 00ff\n\n" +
+		"deviceid = 1050\ngyro_bias = 0.1,0.2,0.3\nmag_scale = 0.9,1.1,1\n"
+	if string(content) != want {
+		t.Errorf("file content %q, want %q", content, want)
+	}
+}
+
+func TestCalibrationFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "no separator", content: "deviceid = 1\ngyro_bias\n", err: ":2: expected key = value"},
+		{name: "before deviceid", content: "# comment\ngyro_bias = 1,2,3\n", err: "before the first deviceid"},
+		{name: "invalid deviceid", content: "deviceid = x\n", err: "invalid deviceid x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "calibration.conf")
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := NewCalibrationFile(path).Load(1)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// TestI2CCalibration saves a calibration and restores it on the next connect
+// of a device with the same id
+func TestI2CCalibration(t *testing.T) {
+	store := NewCalibrationFile(filepath.Join(t.TempDir(), "calibration.conf"))
+	errorChan := make(chan *Error.Error, 64)
+	e := NewEngine(make(chan *nmea.Data), errorChan)
+	defer e.Stop(time.Second)
+	e.SetCalibrationStore(store)
+
+	newConn := func(read i2cReadFunc) *I2CConnection {
+		cfg, err := config.NewI2C(map[string]string{
+			config.ParamDevice:    devMpu9250,
+			config.ParamCalibrate: "true",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &I2CConnection{engine: e, read: read, config: cfg, connStats: newConnStats(time.Second)}
+	}
+
+	calibrated := map[string]string{
+		config.ParamGyroBias:  "0.1,0.2,0.3",
+		config.ParamMagOffset: "10,-5,2",
+		config.ParamMagScale:  "0.9,1.1,1",
+	}
+	first := newConn(func(conn *I2CConnection) error {
+		return conn.saveCalibration(calibrated)
+	})
+	if err := first.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if calibrate, _ := first.config.Bool(config.ParamCalibrate, true); calibrate {
+		t.Error("a reconnect would calibrate again")
+	}
+
+	restored := map[string]string{}
+	second := newConn(func(conn *I2CConnection) error {
+		conn.restoreCalibration()
+		for key := range calibrated {
+			restored[key] = conn.config.String(key, "")
+		}
+		return nil
+	})
+	if err := second.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, calibrated) {
+		t.Errorf("restored %v, want %v", restored, calibrated)
+	}
+}
+
+// TestI2CCalibrationInvalid connects with a malformed calibration file, only
+// the imus read it and they fall back to no calibration with a warning
+func TestI2CCalibrationInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calibration.conf")
+	if err := ioutil.WriteFile(path, []byte("gyro_bias = 1,2,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		imu     bool
+		warning bool
+	}{
+		{name: "other sensor"},
+		{name: "imu", imu: true, warning: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errorChan := make(chan *Error.Error, 64)
+			e := NewEngine(make(chan *nmea.Data), errorChan)
+			defer e.Stop(time.Second)
+			e.SetCalibrationStore(NewCalibrationFile(path))
+
+			cfg, err := config.NewI2C(map[string]string{config.ParamDevice: devMpu9250})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bias := ""
+			conn := &I2CConnection{engine: e, config: cfg, connStats: newConnStats(time.Second),
+				read: func(conn *I2CConnection) error {
+					if test.imu {
+						conn.restoreCalibration()
+					}
+					bias = conn.config.String(config.ParamGyroBias, "")
+					return nil
+				}}
+			if err := conn.connect(); err != nil {
+				t.Fatal(err)
+			}
+			if bias != "" {
+				t.Errorf("applied gyro bias %q", bias)
+			}
+
+			warning := false
+			for len(errorChan) > 0 {
+				if err := <-errorChan; err.Lvl == Error.Warning &&
+					strings.Contains(err.Text, "before the first deviceid") {
+					warning = true
+				}
+			}
+			if warning != test.warning {
+				t.Errorf("warned %v, want %v", warning, test.warning)
+			}
+		})
+	}
+}
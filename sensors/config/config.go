@@ -1,13 +1,35 @@
 package config
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+	"time"
+)
 
 const (
-	ErrFlag    string = "[DevConfig]"
-	TypeSerial string = "serial"
-	TypeI2C    string = "i2c"
-	TypeEmpty  string = "empty"
-	ParamType  string = "type"
+	ErrFlag     string = "[DevConfig]"
+	TypeSerial  string = "serial"
+	TypeI2C     string = "i2c"
+	TypeOneWire string = "onewire"
+	TypeEmpty   string = "empty"
+	ParamType   string = "type"
+
+	// optional for every device
+	ParamDeviceID         string = "deviceid"
+	ParamExpectedInterval string = "expected_interval"
+
+	// corrections of single fields, the field name follows the prefix, e.g.
+	// offset.temperature = -1.3
+	// scale.temperature = float, applied before the offset
+	// sealevel.pressure = height above sea level in m, reduces the pressure to
+	// QNH using the temperature field of the same reading if there is one
+	// unit.pressure = from:to, e.g. hPa:inHg
+	// keep_raw = bool, store the uncorrected value as <field>_raw as well
+	ParamOffsetPrefix   string = "offset."
+	ParamScalePrefix    string = "scale."
+	ParamSeaLevelPrefix string = "sealevel."
+	ParamUnitPrefix     string = "unit."
+	ParamKeepRaw        string = "keep_raw"
 )
 
 var (
@@ -18,6 +40,7 @@ type Config interface {
 	Map() map[string]string
 	Type() string
 	DeviceID() int64
+	ExpectedInterval() time.Duration
 }
 
 func NewConfig(configMap map[string]string) (*Config, error) {
@@ -35,7 +58,9 @@ func NewConfig(configMap map[string]string) (*Config, error) {
 			case TypeSerial:
 				result, err = NewSerial(configMap)
 			case TypeI2C:
-				//TODO I2C config
+				result, err = NewI2C(configMap)
+			case TypeOneWire:
+				result, err = NewOneWire(configMap)
 			case TypeEmpty:
 				result, err = NewEmpty(configMap)
 			}
@@ -46,3 +71,27 @@ func NewConfig(configMap map[string]string) (*Config, error) {
 	return &result, err
 
 }
+
+func expectedIntervalFromMap(configMap map[string]string, fallback time.Duration) (time.Duration, error) {
+	value, ok := configMap[ParamExpectedInterval]
+	if !ok {
+		return fallback, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, errors.New(ErrFlag + ": invalid value for " + ParamExpectedInterval + ": " + value)
+	}
+	return interval, nil
+}
+
+func deviceIDFromMap(configMap map[string]string, fallback uint32) (uint32, error) {
+	value, ok := configMap[ParamDeviceID]
+	if !ok {
+		return fallback, nil
+	}
+	deviceID, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, errors.New(ErrFlag + ": invalid value for " + ParamDeviceID + ": " + value)
+	}
+	return uint32(deviceID), nil
+}
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type EmptyConfig struct{}
 
 func NewEmpty(configMap map[string]string) (*EmptyConfig, error) {
@@ -10,6 +12,10 @@ func (config EmptyConfig) DeviceID() int64 {
 	return 0
 }
 
+func (config EmptyConfig) ExpectedInterval() time.Duration {
+	return 0
+}
+
 func (config EmptyConfig) Map() map[string]string {
 	return map[string]string{}
 }
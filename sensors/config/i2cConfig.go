@@ -1,5 +1,70 @@
 package config
 
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ParamBus     string = "bus"
+	ParamAddress string = "address"
+	ParamDevice  string = "device"
+
+	// address switching
+	ParamSecondaryAddress string = "secondary_address"
+	ParamGpio             string = "gpio"
+	ParamGpioPrimaryLevel string = "gpio_primary_level"
+
+	// current monitors
+	ParamShunt        string = "shunt"
+	ParamMaxCurrent   string = "max_current"
+	ParamCurrentScale string = "current_scale"
+
+	// analog inputs, all but channels are suffixed with the channel number
+	ParamChannels string = "channels"
+	ParamName     string = "name"
+	ParamGain     string = "gain"
+	ParamRate     string = "rate"
+	ParamCurve    string = "curve"
+
+	// inertial measurement units
+	ParamInterval        string = "interval"
+	ParamCalibrate       string = "calibrate"
+	ParamCalibrationTime string = "calibration_time"
+	ParamCalibration     string = "calibration"
+	ParamGyroBias        string = "gyro_bias"
+	ParamMagOffset       string = "mag_offset"
+	ParamMagScale        string = "mag_scale"
+	ParamFilterAlpha     string = "filter_alpha"
+
+	// bmxx80
+	ParamOversamplingTemperature string = "oversampling_temperature"
+	ParamOversamplingPressure    string = "oversampling_pressure"
+	ParamOversamplingHumidity    string = "oversampling_humidity"
+	ParamFilter                  string = "filter"
+	ParamMode                    string = "mode"
+
+	ModeContinuous string = "continuous"
+	ModeForced     string = "forced"
+)
+
+// primary addresses of the supported devices, used if none is configured
+var defaultI2CAddresses = map[string]uint16{
+	"bmxx80":  0x76,
+	"bme680":  0x76,
+	"sht3x":   0x44,
+	"sht4x":   0x44,
+	"htu21d":  0x40,
+	"si7021":  0x40,
+	"ina219":  0x40,
+	"ina226":  0x40,
+	"ads1115": 0x48,
+	"bno055":  0x28,
+	"mpu9250": 0x68,
+}
+
 type I2CConfig struct {
 	deviceID                uint32
 	configMap               map[string]string
@@ -9,16 +74,129 @@ type I2CConfig struct {
 	gpioAddressSwitch       uint
 	gpioPrimaryAddressLevel bool
 	deviceType              string
+	interval                time.Duration
+	expected                time.Duration
 }
 
 // necessary I2C config:
 // type = i2c
 // bus = /dev/i2c-*
-// address = uint8
+// address = uint8, defaults to the primary address of the device
 // device = string
+//
+// optional I2C config:
+// deviceid = int, defaults to the address
+// interval = duration between readings, defaults to the interval of the engine
+// expected_interval = duration between readings for the watchdog, defaults
+// to interval
+//
+// address switching, so identical sensors can share a bus:
+// secondary_address = uint8, the device is read at this address
+// gpio = int, GPIO line driving the address pin of the device
+// gpio_primary_level = bool, level that selects the primary address
+// The device is parked at the primary address and only moved to the
+// secondary one while it is read. Without its own deviceid it gets the
+// primary address plus (gpio+1)*256. The address pins need pull resistors to
+// the primary level, otherwise sensors that are not connected yet answer at
+// the secondary address as well.
+//
+// environment sensors (bmxx80):
+// oversampling_temperature = off, 1, 2, 4, 8 or 16, default 16
+// oversampling_pressure = off, 1, 2, 4, 8 or 16, default 16
+// oversampling_humidity = off, 1, 2, 4, 8 or 16, default 16
+// filter = IIR filter coefficient off, 2, 4, 8 or 16, default 16
+// mode = continuous or forced, default continuous. In forced mode the sensor
+// sleeps between readings, which saves power at long intervals.
+//
+// current monitors (ina219, ina226):
+// shunt = float, shunt resistance in ohms
+// max_current = float, expected maximum current in amperes
+// current_scale = float, correction factor from a reference measurement
+//
+// analog inputs (ads1115):
+// channels = comma separated inputs 0 to 3, default 0
+// name0 = string, field name of input 0
+// gain0 = full scale voltage 6.144, 4.096, 2.048, 1.024, 0.512 or 0.256
+// rate0 = samples per second 8, 16, 32, 64, 128, 250, 475 or 860
+// curve0 = raw:value pairs, e.g. 1200:0,9800:120 for a 120 l tank
+//
+// inertial measurement units (bno055, mpu9250):
+// interval = duration between samples, default 100ms
+// calibrate = bool, run the calibration routine after connecting
+// calibration_time = duration of the mpu9250 calibration, default 1m
+// calibration = hex string, bno055 offsets written by the calibration
+// gyro_bias = x,y,z in deg/s, written by the mpu9250 calibration
+// mag_offset = x,y,z in uT, written by the mpu9250 calibration
+// mag_scale = x,y,z, written by the mpu9250 calibration
+// filter_alpha = float, gyro weight of the mpu9250 complementary filter
 
 func NewI2C(configMap map[string]string) (*I2CConfig, error) {
-	return DefaultI2C(), nil
+	config := DefaultI2C()
+	config.configMap = configMap
+
+	addressGiven, gpioGiven := false, false
+	for key, value := range configMap {
+		var err error
+		switch key {
+		case ParamBus:
+			config.bus = value
+		case ParamDevice:
+			config.deviceType = strings.ToLower(value)
+		case ParamAddress:
+			config.primaryAddress, err = parseAddress(value)
+			addressGiven = true
+		case ParamSecondaryAddress:
+			config.secondaryAddress, err = parseAddress(value)
+		case ParamGpio:
+			var pin uint64
+			pin, err = strconv.ParseUint(value, 10, 8)
+			config.gpioAddressSwitch = uint(pin)
+			gpioGiven = true
+		case ParamGpioPrimaryLevel:
+			config.gpioPrimaryAddressLevel, err = strconv.ParseBool(value)
+		case ParamInterval:
+			config.interval, err = time.ParseDuration(value)
+			if err == nil && config.interval <= 0 {
+				err = errors.New("interval must be positive")
+			}
+			config.expected = config.interval
+		}
+		if err != nil {
+			return nil, errors.New(ErrFlag + ": invalid value for " + key + ": " + value)
+		}
+	}
+	if address, ok := defaultI2CAddresses[config.deviceType]; ok && !addressGiven {
+		config.primaryAddress = address
+	}
+
+	if (config.secondaryAddress != 0) != gpioGiven {
+		return nil, errors.New(ErrFlag + ": " + ParamSecondaryAddress +
+			" and " + ParamGpio + " are only valid together")
+	}
+
+	defaultID := I2CDeviceID(config.primaryAddress, 0)
+	if config.AddressSwitched() {
+		defaultID = I2CDeviceID(config.primaryAddress, config.gpioAddressSwitch+1)
+	}
+	deviceID, err := deviceIDFromMap(configMap, defaultID)
+	if err != nil {
+		return nil, err
+	}
+	config.deviceID = deviceID
+
+	expected, err := expectedIntervalFromMap(configMap, config.expected)
+	if err != nil {
+		return nil, err
+	}
+	config.expected = expected
+	return config, nil
+}
+
+// I2CDeviceID is the default device id of the n-th device at a primary
+// address, n*256 above the address. Address switched devices are the
+// (gpio+1)-th, the ids stay below the ones of the serial devices.
+func I2CDeviceID(address uint16, n uint) uint32 {
+	return uint32(address) + uint32(n)<<8
 }
 
 func DefaultI2C() *I2CConfig {
@@ -31,6 +209,8 @@ func DefaultI2C() *I2CConfig {
 		gpioAddressSwitch:       0,
 		gpioPrimaryAddressLevel: false,
 		deviceType:              "bmxx80",
+		interval:                0,
+		expected:                0,
 	}
 }
 
@@ -51,10 +231,41 @@ func (config I2CConfig) DeviceID() int64 {
 	return int64(config.deviceID)
 }
 
+func (config I2CConfig) ExpectedInterval() time.Duration {
+	return config.expected
+}
+
+// Address is the address the device is talked to, the secondary one if the
+// address is switched by GPIO
 func (config *I2CConfig) Address() uint16 {
+	if config.AddressSwitched() {
+		return config.secondaryAddress
+	}
 	return config.primaryAddress
 }
 
+// Interval is the configured duration between readings, zero if the engine
+// default applies
+func (config *I2CConfig) Interval() time.Duration {
+	return config.interval
+}
+
+func (config *I2CConfig) PrimaryAddress() uint16 {
+	return config.primaryAddress
+}
+
+func (config *I2CConfig) AddressSwitched() bool {
+	return config.secondaryAddress != 0
+}
+
+func (config *I2CConfig) GpioAddressSwitch() uint {
+	return config.gpioAddressSwitch
+}
+
+func (config *I2CConfig) GpioPrimaryAddressLevel() bool {
+	return config.gpioPrimaryAddressLevel
+}
+
 func (config *I2CConfig) Bus() string {
 	return config.bus
 }
@@ -66,3 +277,61 @@ func (config *I2CConfig) BusPath() string {
 func (config *I2CConfig) DeviceType() string {
 	return config.deviceType
 }
+
+// String returns a device specific parameter, or fallback if it is not set
+func (config *I2CConfig) String(key string, fallback string) string {
+	value, ok := config.configMap[key]
+	if !ok {
+		return fallback
+	}
+	return value
+}
+
+// Set stores a device specific parameter, e.g. calibration results
+func (config *I2CConfig) Set(key string, value string) {
+	config.configMap[key] = value
+}
+
+// Bool returns a device specific parameter, or fallback if it is not set
+func (config *I2CConfig) Bool(key string, fallback bool) (bool, error) {
+	value, ok := config.configMap[key]
+	if !ok {
+		return fallback, nil
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(ErrFlag + ": invalid value for " + key + ": " + value)
+	}
+	return result, nil
+}
+
+// Duration returns a device specific parameter, or fallback if it is not set
+func (config *I2CConfig) Duration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := config.configMap[key]
+	if !ok {
+		return fallback, nil
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil || result <= 0 {
+		return 0, errors.New(ErrFlag + ": invalid value for " + key + ": " + value)
+	}
+	return result, nil
+}
+
+// Float returns a device specific parameter, or fallback if it is not set
+func (config *I2CConfig) Float(key string, fallback float64) (float64, error) {
+	value, ok := config.configMap[key]
+	if !ok {
+		return fallback, nil
+	}
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.New(ErrFlag + ": invalid value for " + key + ": " + value)
+	}
+	return result, nil
+}
+
+func parseAddress(value string) (uint16, error) {
+	address, err := strconv.ParseUint(value, 0, 16)
+	return uint16(address), err
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"time"
+)
+
+// the first device id of the range of other devices, see nmea.Data, so a
+// 1-Wire bus does not take the place of the serial or i2c defaults
+const defaultOneWireDeviceID uint32 = 2*math.MaxUint16 + 1
+
+// sysfs names of 1-Wire slaves: family code and 48 bit serial number
+var oneWireSlave = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{12}$`)
+
+type OneWireConfig struct {
+	deviceID  uint32
+	configMap map[string]string
+	path      string
+	interval  time.Duration
+	names     map[string]string
+	expected  time.Duration
+}
+
+// necessary 1-Wire config:
+// type = onewire
+//
+// optional 1-Wire config:
+// path = directory of the w1 slaves, default /sys/bus/w1/devices
+// interval = duration between readings, default 10s
+// deviceid = int, default 131071
+// expected_interval = duration between readings for the watchdog
+// 28-xxxxxxxxxxxx = name of the location the probe measures, e.g. coolant.
+// Probes without a name are stored under their serial.
+
+func NewOneWire(configMap map[string]string) (*OneWireConfig, error) {
+	config := DefaultOneWire()
+	config.configMap = configMap
+
+	for key, value := range configMap {
+		switch {
+		case key == ParamPath:
+			config.path = value
+		case key == ParamInterval:
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return nil, errors.New(ErrFlag + ": invalid value for " + key + ": " + value)
+			}
+			config.interval = interval
+			config.expected = interval
+		case oneWireSlave.MatchString(key):
+			config.names[key] = value
+		}
+	}
+
+	deviceID, err := deviceIDFromMap(configMap, config.deviceID)
+	if err != nil {
+		return nil, err
+	}
+	config.deviceID = deviceID
+
+	expected, err := expectedIntervalFromMap(configMap, config.expected)
+	if err != nil {
+		return nil, err
+	}
+	config.expected = expected
+	return config, nil
+}
+
+func DefaultOneWire() *OneWireConfig {
+	return &OneWireConfig{
+		deviceID:  defaultOneWireDeviceID,
+		configMap: map[string]string{},
+		path:      "/sys/bus/w1/devices",
+		interval:  10 * time.Second,
+		names:     map[string]string{},
+		expected:  10 * time.Second,
+	}
+}
+
+func OneWireFromInterface(cfg Config) (*OneWireConfig, error) {
+	return NewOneWire(cfg.Map())
+}
+
+func (config *OneWireConfig) Path() string {
+	return config.path
+}
+
+func (config *OneWireConfig) Interval() time.Duration {
+	return config.interval
+}
+
+// Name returns the configured location of a probe or its serial
+func (config *OneWireConfig) Name(serial string) string {
+	if name, ok := config.names[serial]; ok {
+		return name
+	}
+	return serial
+}
+
+// Config interface implementation
+func (config OneWireConfig) Map() map[string]string {
+	return config.configMap
+}
+
+func (config OneWireConfig) Type() string {
+	return TypeOneWire
+}
+
+func (config OneWireConfig) DeviceID() int64 {
+	return int64(config.deviceID)
+}
+
+func (config OneWireConfig) ExpectedInterval() time.Duration {
+	return config.expected
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewOneWire(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap map[string]string
+		deviceID  int64
+		interval  time.Duration
+		invalid   bool
+	}{
+		{name: "defaults", configMap: map[string]string{}, deviceID: 131071, interval: 10 * time.Second},
+		{name: "device id", configMap: map[string]string{ParamDeviceID: "131100"}, deviceID: 131100, interval: 10 * time.Second},
+		{name: "interval", configMap: map[string]string{ParamInterval: "2s"}, deviceID: 131071, interval: 2 * time.Second},
+		{name: "invalid interval", configMap: map[string]string{ParamInterval: "0s"}, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := NewOneWire(test.configMap)
+			if test.invalid {
+				if err == nil {
+					t.Error("invalid config accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.DeviceID() != test.deviceID || config.Interval() != test.interval {
+				t.Errorf("device id %d, interval %v", config.DeviceID(), config.Interval())
+			}
+		})
+	}
+}
+
+// the defaults of different buses must not share a device id, the engine
+// keys its connections by it
+func TestOneWireDefaultDeviceID(t *testing.T) {
+	oneWire := DefaultOneWire().DeviceID()
+	if oneWire == DefaultSerial().DeviceID() || oneWire == DefaultI2C().DeviceID() {
+		t.Errorf("1-Wire default device id %d is taken", oneWire)
+	}
+}
+
+func TestOneWireNames(t *testing.T) {
+	config, err := NewOneWire(map[string]string{
+		"28-000005e2fdc3": "coolant",
+		// not a slave name, ignored
+		"coolant": "28-000005e2fdc3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := config.Name("28-000005e2fdc3"); name != "coolant" {
+		t.Errorf("name %q, want coolant", name)
+	}
+	if name := config.Name("28-000005e2fdc4"); name != "28-000005e2fdc4" {
+		t.Errorf("unnamed probe %q, want its serial", name)
+	}
+}
@@ -1,35 +1,140 @@
 package config
 
-import "github.com/tarm/serial"
+import (
+	"errors"
+	"github.com/tarm/serial"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ParamPath         string = "path"
+	ParamBaud         string = "baud"
+	ParamSize         string = "size"
+	ParamParity       string = "parity"
+	ParamStop         string = "stop"
+	ParamReconnectMin string = "reconnect_min"
+	ParamReconnectMax string = "reconnect_max"
+	ParamAllow        string = "allow"
+	ParamDeny         string = "deny"
+)
+
+// a read returns without data after this time, so a device that stays
+// attached but goes silent does not block the read routine forever
+const readTimeout = time.Second
 
 type SerialConfig struct {
 	deviceID     uint32
 	configMap    map[string]string
 	deviceConfig *serial.Config
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+	allow        []string
+	deny         []string
+	expected     time.Duration
 }
 
 // necessary serial config:
 // type = serial
-// path = /dev/tty*
+// path = /dev/tty* or /dev/serial/by-id/*
 // baud = int
 // size = int
-// parity = int
-// stop = int
+// parity = N, O, E, M or S
+// stop = 1, 15 or 2
+//
+// optional serial config:
+// deviceid = int
+// reconnect_min = duration, first delay between reconnect attempts
+// reconnect_max = duration, upper limit for the doubled delay
+// allow = comma separated sentence types, e.g. RMC,GPGGA (default: all)
+// deny = comma separated sentence types, applied after allow
+// expected_interval = duration between sentences for the watchdog
 
 func NewSerial(configMap map[string]string) (*SerialConfig, error) {
-	return DefaultSerial(), nil
+	config := DefaultSerial()
+	config.configMap = configMap
+
+	for key, value := range configMap {
+		var err error
+		switch key {
+		case ParamPath:
+			config.deviceConfig.Name = value
+		case ParamBaud:
+			config.deviceConfig.Baud, err = strconv.Atoi(value)
+		case ParamSize:
+			var size uint64
+			size, err = strconv.ParseUint(value, 10, 8)
+			config.deviceConfig.Size = byte(size)
+		case ParamParity:
+			var parity serial.Parity
+			if len(value) == 1 {
+				parity = serial.Parity(strings.ToUpper(value)[0])
+			}
+			switch parity {
+			case serial.ParityNone, serial.ParityOdd, serial.ParityEven,
+				serial.ParityMark, serial.ParitySpace:
+				config.deviceConfig.Parity = parity
+			default:
+				err = serial.ErrBadParity
+			}
+		case ParamStop:
+			switch value {
+			case "1":
+				config.deviceConfig.StopBits = serial.Stop1
+			case "15", "1.5":
+				config.deviceConfig.StopBits = serial.Stop1Half
+			case "2":
+				config.deviceConfig.StopBits = serial.Stop2
+			default:
+				err = serial.ErrBadStopBits
+			}
+		case ParamReconnectMin:
+			config.reconnectMin, err = time.ParseDuration(value)
+		case ParamReconnectMax:
+			config.reconnectMax, err = time.ParseDuration(value)
+		case ParamAllow:
+			config.allow = splitList(value)
+		case ParamDeny:
+			config.deny = splitList(value)
+		}
+		if err != nil {
+			return nil, errors.New(ErrFlag + ": invalid value for " + key + ": " + value)
+		}
+	}
+
+	if config.reconnectMin <= 0 || config.reconnectMax < config.reconnectMin {
+		return nil, errors.New(ErrFlag + ": invalid reconnect delays")
+	}
+
+	deviceID, err := deviceIDFromMap(configMap, config.deviceID)
+	if err != nil {
+		return nil, err
+	}
+	config.deviceID = deviceID
+
+	expected, err := expectedIntervalFromMap(configMap, config.expected)
+	if err != nil {
+		return nil, err
+	}
+	config.expected = expected
+	return config, nil
 }
+
 func DefaultSerial() *SerialConfig {
 	return &SerialConfig{
 		deviceConfig: &serial.Config{
 			Name:        "/dev/ttyAMA0",
 			Baud:        9600,
-			ReadTimeout: 0,
+			ReadTimeout: readTimeout,
 			Size:        8,
 			Parity:      serial.ParityNone,
 			StopBits:    serial.Stop1,
 		},
-		configMap: map[string]string{},
+		configMap:    map[string]string{},
+		reconnectMin: time.Second,
+		reconnectMax: time.Minute,
+		expected:     time.Second,
 	}
 }
 
@@ -41,6 +146,24 @@ func (config *SerialConfig) DeviceConfig() *serial.Config {
 	return config.deviceConfig
 }
 
+// Forwards reports whether sentences of the given type, e.g. $GPRMC, pass the
+// allow and deny lists. List entries match either the complete type or the
+// sentence formatter without talker ID.
+func (config *SerialConfig) Forwards(sentenceType string) bool {
+	if len(config.allow) > 0 && !matchesSentence(config.allow, sentenceType) {
+		return false
+	}
+	return !matchesSentence(config.deny, sentenceType)
+}
+
+func (config *SerialConfig) ReconnectMin() time.Duration {
+	return config.reconnectMin
+}
+
+func (config *SerialConfig) ReconnectMax() time.Duration {
+	return config.reconnectMax
+}
+
 // Config interface implementation
 func (config SerialConfig) Map() map[string]string {
 	return config.configMap
@@ -53,3 +176,29 @@ func (config SerialConfig) Type() string {
 func (config SerialConfig) DeviceID() int64 {
 	return int64(config.deviceID)
 }
+
+func (config SerialConfig) ExpectedInterval() time.Duration {
+	return config.expected
+}
+
+func matchesSentence(list []string, sentenceType string) bool {
+	sentenceType = strings.ToUpper(strings.TrimLeft(sentenceType, "$!"))
+	for _, entry := range list {
+		if entry == sentenceType ||
+			(len(entry) == 3 && strings.HasSuffix(sentenceType, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToUpper(strings.TrimLeft(strings.TrimSpace(entry), "$!"))
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
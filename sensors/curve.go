@@ -0,0 +1,64 @@
+package sensors
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type curvePoint struct {
+	raw   float64
+	value float64
+}
+
+// curve is a piecewise-linear calibration table sorted by raw value. Readings
+// outside the table are clamped to its first or last value.
+type curve []curvePoint
+
+// parseCurve reads comma separated raw:value pairs, e.g. "1200:0,9800:120"
+func parseCurve(value string) (curve, error) {
+	result := make(curve, 0)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, errors.New("invalid calibration point " + pair)
+		}
+		raw, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, errors.New("invalid calibration point " + pair)
+		}
+		calibrated, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, errors.New("invalid calibration point " + pair)
+		}
+		result = append(result, curvePoint{raw: raw, value: calibrated})
+	}
+
+	if len(result) < 2 {
+		return nil, errors.New("calibration curve needs at least two points")
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].raw < result[j].raw
+	})
+	for i := 1; i < len(result); i++ {
+		if result[i].raw == result[i-1].raw {
+			return nil, errors.New("calibration curve has two values for " +
+				strconv.FormatFloat(result[i].raw, 'f', -1, 64))
+		}
+	}
+	return result, nil
+}
+
+func (c curve) apply(raw float64) float64 {
+	if raw <= c[0].raw {
+		return c[0].value
+	}
+	for i := 1; i < len(c); i++ {
+		if raw <= c[i].raw {
+			lower, upper := c[i-1], c[i]
+			return lower.value + (raw-lower.raw)*(upper.value-lower.value)/(upper.raw-lower.raw)
+		}
+	}
+	return c[len(c)-1].value
+}
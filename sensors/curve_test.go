@@ -0,0 +1,65 @@
+package sensors
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseCurve(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{value: "1200:0,9800:120"},
+		{value: " 9800:120 , 1200:0,5500:50"},
+		{value: "1200:0", err: "at least two points"},
+		{value: "1200:0,1200:10", err: "two values for 1200"},
+		{value: "1200:0,9800", err: "invalid calibration point 9800"},
+		{value: "1200:0,high:120", err: "invalid calibration point high:120"},
+		{value: "1200:0,9800:full", err: "invalid calibration point 9800:full"},
+		{value: "", err: "invalid calibration point"},
+	}
+	for _, test := range tests {
+		c, err := parseCurve(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		for i := 1; i < len(c); i++ {
+			if c[i].raw <= c[i-1].raw {
+				t.Errorf("%q: points not sorted by raw value", test.value)
+			}
+		}
+	}
+}
+
+func TestCurveApply(t *testing.T) {
+	c, err := parseCurve("9800:120,1200:0,5500:50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		raw  float64
+		want float64
+	}{
+		{0, 0},
+		{1200, 0},
+		{3350, 25},
+		{5500, 50},
+		{7650, 85},
+		{9800, 120},
+		{12000, 120},
+	}
+	for _, test := range tests {
+		if got := c.apply(test.raw); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("apply(%v) = %v, want %v", test.raw, got, test.want)
+		}
+	}
+}
@@ -4,79 +4,264 @@ import (
 	"../Error"
 	"../nmea"
 	"./config"
+	"errors"
 	"periph.io/x/periph/conn/i2c"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
 	// i2c device types
-	devBmxx80 string = "bmxx80"
+	devBmxx80  string = "bmxx80"
+	devBme680  string = "bme680"
+	devSht3x   string = "sht3x"
+	devSht4x   string = "sht4x"
+	devHtu21d  string = "htu21d"
+	devSi7021  string = "si7021"
+	devIna219  string = "ina219"
+	devIna226  string = "ina226"
+	devAds1115 string = "ads1115"
+	devBno055  string = "bno055"
+	devMpu9250 string = "mpu9250"
 
-	ErrFlag    string = "[sensors]"
-	ErrI2CFlag string = "[I2C]"
+	ErrFlag       string = "[sensors]"
+	ErrI2CFlag    string = "[I2C]"
+	ErrSerialFlag string = "[serial]"
+	ErrW1Flag     string = "[1-Wire]"
+
+	// sampling interval of devices without their own interval
+	defaultIntervalInMs uint = 1000
+)
+
+// connection states
+const (
+	StateConnecting State = iota
+	StateRunning
+	StateStalled
+	StateStopped
 )
 
+type State uint8
+
 type Engine struct {
 	errorChan          chan<- *Error.Error
 	nmeaChan           chan<- *nmea.Data
 	intervalInMs       uint
 	connList           map[int64]Connection
+	configs            map[int64]config.Config
+	transforms         map[int64]*transform
+	connMutex          sync.Mutex
 	i2cHostInitialized bool
 	i2cBuses           map[string]i2c.BusCloser
+	i2cBusLocks        map[string]*sync.Mutex
+	routines           sync.WaitGroup
+	watchdogStop       chan bool
+	watchdogDone       chan bool
+	calibrations       CalibrationStore
+
+	// Stop only runs once, later calls return its result
+	stopOnce sync.Once
+	stopErr  error
 }
 
 type Connection interface {
 	DeviceID() int64
 	Type() string
+	Status() Status
 	Stop()
 	connect() error
 }
 
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateRunning:
+		return "running"
+	case StateStalled:
+		return "stalled"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
 func NewEngine(nmeaChan chan<- *nmea.Data, errorChan chan<- *Error.Error) *Engine {
 	cd := &Engine{
 		errorChan:          errorChan,
 		nmeaChan:           nmeaChan,
+		intervalInMs:       defaultIntervalInMs,
 		connList:           map[int64]Connection{},
+		configs:            map[int64]config.Config{},
+		transforms:         map[int64]*transform{},
 		i2cHostInitialized: false,
 		i2cBuses:           map[string]i2c.BusCloser{},
+		i2cBusLocks:        map[string]*sync.Mutex{},
+		watchdogStop:       make(chan bool),
+		watchdogDone:       make(chan bool),
 	}
 
+	go cd.watchdogRoutine()
 	return cd
 }
 
+// SetInterval sets the sampling interval of devices that have none
+// configured. It applies to devices connected afterwards.
+func (e *Engine) SetInterval(interval time.Duration) {
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	e.intervalInMs = uint(interval / time.Millisecond)
+}
+
+// SetCalibrationStore sets where calibration results are kept, without a
+// store they are only logged and lost on restart. It applies to devices
+// connected afterwards.
+func (e *Engine) SetCalibrationStore(store CalibrationStore) {
+	e.calibrations = store
+}
+
+func (e *Engine) interval() time.Duration {
+	return time.Duration(e.intervalInMs) * time.Millisecond
+}
+
 func (e *Engine) Connect(cfg config.Config) Connection {
+	e.connMutex.Lock()
+	previous, taken := e.configs[cfg.DeviceID()]
+	e.connMutex.Unlock()
+	if taken {
+		e.error(errors.New("device id "+strconv.FormatInt(cfg.DeviceID(), 10)+" of "+describeConfig(cfg)+
+			" is already used by "+describeConfig(previous)+", set "+config.ParamDeviceID+" in one of them"),
+			Error.High)
+		return nil
+	}
+
 	var conn Connection
 	switch cfg.Type() {
 	case config.TypeSerial:
 		sConn, err := e.newSerialConnection(cfg)
 		if err != nil {
-			e.error(err)
+			e.error(err, Error.High)
+		} else {
+			conn = sConn
 		}
-		conn = sConn
 	case config.TypeI2C:
 		iConn, err := e.newI2CConnection(cfg)
 		if err != nil {
-			e.error(err)
+			e.error(err, Error.High)
+		} else {
+			conn = iConn
+		}
+	case config.TypeOneWire:
+		wConn, err := e.newOneWireConnection(cfg)
+		if err != nil {
+			e.error(err, Error.High)
+		} else {
+			conn = wConn
 		}
-		conn = iConn
 	}
 	if conn == nil {
 		return nil
 	}
-	err := conn.connect()
+	t, err := newTransform(cfg.Map())
+	if err != nil {
+		e.error(err)
+		return nil
+	}
+	e.connMutex.Lock()
+	e.transforms[conn.DeviceID()] = t
+	e.connMutex.Unlock()
+
+	err = conn.connect()
 	if err != nil {
 		e.error(err)
 	}
 
+	e.connMutex.Lock()
 	e.connList[conn.DeviceID()] = conn
+	e.configs[conn.DeviceID()] = cfg
+	e.connMutex.Unlock()
 	return conn
 
 }
 
-func (e *Engine) Stop() error {
-	//TODO
+// describeConfig names a device configuration in messages by the keys that
+// tell devices of the same type apart
+func describeConfig(cfg config.Config) string {
+	configMap := cfg.Map()
+	description := cfg.Type()
+	for _, key := range []string{config.ParamPath, config.ParamBus, config.ParamDevice, config.ParamAddress} {
+		if value, ok := configMap[key]; ok {
+			description += " " + key + "=" + value
+		}
+	}
+	return description
+}
+
+// Stop stops the watchdog and every connection and waits for their routines
+// to return, so nothing is sent on the nmea channel afterwards. The i2c buses
+// are only closed once all routines are gone. It is safe to call Stop more
+// than once.
+func (e *Engine) Stop(timeout time.Duration) error {
+	e.stopOnce.Do(func() {
+		e.stopErr = e.stop(timeout)
+	})
+	return e.stopErr
+}
+
+func (e *Engine) stop(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	close(e.watchdogStop)
+	select {
+	case <-e.watchdogDone:
+	case <-deadline:
+		return errors.New(ErrFlag + " timeout while waiting for the watchdog")
+	}
+
+	e.connMutex.Lock()
+	for _, conn := range e.connList {
+		conn.Stop()
+	}
+	e.connMutex.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		e.routines.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-deadline:
+		return errors.New(ErrFlag + " timeout while waiting for sensor routines")
+	}
+
+	for path, bus := range e.i2cBuses {
+		if err := bus.Close(); err != nil {
+			e.error(err, Error.Low)
+		}
+		delete(e.i2cBuses, path)
+	}
 	return nil
 }
 
+// Status returns a snapshot of every connection ordered by device ID
+func (e *Engine) Status() []Status {
+	e.connMutex.Lock()
+	list := make([]Status, 0, len(e.connList))
+	for _, conn := range e.connList {
+		list = append(list, conn.Status())
+	}
+	e.connMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	return list
+}
+
 func (e *Engine) error(err error, lvl ...Error.Level) {
 	level := Error.Debug
 	if len(lvl) > 0 {
@@ -0,0 +1,122 @@
+package sensors
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"./config"
+)
+
+// Stop may be called by a signal handler and on the way out of main at the
+// same time, every connection is stopped once
+func TestEngineStopTwice(t *testing.T) {
+	e := NewEngine(make(chan *nmea.Data, 8), make(chan *Error.Error, 64))
+	fake := &fakeConn{status: Status{DeviceID: 3, State: StateRunning}}
+	e.connList[3] = fake
+	var halts int32
+	e.connList[0x76] = &I2CConnection{
+		engine:    e,
+		config:    config.DefaultI2C(),
+		stop:      func() error { atomic.AddInt32(&halts, 1); return nil },
+		connStats: newConnStats(time.Second),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.Stop(time.Second); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := e.Stop(time.Second); err != nil {
+		t.Error(err)
+	}
+	if fake.stops != 1 || atomic.LoadInt32(&halts) != 1 {
+		t.Errorf("connections stopped %d and %d times, want once", fake.stops, halts)
+	}
+}
+
+// the watchdog and the engine may stop an i2c connection at the same time
+func TestI2CStopConcurrent(t *testing.T) {
+	e := &Engine{errorChan: make(chan *Error.Error, 64)}
+	var halts int32
+	conn := &I2CConnection{
+		engine:    e,
+		config:    config.DefaultI2C(),
+		stop:      func() error { atomic.AddInt32(&halts, 1); return nil },
+		connStats: newConnStats(time.Second),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Stop()
+		}()
+	}
+	wg.Wait()
+	if halts != 1 || !conn.IsStopped() {
+		t.Errorf("halted %d times, stopped %v", halts, conn.IsStopped())
+	}
+}
+
+func TestConnectDuplicateDeviceID(t *testing.T) {
+	dir := t.TempDir()
+	first := map[string]string{config.ParamPath: filepath.Join(dir, "ttyUSB0")}
+	tests := []struct {
+		name        string
+		second      map[string]string
+		err         string
+		connections int
+	}{
+		{name: "default ids", second: map[string]string{config.ParamPath: filepath.Join(dir, "ttyUSB1")},
+			err: "device id 0 of serial path=" + filepath.Join(dir, "ttyUSB1") +
+				" is already used by serial path=" + filepath.Join(dir, "ttyUSB0"), connections: 1},
+		{name: "same id set", second: map[string]string{config.ParamPath: filepath.Join(dir, "ttyUSB1"),
+			config.ParamDeviceID: "0"}, err: "set deviceid in one of them", connections: 1},
+		{name: "own id", second: map[string]string{config.ParamPath: filepath.Join(dir, "ttyUSB1"),
+			config.ParamDeviceID: "65537"}, connections: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errorChan := make(chan *Error.Error, 64)
+			e := NewEngine(make(chan *nmea.Data), errorChan)
+			defer e.Stop(time.Second)
+			for i, configMap := range []map[string]string{first, test.second} {
+				configMap[config.ParamType] = config.TypeSerial
+				cfg, err := config.NewSerial(configMap)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn := e.Connect(cfg)
+				if rejected := conn == nil; rejected != (i == 1 && test.err != "") {
+					t.Fatalf("config %d rejected: %v", i, rejected)
+				}
+			}
+
+			found := ""
+			for len(errorChan) > 0 {
+				if err := <-errorChan; err.Lvl == Error.High {
+					found = err.Text
+				}
+			}
+			if test.err == "" && found != "" || !strings.Contains(found, test.err) {
+				t.Errorf("got error %q, want %q", found, test.err)
+			}
+			if connections := len(e.Status()); connections != test.connections {
+				t.Errorf("%d connections, want %d", connections, test.connections)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package sensors
+
+import (
+	"../nmea"
+	"errors"
+	"time"
+)
+
+const (
+	// no hold master mode, the bus is free during the conversion
+	htu21dCmdTemperature byte = 0xf3
+	htu21dCmdHumidity    byte = 0xf5
+	htu21dCmdSoftReset   byte = 0xfe
+	// worst case conversion times at full resolution
+	htu21dTemperatureTime = 50 * time.Millisecond
+	htu21dHumidityTime    = 16 * time.Millisecond
+
+	dataTypeHtu21d string = "HTU21D"
+)
+
+// readHtu21d also serves the Si7021, which uses the same commands and
+// conversion formulas
+func readHtu21d(conn *I2CConnection) error {
+	dev := conn.dev()
+	if err := dev.Tx([]byte{htu21dCmdSoftReset}, nil); err != nil {
+		return err
+	}
+	time.Sleep(15 * time.Millisecond)
+
+	conn.poll(dataTypeHtu21d, conn.interval(), func() (nmea.DataMap, error) {
+		temp, err := readHtu21dWord(conn, htu21dCmdTemperature, htu21dTemperatureTime)
+		if err != nil {
+			return nil, err
+		}
+		humi, err := readHtu21dWord(conn, htu21dCmdHumidity, htu21dHumidityTime)
+		if err != nil {
+			return nil, err
+		}
+
+		humidity := -6.0 + 125.0*float64(humi)/65536.0
+		if humidity < 0 {
+			humidity = 0
+		} else if humidity > 100 {
+			humidity = 100
+		}
+		return nmea.DataMap{
+			"temperature": -46.85 + 175.72*float64(temp)/65536.0,
+			"humidity":    humidity,
+		}, nil
+	})
+	return nil
+}
+
+func readHtu21dWord(conn *I2CConnection, cmd byte, conversion time.Duration) (uint16, error) {
+	dev := conn.dev()
+	if err := dev.Tx([]byte{cmd}, nil); err != nil {
+		return 0, err
+	}
+	time.Sleep(conversion)
+
+	buffer := make([]byte, 3)
+	if err := dev.Tx(nil, buffer); err != nil {
+		return 0, err
+	}
+	if crc8(buffer[0:2], 0x00) != buffer[2] {
+		return 0, errors.New("crc mismatch in " + conn.config.DeviceType() + " reading")
+	}
+	// the two lowest bits are status bits
+	return (uint16(buffer[0])<<8 | uint16(buffer[1])) &^ 0x3, nil
+}
@@ -2,9 +2,16 @@ package sensors
 
 import (
 	"errors"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpioreg"
 	"periph.io/x/periph/conn/i2c"
 	"periph.io/x/periph/conn/i2c/i2creg"
 	"periph.io/x/periph/host"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"../Error"
 	"../nmea"
@@ -14,6 +21,7 @@ import (
 
 type i2cReadFunc func(conn *I2CConnection) error
 type i2cStopFunc func() error
+type i2cSenseFunc func() (nmea.DataMap, error)
 
 type I2CConnection struct {
 	engine    *Engine
@@ -21,39 +29,113 @@ type I2CConnection struct {
 	stop      i2cStopFunc
 	bus       i2c.Bus
 	config    *config.I2CConfig
+	lock      sync.Mutex // guards isStopped against the watchdog and read routines
 	isStopped bool
+	connStats
 }
 
-func (ic I2CConnection) DeviceID() int64 {
+func (ic *I2CConnection) DeviceID() int64 {
 	return ic.config.DeviceID()
 }
 
-func (ic I2CConnection) Type() string {
+func (ic *I2CConnection) Type() string {
 	return ic.config.Type()
 }
 
-func (ic I2CConnection) Stop() {
-	if !ic.isStopped {
-		ic.error(errors.New(
-			"stopping i2c sensor " +
-				ic.config.DeviceType()))
+func (ic *I2CConnection) Status() Status {
+	status := ic.status(ic.DeviceID(), ic.Type())
+	status.ExpectedInterval = expectedI2CInterval(ic.config, ic.engine.interval())
+	return status
+}
 
-		ic.isStopped = true
-		err := ic.stop()
-		if err != nil {
-			ic.error(err, Error.Low)
-		}
+func (ic *I2CConnection) Stop() {
+	ic.lock.Lock()
+	stopped := ic.isStopped
+	ic.isStopped = true
+	ic.lock.Unlock()
+	if stopped {
+		return
+	}
+
+	ic.error(errors.New(
+		"stopping i2c sensor " +
+			ic.config.DeviceType()))
+	ic.swapState(StateStopped)
+	if ic.stop == nil {
+		return
+	}
+	err := ic.stop()
+	if err != nil {
+		ic.error(err, Error.Low)
+	}
+}
+
+func (ic *I2CConnection) connect() error {
+	ic.lock.Lock()
+	ic.isStopped = false
+	ic.lock.Unlock()
+	ic.swapState(StateConnecting)
+	return ic.read(ic)
+}
+
+// restoreCalibration applies the stored calibration over the configuration,
+// a file that cannot be read leaves the sensor uncalibrated
+func (ic *I2CConnection) restoreCalibration() {
+	if ic.engine.calibrations == nil {
+		return
+	}
+	params, err := ic.engine.calibrations.Load(ic.DeviceID())
+	if err != nil {
+		ic.error(errors.New("ignoring stored calibration: "+err.Error()), Error.Warning)
+		return
+	}
+	for key, value := range params {
+		ic.config.Set(key, value)
 	}
 }
 
-func (ic I2CConnection) connect() error {
-	return ic.read(&ic)
+// saveCalibration applies the results of a calibration to the configuration,
+// so a reconnect does not calibrate again, and stores them for the next start
+func (ic *I2CConnection) saveCalibration(params map[string]string) error {
+	keys := make([]string, 0, len(params))
+	for key, value := range params {
+		ic.config.Set(key, value)
+		keys = append(keys, key)
+	}
+	ic.config.Set(config.ParamCalibrate, "false")
+
+	if ic.engine.calibrations != nil {
+		if err := ic.engine.calibrations.Save(ic.DeviceID(), params); err != nil {
+			return errors.New(ic.config.DeviceType() + " calibration could not be stored: " + err.Error())
+		}
+		ic.error(errors.New(ic.config.DeviceType()+" calibration finished and stored"), Error.Info)
+		return nil
+	}
+
+	sort.Strings(keys)
+	entries := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, key+" = "+params[key])
+	}
+	ic.error(errors.New(ic.config.DeviceType()+" calibration finished, add to the device configuration: "+
+		strings.Join(entries, "; ")), Error.Info)
+	return nil
 }
 
 func (ic *I2CConnection) IsStopped() bool {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
 	return ic.isStopped
 }
 
+// interval returns the configured sampling interval or the engine default
+func (ic *I2CConnection) interval() time.Duration {
+	if interval := ic.config.Interval(); interval > 0 {
+		return interval
+	}
+	return ic.engine.interval()
+}
+
 func (e *Engine) newI2CConnection(cfg config.Config) (*I2CConnection, error) {
 	configuration, err := config.I2CFromInterface(cfg)
 	if err != nil {
@@ -61,28 +143,54 @@ func (e *Engine) newI2CConnection(cfg config.Config) (*I2CConnection, error) {
 	}
 
 	conn := &I2CConnection{
-		engine: e,
-		read:   nil,
-		stop:   nil,
-		bus:    nil,
-		config: configuration,
+		engine:    e,
+		read:      nil,
+		stop:      nil,
+		bus:       nil,
+		config:    configuration,
+		connStats: newConnStats(expectedI2CInterval(configuration, e.interval())),
 	}
 
 	switch configuration.DeviceType() {
 	case devBmxx80:
 		conn.read = readBmxx80
+	case devBme680:
+		conn.read = readBme680
+	case devSht3x:
+		conn.read = readSht3x
+	case devSht4x:
+		conn.read = readSht4x
+	case devHtu21d, devSi7021:
+		conn.read = readHtu21d
+	case devIna219:
+		conn.read = readIna219
+	case devIna226:
+		conn.read = readIna226
+	case devAds1115:
+		conn.read = readAds1115
+	case devBno055:
+		conn.read = readBno055
+	case devMpu9250:
+		conn.read = readMpu9250
 	default:
 		return nil, errors.New(
 			ErrI2CFlag + ": device type " +
 				configuration.DeviceType() + " not supported")
 	}
 
-	err = e.i2cBusInit(configuration.BusPath())
-	if err != nil {
-		e.error(err)
+	// without a bus every transaction of the driver would fail
+	if err = e.i2cBusInit(configuration.BusPath()); err != nil {
+		return nil, errors.New(ErrI2CFlag + ": " + configuration.BusPath() + ": " + err.Error())
 	}
 	conn.bus = e.i2cBuses[configuration.BusPath()]
 
+	if configuration.AddressSwitched() {
+		conn.bus, err = e.i2cSwitchedBus(conn.bus, configuration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return conn, nil
 }
 
@@ -107,15 +215,79 @@ func (e *Engine) i2cBusInit(path string) error {
 	return nil
 }
 
-func (ic I2CConnection) error(err error, lvl ...Error.Level) {
+func (ic *I2CConnection) error(err error, lvl ...Error.Level) {
 	errLvl := Error.Debug
 	if len(lvl) > 0 {
 		errLvl = lvl[0]
 	}
+	ic.countError(err, errLvl)
 	newErr := errors.New(ErrI2CFlag + err.Error())
 	ic.engine.error(newErr, errLvl)
 }
 
+func (ic *I2CConnection) dev() *i2c.Dev {
+	return &i2c.Dev{Bus: ic.bus, Addr: ic.config.Address()}
+}
+
+// poll calls sense every interval until the connection is stopped and sends
+// the readings as dataType, for devices without a continuous mode of their own
+func (ic *I2CConnection) poll(dataType string, interval time.Duration, sense i2cSenseFunc) {
+	stopChan := make(chan bool)
+	ic.stop = func() error {
+		close(stopChan)
+		return nil
+	}
+	ic.swapState(StateRunning)
+
+	ic.engine.routines.Add(1)
+	go func() {
+		defer ic.engine.routines.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			fields, err := sense()
+			// nil fields without error means there is nothing to send yet
+			if err != nil {
+				ic.error(err, Error.Low)
+			} else if fields != nil {
+				ic.send(nmea.NewSensorData(dataType, ic.DeviceID(), fields))
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
 func (ic *I2CConnection) send(data *nmea.Data) {
-	ic.engine.nmeaChan <- data
+	ic.countSentence()
+	ic.engine.publish(data)
+}
+
+// i2cSwitchedBus wraps a bus so the device is moved to its secondary address
+// by its GPIO line for each transaction
+func (e *Engine) i2cSwitchedBus(bus i2c.Bus, configuration *config.I2CConfig) (i2c.Bus, error) {
+	pinName := strconv.Itoa(int(configuration.GpioAddressSwitch()))
+	pin := gpioreg.ByName(pinName)
+	if pin == nil {
+		return nil, errors.New(ErrI2CFlag + ": gpio " + pinName + " not found")
+	}
+
+	lock, ok := e.i2cBusLocks[configuration.BusPath()]
+	if !ok {
+		lock = &sync.Mutex{}
+		e.i2cBusLocks[configuration.BusPath()] = lock
+	}
+	return newSwitchedBus(bus, lock, pin, gpio.Level(configuration.GpioPrimaryAddressLevel()))
+}
+
+func expectedI2CInterval(configuration *config.I2CConfig, engineInterval time.Duration) time.Duration {
+	if expected := configuration.ExpectedInterval(); expected > 0 {
+		return expected
+	}
+	return engineInterval
 }
@@ -0,0 +1,66 @@
+package sensors
+
+import (
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/physic"
+	"sync"
+	"time"
+)
+
+const (
+	// time for the address pin to settle before the transaction
+	addressSwitchDelay = 10 * time.Microsecond
+)
+
+// switchedBus moves a device from its primary to its secondary address for
+// the duration of every transaction. Identical sensors with their address
+// pins on separate GPIO lines stay parked at the primary address and are read
+// one after another at the secondary address. All switched buses on the same
+// physical bus share one lock, so only one device is moved at a time.
+type switchedBus struct {
+	bus          i2c.Bus
+	lock         *sync.Mutex
+	pin          gpio.PinOut
+	primaryLevel gpio.Level
+}
+
+func newSwitchedBus(bus i2c.Bus, lock *sync.Mutex, pin gpio.PinOut, primaryLevel gpio.Level) (*switchedBus, error) {
+	sb := &switchedBus{
+		bus:          bus,
+		lock:         lock,
+		pin:          pin,
+		primaryLevel: primaryLevel,
+	}
+
+	// park the device so it does not collide with the one being read
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if err := sb.pin.Out(sb.primaryLevel); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+func (sb *switchedBus) String() string {
+	return sb.bus.String() + " switched by " + sb.pin.String()
+}
+
+func (sb *switchedBus) Tx(addr uint16, w, r []byte) error {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	if err := sb.pin.Out(!sb.primaryLevel); err != nil {
+		return err
+	}
+	time.Sleep(addressSwitchDelay)
+	err := sb.bus.Tx(addr, w, r)
+	if parkErr := sb.pin.Out(sb.primaryLevel); err == nil {
+		err = parkErr
+	}
+	return err
+}
+
+func (sb *switchedBus) SetSpeed(f physic.Frequency) error {
+	return sb.bus.SetSpeed(f)
+}
@@ -0,0 +1,206 @@
+package sensors
+
+import (
+	"errors"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpiotest"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"periph.io/x/periph/conn/physic"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// switchedAddress is the secondary address the sensors are read at
+const switchedAddress uint16 = 0x77
+
+// levelBus stands in for the sensors on a bus: every transaction is answered
+// by the one sensor whose address pin is at the secondary level
+type levelBus struct {
+	primaryLevel gpio.Level
+	pins         []*gpiotest.Pin
+	answers      map[*gpiotest.Pin][]byte
+	// levels of the pins during each transaction
+	levels [][]gpio.Level
+}
+
+func (lb *levelBus) String() string {
+	return "levelBus"
+}
+
+func (lb *levelBus) Tx(addr uint16, w, r []byte) error {
+	levels := make([]gpio.Level, len(lb.pins))
+	var switched []*gpiotest.Pin
+	for i, pin := range lb.pins {
+		levels[i] = pin.Read()
+		if levels[i] != lb.primaryLevel {
+			switched = append(switched, pin)
+		}
+	}
+	lb.levels = append(lb.levels, levels)
+
+	if addr != switchedAddress {
+		return errors.New("no device at the address")
+	}
+	if len(switched) != 1 {
+		return errors.New("address collision")
+	}
+	copy(r, lb.answers[switched[0]])
+	return nil
+}
+
+func (lb *levelBus) SetSpeed(f physic.Frequency) error {
+	return nil
+}
+
+func TestSwitchedBusDrivesPin(t *testing.T) {
+	tests := []struct {
+		name         string
+		primaryLevel gpio.Level
+	}{
+		{name: "primary low", primaryLevel: gpio.Low},
+		{name: "primary high", primaryLevel: gpio.High},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pin := &gpiotest.Pin{N: "GPIO17", Num: 17, L: !test.primaryLevel}
+			bus := &levelBus{
+				primaryLevel: test.primaryLevel,
+				pins:         []*gpiotest.Pin{pin},
+				answers:      map[*gpiotest.Pin][]byte{pin: {0x60}},
+			}
+			record := &i2ctest.Record{Bus: bus}
+
+			sb, err := newSwitchedBus(record, &sync.Mutex{}, pin, test.primaryLevel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pin.Read() != test.primaryLevel {
+				t.Fatalf("pin not parked at %s after setup", test.primaryLevel)
+			}
+
+			for i := 0; i < 3; i++ {
+				read := make([]byte, 1)
+				if err := sb.Tx(switchedAddress, []byte{0xd0}, read); err != nil {
+					t.Fatal(err)
+				}
+				if read[0] != 0x60 {
+					t.Errorf("read %#x, want 0x60", read[0])
+				}
+				if pin.Read() != test.primaryLevel {
+					t.Errorf("pin not parked after transaction %d", i)
+				}
+			}
+
+			for i, levels := range bus.levels {
+				if levels[0] != !test.primaryLevel {
+					t.Errorf("pin at %s during transaction %d", levels[0], i)
+				}
+			}
+			want := []i2ctest.IO{
+				{Addr: switchedAddress, W: []byte{0xd0}, R: []byte{0x60}},
+				{Addr: switchedAddress, W: []byte{0xd0}, R: []byte{0x60}},
+				{Addr: switchedAddress, W: []byte{0xd0}, R: []byte{0x60}},
+			}
+			if !reflect.DeepEqual(record.Ops, want) {
+				t.Errorf("transactions %v, want %v", record.Ops, want)
+			}
+		})
+	}
+}
+
+func TestSwitchedBusParksPinOnError(t *testing.T) {
+	pin := &gpiotest.Pin{N: "GPIO17", Num: 17}
+	playback := &i2ctest.Playback{
+		Ops:       []i2ctest.IO{{Addr: switchedAddress, W: []byte{0xd0}, R: []byte{0x60}}},
+		DontPanic: true,
+	}
+	sb, err := newSwitchedBus(playback, &sync.Mutex{}, pin, gpio.Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the device does not expect this register
+	if err := sb.Tx(switchedAddress, []byte{0xf7}, make([]byte, 1)); err == nil {
+		t.Error("expected the error of the transaction")
+	}
+	if pin.Read() != gpio.Low {
+		t.Error("pin not parked after a failed transaction")
+	}
+}
+
+func TestSwitchedBusIdenticalSensors(t *testing.T) {
+	pinA := &gpiotest.Pin{N: "GPIO17", Num: 17}
+	pinB := &gpiotest.Pin{N: "GPIO27", Num: 27}
+
+	// sequential reads in the order of a playback
+	playback := &i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			{Addr: switchedAddress, W: []byte{0xfa}, R: []byte{0x0a}},
+			{Addr: switchedAddress, W: []byte{0xfa}, R: []byte{0x0b}},
+			{Addr: switchedAddress, W: []byte{0xfa}, R: []byte{0x0a}},
+		},
+	}
+	lock := &sync.Mutex{}
+	busA, err := newSwitchedBus(playback, lock, pinA, gpio.Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busB, err := newSwitchedBus(playback, lock, pinB, gpio.Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		bus  i2c.Bus
+		want byte
+	}{{busA, 0x0a}, {busB, 0x0b}, {busA, 0x0a}} {
+		read := make([]byte, 1)
+		if err := test.bus.Tx(switchedAddress, []byte{0xfa}, read); err != nil {
+			t.Fatal(err)
+		}
+		if read[0] != test.want {
+			t.Errorf("read %d: got %#x, want %#x", i, read[0], test.want)
+		}
+	}
+	if err := playback.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// concurrent reads, the shared lock keeps the other sensor parked
+	bus := &levelBus{
+		primaryLevel: gpio.Low,
+		pins:         []*gpiotest.Pin{pinA, pinB},
+		answers:      map[*gpiotest.Pin][]byte{pinA: {0x0a}, pinB: {0x0b}},
+	}
+	busA.bus = bus
+	busB.bus = bus
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for _, sensor := range []struct {
+		bus  *switchedBus
+		want byte
+	}{{busA, 0x0a}, {busB, 0x0b}} {
+		wg.Add(1)
+		go func(sb *switchedBus, want byte) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				read := make([]byte, 1)
+				if err := sb.Tx(switchedAddress, []byte{0xfa}, read); err != nil {
+					errs <- err
+				} else if read[0] != want {
+					errs <- errors.New(sb.String() + " read the other sensor")
+				}
+			}
+		}(sensor.bus, sensor.want)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(bus.levels) != 200 {
+		t.Errorf("%d transactions, want 200", len(bus.levels))
+	}
+}
@@ -0,0 +1,73 @@
+package sensors
+
+import (
+	"../nmea"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultImuInterval = 100 * time.Millisecond
+
+	dataTypeAttitude string = "ATTITUDE"
+)
+
+// attitude builds the record shared by all IMU drivers. Heel is positive to
+// starboard, pitch positive bow up, heading is magnetic and rate of turn is
+// given in degrees per minute like the NMEA ROT sentence.
+func attitude(heel, pitch, heading, degreesPerSecond float64) nmea.DataMap {
+	return nmea.DataMap{
+		"heel":       heel,
+		"pitch":      pitch,
+		"heading":    normalizeHeading(heading),
+		"rateofturn": degreesPerSecond * 60,
+	}
+}
+
+func normalizeHeading(heading float64) float64 {
+	heading = math.Mod(heading, 360)
+	if heading < 0 {
+		heading += 360
+	}
+	return heading
+}
+
+// angleDifference returns the signed shortest rotation from a to b in degrees
+func angleDifference(a, b float64) float64 {
+	return math.Mod(b-a+540, 360) - 180
+}
+
+func parseVector(value string) ([3]float64, error) {
+	var vector [3]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return vector, errors.New("invalid vector " + value)
+	}
+	for i, part := range parts {
+		component, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return vector, errors.New("invalid vector " + value)
+		}
+		vector[i] = component
+	}
+	return vector, nil
+}
+
+func formatVector(vector [3]float64) string {
+	parts := make([]string, len(vector))
+	for i, component := range vector {
+		parts[i] = strconv.FormatFloat(component, 'f', 4, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
@@ -0,0 +1,161 @@
+package sensors
+
+import (
+	"../nmea"
+	"./config"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	inaRegConfig      byte = 0x00
+	inaRegBusVoltage  byte = 0x02
+	inaRegPower       byte = 0x03
+	inaRegCurrent     byte = 0x04
+	inaRegCalibration byte = 0x05
+	ina226RegManufID  byte = 0xfe
+
+	ina226ManufID uint16 = 0x5449
+
+	// 32 V range, 320 mV shunt range, 128 samples averaged, continuous
+	ina219Config uint16 = 0x3fff
+	// 64 samples averaged, 1.1 ms conversion times, continuous
+	ina226Config uint16 = 0x4727
+
+	inaDefaultShunt      float64 = 0.1
+	inaDefaultMaxCurrent float64 = 3.2
+
+	dataTypeIna219 string = "INA219"
+	dataTypeIna226 string = "INA226"
+)
+
+// ina holds the scaling of the INA219 and INA226, which share their register
+// layout but differ in calibration constant and bus voltage format
+type ina struct {
+	conn         *I2CConnection
+	currentLSB   float64
+	powerLSB     float64
+	busLSB       float64
+	busShift     uint
+	currentScale float64
+	ampHours     float64
+	lastSample   time.Time
+}
+
+func readIna219(conn *I2CConnection) error {
+	dev, calibration, err := newIna(conn, 0.04096, 20)
+	if err != nil {
+		return err
+	}
+	dev.busLSB = 0.004
+	dev.busShift = 3
+
+	if err = dev.writeReg(inaRegConfig, ina219Config); err != nil {
+		return err
+	}
+	if err = dev.writeReg(inaRegCalibration, calibration); err != nil {
+		return err
+	}
+	conn.poll(dataTypeIna219, conn.interval(), dev.sense)
+	return nil
+}
+
+func readIna226(conn *I2CConnection) error {
+	dev, calibration, err := newIna(conn, 0.00512, 25)
+	if err != nil {
+		return err
+	}
+	dev.busLSB = 0.00125
+
+	id, err := dev.readReg(ina226RegManufID)
+	if err != nil {
+		return err
+	}
+	if id != ina226ManufID {
+		return errors.New("unexpected ina226 manufacturer id " + strconv.Itoa(int(id)))
+	}
+	if err = dev.writeReg(inaRegConfig, ina226Config); err != nil {
+		return err
+	}
+	if err = dev.writeReg(inaRegCalibration, calibration); err != nil {
+		return err
+	}
+	conn.poll(dataTypeIna226, conn.interval(), dev.sense)
+	return nil
+}
+
+// newIna derives current and power resolution from the configured shunt and
+// maximum current and returns the matching calibration register value
+func newIna(conn *I2CConnection, calibConst float64, powerFactor float64) (*ina, uint16, error) {
+	shunt, err := conn.config.Float(config.ParamShunt, inaDefaultShunt)
+	if err != nil {
+		return nil, 0, err
+	}
+	maxCurrent, err := conn.config.Float(config.ParamMaxCurrent, inaDefaultMaxCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	currentScale, err := conn.config.Float(config.ParamCurrentScale, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if shunt <= 0 || maxCurrent <= 0 {
+		return nil, 0, errors.New(conn.config.DeviceType() + ": shunt and max_current must be positive")
+	}
+
+	currentLSB := maxCurrent / 32768
+	calibration := math.Trunc(calibConst / (currentLSB * shunt))
+	if calibration < 1 || calibration > math.MaxUint16 {
+		return nil, 0, errors.New(conn.config.DeviceType() + ": shunt and max_current out of range")
+	}
+
+	return &ina{
+		conn:         conn,
+		currentLSB:   currentLSB,
+		powerLSB:     currentLSB * powerFactor,
+		currentScale: currentScale,
+	}, uint16(calibration), nil
+}
+
+func (dev *ina) readReg(reg byte) (uint16, error) {
+	buffer := make([]byte, 2)
+	err := dev.conn.dev().Tx([]byte{reg}, buffer)
+	return uint16(buffer[0])<<8 | uint16(buffer[1]), err
+}
+
+func (dev *ina) writeReg(reg byte, value uint16) error {
+	return dev.conn.dev().Tx([]byte{reg, byte(value >> 8), byte(value)}, nil)
+}
+
+func (dev *ina) sense() (nmea.DataMap, error) {
+	bus, err := dev.readReg(inaRegBusVoltage)
+	if err != nil {
+		return nil, err
+	}
+	current, err := dev.readReg(inaRegCurrent)
+	if err != nil {
+		return nil, err
+	}
+	power, err := dev.readReg(inaRegPower)
+	if err != nil {
+		return nil, err
+	}
+
+	amperes := float64(int16(current)) * dev.currentLSB * dev.currentScale
+
+	// amp-hours are integrated since the connection was started
+	now := time.Now()
+	if !dev.lastSample.IsZero() {
+		dev.ampHours += amperes * now.Sub(dev.lastSample).Hours()
+	}
+	dev.lastSample = now
+
+	return nmea.DataMap{
+		"voltage":  float64(bus>>dev.busShift) * dev.busLSB,
+		"current":  amperes,
+		"power":    float64(power) * dev.powerLSB * dev.currentScale,
+		"amphours": dev.ampHours,
+	}, nil
+}
@@ -0,0 +1,125 @@
+package sensors
+
+import (
+	"math"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"strings"
+	"testing"
+	"time"
+
+	"./config"
+)
+
+func TestInaSense(t *testing.T) {
+	tests := []struct {
+		name      string
+		device    string
+		configMap map[string]string
+		// bus voltage, current and power registers
+		registers   [3]uint16
+		calibration uint16
+		want        map[string]float64
+		err         string
+	}{
+		{name: "ina219 defaults", device: devIna219, configMap: map[string]string{},
+			registers: [3]uint16{0x6272, 0x2800, 0x0c80}, calibration: 4194,
+			want: map[string]float64{"voltage": 12.6, "current": 1, "power": 6.25}},
+		{name: "ina219 current scale", device: devIna219, configMap: map[string]string{config.ParamCurrentScale: "1.02"},
+			registers: [3]uint16{0x6272, 0x2800, 0x0c80}, calibration: 4194,
+			want: map[string]float64{"voltage": 12.6, "current": 1.02, "power": 6.375}},
+		{name: "ina226 discharging", device: devIna226,
+			configMap: map[string]string{config.ParamShunt: "0.002", config.ParamMaxCurrent: "20"},
+			registers: [3]uint16{0x2760, 0xf000, 0x0800}, calibration: 4194,
+			want: map[string]float64{"voltage": 12.6, "current": -2.5, "power": 31.25}},
+		{name: "ina226 small shunt", device: devIna226,
+			configMap: map[string]string{config.ParamShunt: "0.00075", config.ParamMaxCurrent: "50"},
+			registers: [3]uint16{0x2760, 0x0800, 0x0100}, calibration: 4473,
+			want: map[string]float64{"voltage": 12.6, "current": 3.125, "power": 9.765625}},
+		{name: "zero shunt", device: devIna219, configMap: map[string]string{config.ParamShunt: "0"},
+			err: "must be positive"},
+		{name: "negative max current", device: devIna226, configMap: map[string]string{config.ParamMaxCurrent: "-1"},
+			err: "must be positive"},
+		{name: "calibration out of range", device: devIna219, configMap: map[string]string{config.ParamShunt: "1000000"},
+			err: "out of range"},
+		{name: "invalid shunt", device: devIna219, configMap: map[string]string{config.ParamShunt: "small"},
+			err: config.ParamShunt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.configMap[config.ParamDevice] = test.device
+			test.configMap[config.ParamAddress] = "0x40"
+			cfg, err := config.NewI2C(test.configMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			playback := &i2ctest.Playback{
+				Ops: []i2ctest.IO{
+					{Addr: 0x40, W: []byte{inaRegBusVoltage}, R: []byte{byte(test.registers[0] >> 8), byte(test.registers[0])}},
+					{Addr: 0x40, W: []byte{inaRegCurrent}, R: []byte{byte(test.registers[1] >> 8), byte(test.registers[1])}},
+					{Addr: 0x40, W: []byte{inaRegPower}, R: []byte{byte(test.registers[2] >> 8), byte(test.registers[2])}},
+				},
+			}
+			conn := &I2CConnection{bus: playback, config: cfg, connStats: newConnStats(time.Second)}
+
+			var dev *ina
+			var calibration uint16
+			if test.device == devIna219 {
+				dev, calibration, err = newIna(conn, 0.04096, 20)
+			} else {
+				dev, calibration, err = newIna(conn, 0.00512, 25)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calibration != test.calibration {
+				t.Errorf("calibration %d, want %d", calibration, test.calibration)
+			}
+			if test.device == devIna219 {
+				dev.busLSB = 0.004
+				dev.busShift = 3
+			} else {
+				dev.busLSB = 0.00125
+			}
+
+			fields, err := dev.sense()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for field, want := range test.want {
+				if got, ok := fields[field]; !ok || math.Abs(got-want) > 1e-9 {
+					t.Errorf("%s is %v, want %v", field, got, want)
+				}
+			}
+			if fields["amphours"] != 0 {
+				t.Errorf("amphours %v after the first sample", fields["amphours"])
+			}
+			if err := playback.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIna226ManufacturerID(t *testing.T) {
+	cfg, err := config.NewI2C(map[string]string{config.ParamDevice: devIna226, config.ParamAddress: "0x40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an ina219 at the address of the configured ina226 must not be set up
+	playback := &i2ctest.Playback{
+		Ops: []i2ctest.IO{{Addr: 0x40, W: []byte{ina226RegManufID}, R: []byte{0x39, 0x9f}}},
+	}
+	conn := &I2CConnection{bus: playback, config: cfg, connStats: newConnStats(time.Second)}
+	if err := readIna226(conn); err == nil || !strings.Contains(err.Error(), "manufacturer id") {
+		t.Errorf("got error %v", err)
+	}
+	if err := playback.Close(); err != nil {
+		t.Error(err)
+	}
+}
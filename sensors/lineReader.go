@@ -0,0 +1,126 @@
+package sensors
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// NMEA limits sentences to 82 characters, leave room for proprietary ones
+	maxLineLength  int = 256
+	readBufferSize int = 4096
+)
+
+// ReadStats are the counters of a line reader since the connection was
+// created, they are kept across reconnects
+type ReadStats struct {
+	Since          time.Time
+	Bytes          uint64
+	Lines          uint64
+	DiscardedBytes uint64
+	DiscardedLines uint64
+}
+
+// BytesPerSecond is the average throughput since the reader was created
+func (rs ReadStats) BytesPerSecond() float64 {
+	seconds := time.Since(rs.Since).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(rs.Bytes) / seconds
+}
+
+// lineReader splits a byte stream into lines terminated by any combination of
+// CR and LF. Lines containing binary noise or exceeding maxLineLength are
+// discarded, and a '$' or '!' in the middle of a line starts a new one since
+// the terminator of the previous sentence was obviously lost.
+type lineReader struct {
+	reader     *bufio.Reader
+	line       []byte
+	discarding bool
+	since      time.Time
+
+	bytes          uint64
+	lines          uint64
+	discardedBytes uint64
+	discardedLines uint64
+}
+
+func newLineReader() *lineReader {
+	return &lineReader{
+		reader: bufio.NewReaderSize(nil, readBufferSize),
+		line:   make([]byte, 0, maxLineLength),
+		since:  time.Now(),
+	}
+}
+
+// reset switches to a new source, e.g. after a reconnect, and drops the
+// partial line of the old one
+func (lr *lineReader) reset(r io.Reader) {
+	lr.reader.Reset(r)
+	lr.discard()
+	lr.discarding = false
+}
+
+func (lr *lineReader) readLine() (string, error) {
+	for {
+		b, err := lr.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		atomic.AddUint64(&lr.bytes, 1)
+
+		switch {
+		case b == '\r' || b == '\n':
+			if lr.discarding {
+				lr.discarding = false
+				continue
+			}
+			// empty line or second half of CR LF
+			if len(lr.line) == 0 {
+				continue
+			}
+			line := string(lr.line)
+			lr.line = lr.line[:0]
+			atomic.AddUint64(&lr.lines, 1)
+			return line, nil
+
+		case b == '$' || b == '!':
+			lr.discard()
+			lr.discarding = false
+			lr.line = append(lr.line, b)
+
+		case lr.discarding:
+			atomic.AddUint64(&lr.discardedBytes, 1)
+
+		case b < 0x20 || b > 0x7e || len(lr.line) >= maxLineLength:
+			atomic.AddUint64(&lr.discardedBytes, uint64(len(lr.line))+1)
+			atomic.AddUint64(&lr.discardedLines, 1)
+			lr.line = lr.line[:0]
+			lr.discarding = true
+
+		default:
+			lr.line = append(lr.line, b)
+		}
+	}
+}
+
+func (lr *lineReader) discard() {
+	if len(lr.line) > 0 {
+		atomic.AddUint64(&lr.discardedBytes, uint64(len(lr.line)))
+		atomic.AddUint64(&lr.discardedLines, 1)
+		lr.line = lr.line[:0]
+	}
+}
+
+func (lr *lineReader) stats() ReadStats {
+	return ReadStats{
+		Since:          lr.since,
+		Bytes:          atomic.LoadUint64(&lr.bytes),
+		Lines:          atomic.LoadUint64(&lr.lines),
+		DiscardedBytes: atomic.LoadUint64(&lr.discardedBytes),
+		DiscardedLines: atomic.LoadUint64(&lr.discardedLines),
+	}
+}
@@ -0,0 +1,70 @@
+package sensors
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLineReader(t *testing.T) {
+	tests := []struct {
+		name string
+		// the reader is reset to each source in turn, like on a reconnect
+		sources        []string
+		lines          []string
+		discardedBytes uint64
+		discardedLines uint64
+	}{
+		{name: "cr lf", sources: []string{"$GPRMC,1*00\r\n$GPGGA,2*00\r\n"},
+			lines: []string{"$GPRMC,1*00", "$GPGGA,2*00"}},
+		{name: "any terminator", sources: []string{"$GPRMC,1\r$GPGGA,2\n\r$GPVTG,3\n\n\r\n"},
+			lines: []string{"$GPRMC,1", "$GPGGA,2", "$GPVTG,3"}},
+		{name: "lost terminator", sources: []string{"$GPRMC,abc$GPGGA,2\r\n!AIVDM,3\r\n"},
+			lines: []string{"$GPGGA,2", "!AIVDM,3"}, discardedBytes: 10, discardedLines: 1},
+		{name: "binary noise", sources: []string{"$GP\x00RMC\r\n$GPGGA,2\r\n"},
+			lines: []string{"$GPGGA,2"}, discardedBytes: 7, discardedLines: 1},
+		{name: "noise until the next sentence", sources: []string{"$GP\xffRMC$GPGGA,2\r\n"},
+			lines: []string{"$GPGGA,2"}, discardedBytes: 7, discardedLines: 1},
+		{name: "too long", sources: []string{strings.Repeat("A", 300) + "\r\n$GPGGA,2\r\n"},
+			lines: []string{"$GPGGA,2"}, discardedBytes: 300, discardedLines: 1},
+		{name: "longest line", sources: []string{"$" + strings.Repeat("A", maxLineLength-1) + "\r\n"},
+			lines: []string{"$" + strings.Repeat("A", maxLineLength-1)}},
+		{name: "partial line dropped on reconnect", sources: []string{"$GPRMC,1\r\n$GPGG", "\r\n$GPGGA,2\r\n"},
+			lines: []string{"$GPRMC,1", "$GPGGA,2"}, discardedBytes: 5, discardedLines: 1},
+		{name: "partial line kept until the source ends", sources: []string{"$GPRMC,1\r\n$GPGG"},
+			lines: []string{"$GPRMC,1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lr := newLineReader()
+			lines := make([]string, 0)
+			bytes := 0
+			for _, source := range test.sources {
+				// one byte per read, so every line is split across reads
+				lr.reset(iotest.OneByteReader(strings.NewReader(source)))
+				bytes += len(source)
+				for {
+					line, err := lr.readLine()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					lines = append(lines, line)
+				}
+			}
+
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("got %q, want %q", lines, test.lines)
+			}
+			stats := lr.stats()
+			if stats.Bytes != uint64(bytes) || stats.Lines != uint64(len(test.lines)) ||
+				stats.DiscardedBytes != test.discardedBytes || stats.DiscardedLines != test.discardedLines {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package sensors
+
+import (
+	"../Error"
+	"../nmea"
+	"./config"
+	"errors"
+	"math"
+	"periph.io/x/periph/conn/i2c"
+	"strconv"
+	"time"
+)
+
+const (
+	mpu9250RegConfig      byte = 0x1a
+	mpu9250RegGyroConfig  byte = 0x1b
+	mpu9250RegAccelConfig byte = 0x1c
+	mpu9250RegIntPinCfg   byte = 0x37
+	mpu9250RegAccel       byte = 0x3b
+	mpu9250RegPwrMgmt1    byte = 0x6b
+	mpu9250RegWhoAmI      byte = 0x75
+
+	mpu9250WhoAmI     byte    = 0x71
+	mpu9255WhoAmI     byte    = 0x73
+	mpu9250Reset      byte    = 0x80
+	mpu9250ClockPLL   byte    = 0x01
+	mpu9250Dlpf41Hz   byte    = 0x03
+	mpu9250I2CBypass  byte    = 0x02
+	mpu9250GyroPerDps float64 = 131   // +-250 deg/s
+	mpu9250AccelPerG  float64 = 16384 // +-2 g
+
+	// the magnetometer is a separate chip reached through the bypass
+	ak8963Address     uint16 = 0x0c
+	ak8963RegWhoAmI   byte   = 0x00
+	ak8963RegStatus1  byte   = 0x02
+	ak8963RegData     byte   = 0x03
+	ak8963RegControl1 byte   = 0x0a
+	ak8963RegASA      byte   = 0x10
+	ak8963WhoAmI      byte   = 0x48
+	ak8963PowerDown   byte   = 0x00
+	ak8963FuseROM     byte   = 0x0f
+	// continuous measurement at 100 Hz with 16 bit output
+	ak8963Continuous byte    = 0x16
+	ak8963DataReady  byte    = 0x01
+	ak8963Overflow   byte    = 0x08
+	ak8963MicroTesla float64 = 0.15
+
+	mpu9250DefaultAlpha           float64 = 0.98
+	mpu9250DefaultCalibrationTime         = time.Minute
+	// the first part of the calibration measures the gyroscope bias
+	mpu9250GyroCalibrationTime = 5 * time.Second
+)
+
+type mpu9250Sample struct {
+	accel [3]float64 // g
+	gyro  [3]float64 // deg/s, bias removed
+	mag   [3]float64 // uT in the accelerometer frame, offsets removed
+	fresh bool       // mag holds a new reading
+}
+
+// mpu9250 delivers raw readings that are fused by a complementary filter:
+// the integrated gyroscope is trusted short term, accelerometer and
+// tilt-compensated magnetometer correct its drift.
+type mpu9250 struct {
+	conn       *I2CConnection
+	mag        *i2c.Dev
+	magAdjust  [3]float64
+	gyroBias   [3]float64
+	magOffset  [3]float64
+	magScale   [3]float64
+	alpha      float64
+	heel       float64
+	pitch      float64
+	heading    float64
+	magReading [3]float64
+	lastSample time.Time
+
+	// calibration state
+	calibrating    bool
+	calibrationEnd time.Time
+	gyroPhaseEnd   time.Time
+	gyroSum        [3]float64
+	gyroSamples    float64
+	magMin, magMax [3]float64
+	magInitialized bool
+}
+
+func readMpu9250(conn *I2CConnection) error {
+	conn.restoreCalibration()
+	dev := &mpu9250{
+		conn:     conn,
+		mag:      &i2c.Dev{Bus: conn.bus, Addr: ak8963Address},
+		magScale: [3]float64{1, 1, 1},
+	}
+	if err := dev.init(); err != nil {
+		return err
+	}
+	if err := dev.loadCalibration(); err != nil {
+		return err
+	}
+
+	interval, err := conn.config.Duration(config.ParamInterval, defaultImuInterval)
+	if err != nil {
+		return err
+	}
+	conn.poll(dataTypeAttitude, interval, dev.sense)
+	return nil
+}
+
+func (dev *mpu9250) init() error {
+	id, err := dev.readReg(dev.conn.dev(), mpu9250RegWhoAmI, 1)
+	if err != nil {
+		return err
+	}
+	if id[0] != mpu9250WhoAmI && id[0] != mpu9255WhoAmI {
+		return errors.New("unexpected mpu9250 chip id " + strconv.Itoa(int(id[0])))
+	}
+
+	steps := [][2]byte{
+		{mpu9250RegPwrMgmt1, mpu9250Reset},
+		{mpu9250RegPwrMgmt1, mpu9250ClockPLL},
+		{mpu9250RegConfig, mpu9250Dlpf41Hz},
+		{mpu9250RegGyroConfig, 0},
+		{mpu9250RegAccelConfig, 0},
+		{mpu9250RegIntPinCfg, mpu9250I2CBypass},
+	}
+	for _, step := range steps {
+		if err = dev.conn.dev().Tx(step[:], nil); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	id, err = dev.readReg(dev.mag, ak8963RegWhoAmI, 1)
+	if err != nil {
+		return err
+	}
+	if id[0] != ak8963WhoAmI {
+		return errors.New("unexpected ak8963 chip id " + strconv.Itoa(int(id[0])))
+	}
+
+	// read the factory sensitivity adjustment from the fuse ROM
+	if err = dev.mag.Tx([]byte{ak8963RegControl1, ak8963FuseROM}, nil); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	asa, err := dev.readReg(dev.mag, ak8963RegASA, 3)
+	if err != nil {
+		return err
+	}
+	for i := range asa {
+		dev.magAdjust[i] = (float64(asa[i])-128)/256 + 1
+	}
+	if err = dev.mag.Tx([]byte{ak8963RegControl1, ak8963PowerDown}, nil); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	return dev.mag.Tx([]byte{ak8963RegControl1, ak8963Continuous}, nil)
+}
+
+func (dev *mpu9250) loadCalibration() error {
+	var err error
+	cfg := dev.conn.config
+	if dev.alpha, err = cfg.Float(config.ParamFilterAlpha, mpu9250DefaultAlpha); err != nil {
+		return err
+	}
+	if dev.alpha < 0 || dev.alpha >= 1 {
+		return errors.New("mpu9250: filter_alpha must be in [0, 1)")
+	}
+
+	vectors := map[string]*[3]float64{
+		config.ParamGyroBias:  &dev.gyroBias,
+		config.ParamMagOffset: &dev.magOffset,
+		config.ParamMagScale:  &dev.magScale,
+	}
+	for key, vector := range vectors {
+		if value := cfg.String(key, ""); value != "" {
+			if *vector, err = parseVector(value); err != nil {
+				return errors.New("mpu9250: " + key + ": " + err.Error())
+			}
+		}
+	}
+
+	if dev.calibrating, err = cfg.Bool(config.ParamCalibrate, false); err != nil {
+		return err
+	}
+	if dev.calibrating {
+		duration, err := cfg.Duration(config.ParamCalibrationTime, mpu9250DefaultCalibrationTime)
+		if err != nil {
+			return err
+		}
+		if duration <= mpu9250GyroCalibrationTime {
+			return errors.New("mpu9250: calibration_time too short")
+		}
+		now := time.Now()
+		dev.gyroPhaseEnd = now.Add(mpu9250GyroCalibrationTime)
+		dev.calibrationEnd = now.Add(duration)
+		dev.gyroBias = [3]float64{}
+		dev.magOffset = [3]float64{}
+		dev.magScale = [3]float64{1, 1, 1}
+		dev.conn.error(errors.New("mpu9250 calibration: keep the sensor still for "+
+			mpu9250GyroCalibrationTime.String()), Error.Info)
+	}
+	return nil
+}
+
+func (dev *mpu9250) readReg(d *i2c.Dev, reg byte, length int) ([]byte, error) {
+	buffer := make([]byte, length)
+	err := d.Tx([]byte{reg}, buffer)
+	return buffer, err
+}
+
+func (dev *mpu9250) read() (*mpu9250Sample, error) {
+	buffer, err := dev.readReg(dev.conn.dev(), mpu9250RegAccel, 14)
+	if err != nil {
+		return nil, err
+	}
+	bigEndian := func(i int) float64 {
+		return float64(int16(uint16(buffer[i])<<8 | uint16(buffer[i+1])))
+	}
+
+	sample := &mpu9250Sample{}
+	for i := 0; i < 3; i++ {
+		sample.accel[i] = bigEndian(2*i) / mpu9250AccelPerG
+		// temperature sits between accelerometer and gyroscope
+		sample.gyro[i] = bigEndian(8+2*i)/mpu9250GyroPerDps - dev.gyroBias[i]
+	}
+
+	status, err := dev.readReg(dev.mag, ak8963RegStatus1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if status[0]&ak8963DataReady != 0 {
+		// reading the second status register after the data ends the cycle
+		data, err := dev.readReg(dev.mag, ak8963RegData, 7)
+		if err != nil {
+			return nil, err
+		}
+		if data[6]&ak8963Overflow == 0 {
+			var raw [3]float64
+			for i := 0; i < 3; i++ {
+				raw[i] = float64(int16(uint16(data[2*i+1])<<8|uint16(data[2*i]))) *
+					dev.magAdjust[i] * ak8963MicroTesla
+			}
+			// the magnetometer axes are x and y swapped and z inverted
+			dev.magReading = [3]float64{raw[1], raw[0], -raw[2]}
+			sample.fresh = true
+		}
+	}
+	for i := 0; i < 3; i++ {
+		sample.mag[i] = (dev.magReading[i] - dev.magOffset[i]) * dev.magScale[i]
+	}
+	return sample, nil
+}
+
+func (dev *mpu9250) sense() (nmea.DataMap, error) {
+	sample, err := dev.read()
+	if err != nil {
+		return nil, err
+	}
+	if dev.calibrating {
+		return nil, dev.calibrate(sample)
+	}
+
+	now := time.Now()
+	dt := now.Sub(dev.lastSample).Seconds()
+	first := dev.lastSample.IsZero()
+	dev.lastSample = now
+
+	// attitude from gravity, mounted with x to the bow, y to port and z up
+	ax, ay, az := sample.accel[0], sample.accel[1], sample.accel[2]
+	accelHeel := degrees(math.Atan2(ay, az))
+	accelPitch := degrees(math.Atan2(ax, math.Sqrt(ay*ay+az*az)))
+
+	// tilt compensated magnetic heading, computed in the usual frame with
+	// y to starboard and z down
+	roll, pitch := radians(accelHeel), radians(accelPitch)
+	mx, my, mz := sample.mag[0], -sample.mag[1], -sample.mag[2]
+	xh := mx*math.Cos(pitch) + my*math.Sin(roll)*math.Sin(pitch) + mz*math.Cos(roll)*math.Sin(pitch)
+	yh := my*math.Cos(roll) - mz*math.Sin(roll)
+	magHeading := normalizeHeading(degrees(math.Atan2(-yh, xh)))
+
+	// turning to starboard is a negative rotation around z
+	turnRate := -sample.gyro[2]
+	if first {
+		dev.heel, dev.pitch, dev.heading = accelHeel, accelPitch, magHeading
+	} else {
+		dev.heel = dev.alpha*(dev.heel+sample.gyro[0]*dt) + (1-dev.alpha)*accelHeel
+		dev.pitch = dev.alpha*(dev.pitch-sample.gyro[1]*dt) + (1-dev.alpha)*accelPitch
+		predicted := normalizeHeading(dev.heading + turnRate*dt)
+		dev.heading = normalizeHeading(predicted +
+			(1-dev.alpha)*angleDifference(predicted, magHeading))
+	}
+
+	return attitude(dev.heel, dev.pitch, dev.heading, turnRate), nil
+}
+
+// calibrate averages the gyroscope while the sensor is still, then records
+// the magnetometer extremes while it is turned in all directions. Hard iron
+// offsets are the centres of the extremes, soft iron scales even out the
+// axis ranges.
+func (dev *mpu9250) calibrate(sample *mpu9250Sample) error {
+	now := time.Now()
+	if now.Before(dev.gyroPhaseEnd) {
+		for i := 0; i < 3; i++ {
+			dev.gyroSum[i] += sample.gyro[i]
+		}
+		dev.gyroSamples++
+		return nil
+	}
+	if dev.gyroSamples > 0 {
+		for i := 0; i < 3; i++ {
+			dev.gyroBias[i] = dev.gyroSum[i] / dev.gyroSamples
+		}
+		dev.gyroSamples = 0
+		dev.conn.error(errors.New("mpu9250 calibration: turn the sensor in all directions until "+
+			dev.calibrationEnd.Format(time.Kitchen)), Error.Info)
+	}
+
+	if now.Before(dev.calibrationEnd) {
+		if sample.fresh {
+			dev.trackMagnetometer(dev.magReading)
+		}
+		return nil
+	}
+
+	dev.calibrating = false
+	if !dev.magInitialized {
+		return errors.New("mpu9250 calibration: no magnetometer readings")
+	}
+	var ranges [3]float64
+	average := 0.0
+	for i := 0; i < 3; i++ {
+		dev.magOffset[i] = (dev.magMax[i] + dev.magMin[i]) / 2
+		ranges[i] = (dev.magMax[i] - dev.magMin[i]) / 2
+		average += ranges[i] / 3
+	}
+	for i := 0; i < 3; i++ {
+		if ranges[i] <= 0 {
+			return errors.New("mpu9250 calibration: sensor was not turned around every axis")
+		}
+		dev.magScale[i] = average / ranges[i]
+	}
+
+	return dev.conn.saveCalibration(map[string]string{
+		config.ParamGyroBias:  formatVector(dev.gyroBias),
+		config.ParamMagOffset: formatVector(dev.magOffset),
+		config.ParamMagScale:  formatVector(dev.magScale),
+	})
+}
+
+func (dev *mpu9250) trackMagnetometer(reading [3]float64) {
+	if !dev.magInitialized {
+		dev.magMin, dev.magMax = reading, reading
+		dev.magInitialized = true
+		return
+	}
+	for i := 0; i < 3; i++ {
+		dev.magMin[i] = math.Min(dev.magMin[i], reading[i])
+		dev.magMax[i] = math.Max(dev.magMax[i], reading[i])
+	}
+}
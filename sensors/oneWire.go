@@ -0,0 +1,187 @@
+package sensors
+
+import (
+	"../Error"
+	"../nmea"
+	"./config"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the power-on value of the scratchpad, read if a conversion failed
+	ds18b20PowerOnMilliC int = 85000
+
+	dataTypeTemperature string = "TEMPERATURE"
+)
+
+// family codes of the supported temperature probes:
+// DS18S20, DS1822, DS18B20, DS1825 and DS28EA00
+var oneWireFamilies = []string{"10", "22", "28", "3b", "42"}
+
+// OneWireConnection reads temperature probes through the w1_therm driver of
+// the Linux kernel. Probes are enumerated on every poll, so probes that are
+// added or fail later are picked up.
+type OneWireConnection struct {
+	engine *Engine
+	config *config.OneWireConfig
+	connStats
+
+	// lock guards stop and stopChan, Stop is called by the watchdog and the
+	// engine
+	lock     sync.Mutex
+	stop     bool
+	stopChan chan bool
+}
+
+func (e *Engine) newOneWireConnection(cfg config.Config) (*OneWireConnection, error) {
+	configuration, err := config.OneWireFromInterface(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OneWireConnection{
+		engine:    e,
+		config:    configuration,
+		stop:      true,
+		connStats: newConnStats(configuration.ExpectedInterval()),
+	}, nil
+}
+
+// Connection interface implementation
+func (wc *OneWireConnection) DeviceID() int64 {
+	return wc.config.DeviceID()
+}
+
+func (wc *OneWireConnection) Type() string {
+	return wc.config.Type()
+}
+
+func (wc *OneWireConnection) Status() Status {
+	status := wc.status(wc.DeviceID(), wc.Type())
+	status.ExpectedInterval = wc.config.ExpectedInterval()
+	return status
+}
+
+func (wc *OneWireConnection) Stop() {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	wc.stopRoutine()
+}
+
+func (wc *OneWireConnection) stopRoutine() {
+	if wc.stop {
+		return
+	}
+	wc.error(errors.New("stopping probes in " + wc.config.Path()))
+	wc.stop = true
+	close(wc.stopChan)
+}
+
+func (wc *OneWireConnection) connect() error {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	wc.stopRoutine()
+	if _, err := ioutil.ReadDir(wc.config.Path()); err != nil {
+		return err
+	}
+
+	wc.stop = false
+	wc.stopChan = make(chan bool)
+	wc.swapState(StateRunning)
+	wc.engine.routines.Add(1)
+	go wc.readRoutine(wc.stopChan)
+	return nil
+}
+
+func (wc *OneWireConnection) readRoutine(stopChan chan bool) {
+	defer wc.engine.routines.Done()
+	defer wc.swapState(StateStopped)
+	ticker := time.NewTicker(wc.config.Interval())
+	defer ticker.Stop()
+
+	for {
+		fields := nmea.DataMap{}
+		for _, serial := range wc.probes() {
+			temperature, err := readW1Temperature(filepath.Join(wc.config.Path(), serial))
+			if err != nil {
+				wc.error(errors.New(serial+": "+err.Error()), Error.Low)
+				continue
+			}
+			fields[wc.config.Name(serial)] = temperature
+		}
+		if len(fields) > 0 {
+			wc.countSentence()
+			wc.engine.publish(nmea.NewSensorData(dataTypeTemperature, wc.DeviceID(), fields))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// probes returns the serials of all temperature probes in the devices path
+func (wc *OneWireConnection) probes() []string {
+	serials := make([]string, 0)
+	for _, family := range oneWireFamilies {
+		matches, err := filepath.Glob(filepath.Join(wc.config.Path(), family+"-*"))
+		if err != nil {
+			wc.error(err, Error.Low)
+			continue
+		}
+		for _, match := range matches {
+			serials = append(serials, filepath.Base(match))
+		}
+	}
+	return serials
+}
+
+func (wc *OneWireConnection) error(err error, lvl ...Error.Level) {
+	errLvl := Error.Debug
+	if len(lvl) > 0 {
+		errLvl = lvl[0]
+	}
+	wc.countError(err, errLvl)
+	wc.engine.errorChan <- Error.Err(errLvl, err, ErrFlag, ErrW1Flag)
+}
+
+// readW1Temperature parses the w1_slave file of a probe, which looks like
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+//
+// and returns the temperature in degrees Celsius
+func readW1Temperature(probePath string) (float64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(probePath, "w1_slave"))
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		return 0, errors.New("malformed w1_slave file")
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, errors.New("crc check failed")
+	}
+
+	index := strings.LastIndex(lines[1], "t=")
+	if index < 0 {
+		return 0, errors.New("no temperature in w1_slave file")
+	}
+	milliC, err := strconv.Atoi(strings.TrimSpace(lines[1][index+2:]))
+	if err != nil {
+		return 0, errors.New("could not parse temperature from w1_slave file")
+	}
+	if milliC == ds18b20PowerOnMilliC {
+		return 0, errors.New("probe returned its power-on value")
+	}
+	return float64(milliC) / 1000.0, nil
+}
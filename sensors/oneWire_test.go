@@ -0,0 +1,152 @@
+package sensors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"./config"
+)
+
+const (
+	w1SlaveValid     = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	w1SlaveBelowZero = "5e ff 4b 46 7f ff 02 10 d9 : crc=d9 YES\n5e ff 4b 46 7f ff 02 10 d9 t=-10125\n"
+	w1SlaveCRCNo     = "72 01 4b 46 7f ff 0e 10 57 : crc=00 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	w1SlavePowerOn   = "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n"
+)
+
+// fakeW1 creates a w1 devices directory with a w1_slave file per slave
+func fakeW1(t *testing.T, slaves map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range slaves {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if content == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "w1_slave"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadW1Temperature(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    float64
+		err     string
+	}{
+		{name: "valid", content: w1SlaveValid, want: 23.125},
+		{name: "below zero", content: w1SlaveBelowZero, want: -10.125},
+		{name: "crc failed", content: w1SlaveCRCNo, err: "crc check failed"},
+		{name: "power-on value", content: w1SlavePowerOn, err: "power-on value"},
+		{name: "one line", content: "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n", err: "malformed"},
+		{name: "no temperature", content: "72 01 : crc=57 YES\n72 01\n", err: "no temperature"},
+		{name: "unparseable", content: "72 01 : crc=57 YES\n72 01 t=abc\n", err: "could not parse"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := fakeW1(t, map[string]string{"28-000005e2fdc3": test.content})
+			got, err := readW1Temperature(filepath.Join(dir, "28-000005e2fdc3"))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %v, error %v, want %v", got, err, test.want)
+			}
+		})
+	}
+
+	if _, err := readW1Temperature(filepath.Join(t.TempDir(), "28-000000000000")); err == nil {
+		t.Error("missing w1_slave file accepted")
+	}
+}
+
+func TestOneWireProbes(t *testing.T) {
+	dir := fakeW1(t, map[string]string{
+		"28-000005e2fdc3": w1SlaveValid,
+		"10-000802b4a1c9": w1SlaveValid,
+		"3b-0000001a2b3c": w1SlaveValid,
+		// a DS2401 serial number chip and the bus master are no probes
+		"01-000017e7a9b2": "",
+		"w1_bus_master1":  "",
+	})
+	errorChan := make(chan *Error.Error, 64)
+	cfg, err := config.NewOneWire(map[string]string{config.ParamPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(make(chan *nmea.Data), errorChan)
+	defer e.Stop(time.Second)
+	conn, err := e.newOneWireConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := conn.probes()
+	sort.Strings(got)
+	want := []string{"10-000802b4a1c9", "28-000005e2fdc3", "3b-0000001a2b3c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("probes %v, want %v", got, want)
+	}
+}
+
+func TestOneWireReadings(t *testing.T) {
+	dir := fakeW1(t, map[string]string{
+		"28-000005e2fdc3": w1SlaveValid,
+		"28-000005e2fdc4": w1SlaveBelowZero,
+		"28-000005e2fdc5": w1SlaveCRCNo,
+		"28-000005e2fdc6": w1SlavePowerOn,
+	})
+	errorChan := make(chan *Error.Error, 64)
+	nmeaChan := make(chan *nmea.Data, 4)
+	cfg, err := config.NewOneWire(map[string]string{
+		config.ParamPath:     dir,
+		config.ParamInterval: "10ms",
+		"28-000005e2fdc3":    "coolant",
+		"28-000005e2fdc5":    "exhaust",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(nmeaChan, errorChan)
+	if e.Connect(cfg) == nil {
+		t.Fatal("not connected")
+	}
+
+	var data *nmea.Data
+	select {
+	case data = <-nmeaChan:
+	case <-time.After(time.Second):
+		t.Fatal("no reading")
+	}
+	if err := e.Stop(time.Second); err != nil {
+		t.Error(err)
+	}
+
+	if data.Type != dataTypeTemperature || data.DeviceID() != cfg.DeviceID() {
+		t.Errorf("type %s of device %d", data.Type, data.DeviceID())
+	}
+	// probes that failed are left out, probes without a name keep their serial
+	want := nmea.DataMap{
+		"coolant":         23.125,
+		"28-000005e2fdc4": -10.125,
+		"deviceid":        float64(cfg.DeviceID()),
+	}
+	if !reflect.DeepEqual(data.Data, want) {
+		t.Errorf("got %v, want %v", data.Data, want)
+	}
+}
@@ -0,0 +1,323 @@
+package sensors
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"periph.io/x/periph/conn/i2c"
+	"sort"
+	"strconv"
+	"time"
+
+	"../Error"
+	"./config"
+)
+
+const (
+	bmp180ChipID byte = 0x55
+	bmp280ChipID byte = 0x58
+	bme280ChipID byte = 0x60
+
+	sht3xCmdStatus uint16 = 0xf32d
+	sht4xCmdSerial byte   = 0x89
+	htu21dCmdUser  byte   = 0xe7
+
+	ads1115RegLoThresh byte = 0x02
+	ads1115RegHiThresh byte = 0x03
+	// power-on value of the ina219 configuration register
+	ina219ResetConfig uint16 = 0x399f
+)
+
+// silicon labs electronic id, the first byte of the second part names the chip
+var si70xxCmdID = []byte{0xfc, 0xc9}
+
+// Detected is a device found by ScanI2C
+type Detected struct {
+	Bus     string
+	Address uint16
+	Device  string
+	Chip    string
+	// set if the address is used on another bus as well
+	DeviceID uint32
+}
+
+// i2cProbe tells from the answers of a device at one of addresses which
+// chip it is, it returns an empty device type if the chip does not match
+type i2cProbe struct {
+	addresses []uint16
+	probe     func(dev *i2c.Dev) (device string, chip string)
+}
+
+// probes in order of decreasing confidence, the first match of an address
+// wins. The humidity sensors at 0x40 are probed before the INA226, whose
+// register pointer 0xfe is the soft reset command of the HTU21D and Si70xx,
+// they would not answer during the reset.
+var i2cProbes = []i2cProbe{
+	{[]uint16{0x28, 0x29}, probeBno055},
+	{[]uint16{0x68, 0x69}, probeMpu9250},
+	{[]uint16{0x76, 0x77}, probeBmxx80},
+	{[]uint16{0x40}, probeSi70xx},
+	{[]uint16{0x40}, probeHtu21d},
+	{i2cAddressRange(0x40, 0x4f), probeIna226},
+	{[]uint16{0x44, 0x45}, probeSht3x},
+	{[]uint16{0x44, 0x45, 0x46}, probeSht4x},
+	{[]uint16{0x48, 0x49, 0x4a, 0x4b}, probeAds1115},
+	{i2cAddressRange(0x40, 0x4f), probeIna219},
+}
+
+// ScanI2C probes every /dev/i2c-* bus for the supported devices. Only
+// registers that identify a chip are read, no device is configured.
+func (e *Engine) ScanI2C() ([]Detected, error) {
+	paths, err := filepath.Glob("/dev/i2c-*")
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.New(ErrI2CFlag + ": no i2c bus found")
+	}
+	sort.Strings(paths)
+
+	detected := make([]Detected, 0)
+	for _, path := range paths {
+		if err := e.i2cBusInit(path); err != nil {
+			e.error(errors.New(path+": "+err.Error()), Error.Low)
+			continue
+		}
+		detected = append(detected, scanI2CBus(path, e.i2cBuses[path])...)
+	}
+
+	assignDeviceIDs(detected)
+	return detected, nil
+}
+
+// assignDeviceIDs keeps the device ids unique across buses. The first device
+// at an address keeps the default id, the others get the next free one of
+// the ids used for address switched devices.
+func assignDeviceIDs(detected []Detected) {
+	used := map[uint32]bool{}
+	seen := map[uint16]bool{}
+	for i := range detected {
+		address := detected[i].Address
+		if seen[address] {
+			n := uint(1)
+			for used[config.I2CDeviceID(address, n)] {
+				n++
+			}
+			detected[i].DeviceID = config.I2CDeviceID(address, n)
+			used[detected[i].DeviceID] = true
+		}
+		seen[address] = true
+	}
+}
+
+func scanI2CBus(path string, bus i2c.Bus) []Detected {
+	detected := make([]Detected, 0)
+	found := map[uint16]bool{}
+	for _, p := range i2cProbes {
+		for _, address := range p.addresses {
+			if found[address] {
+				continue
+			}
+			device, chip := p.probe(&i2c.Dev{Bus: bus, Addr: address})
+			if device == "" {
+				continue
+			}
+			found[address] = true
+			detected = append(detected, Detected{
+				Bus:     path,
+				Address: address,
+				Device:  device,
+				Chip:    chip,
+			})
+		}
+	}
+	sort.Slice(detected, func(i, j int) bool {
+		return detected[i].Address < detected[j].Address
+	})
+	return detected
+}
+
+// ConfigMap is the device configuration of a detected device
+func (d Detected) ConfigMap() map[string]string {
+	configMap := map[string]string{
+		config.ParamType:    config.TypeI2C,
+		config.ParamBus:     d.Bus,
+		config.ParamAddress: fmt.Sprintf("0x%02x", d.Address),
+		config.ParamDevice:  d.Device,
+	}
+	if d.DeviceID != 0 {
+		configMap[config.ParamDeviceID] = strconv.FormatUint(uint64(d.DeviceID), 10)
+	}
+	return configMap
+}
+
+// WriteDetected writes the configuration entries of detected devices in the
+// key = value form of the device configuration, separated by blank lines
+func WriteDetected(w io.Writer, detected []Detected) error {
+	order := []string{config.ParamType, config.ParamBus, config.ParamAddress,
+		config.ParamDevice, config.ParamDeviceID}
+
+	for i, d := range detected {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# %s on %s\n", d.Chip, d.Bus); err != nil {
+			return err
+		}
+		configMap := d.ConfigMap()
+		for _, key := range order {
+			value, ok := configMap[key]
+			if !ok {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s = %s\n", key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func i2cAddressRange(first uint16, last uint16) []uint16 {
+	addresses := make([]uint16, 0, last-first+1)
+	for address := first; address <= last; address++ {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func probeReg(dev *i2c.Dev, reg byte, length int) ([]byte, bool) {
+	buffer := make([]byte, length)
+	if err := dev.Tx([]byte{reg}, buffer); err != nil {
+		return nil, false
+	}
+	return buffer, true
+}
+
+func probeWord(dev *i2c.Dev, reg byte) (uint16, bool) {
+	buffer, ok := probeReg(dev, reg, 2)
+	if !ok {
+		return 0, false
+	}
+	return uint16(buffer[0])<<8 | uint16(buffer[1]), true
+}
+
+func probeBno055(dev *i2c.Dev) (string, string) {
+	if id, ok := probeReg(dev, bno055RegChipID, 1); ok && id[0] == bno055ChipID {
+		return devBno055, "BNO055"
+	}
+	return "", ""
+}
+
+func probeMpu9250(dev *i2c.Dev) (string, string) {
+	id, ok := probeReg(dev, mpu9250RegWhoAmI, 1)
+	switch {
+	case ok && id[0] == mpu9250WhoAmI:
+		return devMpu9250, "MPU-9250"
+	case ok && id[0] == mpu9255WhoAmI:
+		return devMpu9250, "MPU-9255"
+	}
+	return "", ""
+}
+
+func probeBmxx80(dev *i2c.Dev) (string, string) {
+	id, ok := probeReg(dev, bme680RegChipID, 1)
+	if !ok {
+		return "", ""
+	}
+	switch id[0] {
+	case bmp180ChipID:
+		return devBmxx80, "BMP180"
+	case bmp280ChipID:
+		return devBmxx80, "BMP280"
+	case bme280ChipID:
+		return devBmxx80, "BME280"
+	case bme680ChipID:
+		return devBme680, "BME680"
+	}
+	return "", ""
+}
+
+func probeIna226(dev *i2c.Dev) (string, string) {
+	if id, ok := probeWord(dev, ina226RegManufID); ok && id == ina226ManufID {
+		return devIna226, "INA226"
+	}
+	return "", ""
+}
+
+// probeIna219 can only compare the configuration register with the power-on
+// value and the one written by the driver
+func probeIna219(dev *i2c.Dev) (string, string) {
+	value, ok := probeWord(dev, inaRegConfig)
+	if ok && (value == ina219ResetConfig || value == ina219Config) {
+		return devIna219, "INA219"
+	}
+	return "", ""
+}
+
+func probeSi70xx(dev *i2c.Dev) (string, string) {
+	buffer := make([]byte, 6)
+	if err := dev.Tx(si70xxCmdID, buffer); err != nil {
+		return "", ""
+	}
+	if crc8(buffer[0:2], 0x00) != buffer[2] {
+		return "", ""
+	}
+	switch buffer[0] {
+	case 0x0d:
+		return devSi7021, "Si7013"
+	case 0x14:
+		return devSi7021, "Si7020"
+	case 0x15:
+		return devSi7021, "Si7021"
+	}
+	return "", ""
+}
+
+func probeHtu21d(dev *i2c.Dev) (string, string) {
+	// reserved bits are zero, otp reload is disabled after reset
+	if user, ok := probeReg(dev, htu21dCmdUser, 1); ok && user[0]&0x3a == 0x02 {
+		return devHtu21d, "HTU21D"
+	}
+	return "", ""
+}
+
+func probeSht3x(dev *i2c.Dev) (string, string) {
+	buffer := make([]byte, 3)
+	if err := dev.Tx(sht3xCommand(sht3xCmdStatus), buffer); err != nil {
+		return "", ""
+	}
+	if crc8(buffer[0:2], 0xff) == buffer[2] {
+		return devSht3x, "SHT3x"
+	}
+	return "", ""
+}
+
+func probeSht4x(dev *i2c.Dev) (string, string) {
+	if err := dev.Tx([]byte{sht4xCmdSerial}, nil); err != nil {
+		return "", ""
+	}
+	time.Sleep(time.Millisecond)
+	buffer := make([]byte, 6)
+	if err := dev.Tx(nil, buffer); err != nil {
+		return "", ""
+	}
+	if crc8(buffer[0:2], 0xff) == buffer[2] && crc8(buffer[3:5], 0xff) == buffer[5] {
+		return devSht4x, "SHT4x"
+	}
+	return "", ""
+}
+
+// probeAds1115 checks the power-on values of the comparator thresholds, which
+// the driver leaves untouched
+func probeAds1115(dev *i2c.Dev) (string, string) {
+	low, okLow := probeWord(dev, ads1115RegLoThresh)
+	high, okHigh := probeWord(dev, ads1115RegHiThresh)
+	if okLow && okHigh && low == 0x8000 && high == 0x7fff {
+		return devAds1115, "ADS1115"
+	}
+	return "", ""
+}
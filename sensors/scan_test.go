@@ -0,0 +1,100 @@
+package sensors
+
+import (
+	"bytes"
+	"errors"
+	"periph.io/x/periph/conn/physic"
+	"reflect"
+	"testing"
+)
+
+// fakeBus answers writes of a known command or register with the stored
+// bytes, addresses without a device and unknown commands fail like a NACK
+type fakeBus map[uint16]map[string][]byte
+
+func (fb fakeBus) String() string                    { return "fake" }
+func (fb fakeBus) SetSpeed(f physic.Frequency) error { return nil }
+
+func (fb fakeBus) Tx(addr uint16, w []byte, r []byte) error {
+	answer, ok := fb[addr][string(w)]
+	if !ok {
+		return errors.New("nack")
+	}
+	copy(r, answer)
+	return nil
+}
+
+func TestScanI2CBus(t *testing.T) {
+	status := []byte{0x80, 0x10}
+	bus := fakeBus{
+		0x28: {string([]byte{bno055RegChipID}): {bno055ChipID}},
+		0x40: {string([]byte{inaRegConfig}): {0x39, 0x9f}},
+		0x44: {string(sht3xCommand(sht3xCmdStatus)): append(status, crc8(status, 0xff))},
+		0x48: {
+			string([]byte{ads1115RegLoThresh}): {0x80, 0x00},
+			string([]byte{ads1115RegHiThresh}): {0x7f, 0xff},
+		},
+		// neither a bmp280 nor a bme280
+		0x76: {string([]byte{bme680RegChipID}): {0x42}},
+		0x77: {string([]byte{bme680RegChipID}): {bme280ChipID}},
+	}
+
+	detected := scanI2CBus("/dev/i2c-1", bus)
+	want := []Detected{
+		{Bus: "/dev/i2c-1", Address: 0x28, Device: devBno055, Chip: "BNO055"},
+		{Bus: "/dev/i2c-1", Address: 0x40, Device: devIna219, Chip: "INA219"},
+		{Bus: "/dev/i2c-1", Address: 0x44, Device: devSht3x, Chip: "SHT3x"},
+		{Bus: "/dev/i2c-1", Address: 0x48, Device: devAds1115, Chip: "ADS1115"},
+		{Bus: "/dev/i2c-1", Address: 0x77, Device: devBmxx80, Chip: "BME280"},
+	}
+	if !reflect.DeepEqual(detected, want) {
+		t.Errorf("got %+v, want %+v", detected, want)
+	}
+}
+
+func TestAssignDeviceIDs(t *testing.T) {
+	detected := []Detected{
+		{Bus: "/dev/i2c-1", Address: 0x40},
+		{Bus: "/dev/i2c-1", Address: 0x76},
+		{Bus: "/dev/i2c-3", Address: 0x40},
+		{Bus: "/dev/i2c-4", Address: 0x40},
+		{Bus: "/dev/i2c-4", Address: 0x76},
+	}
+	assignDeviceIDs(detected)
+	ids := make([]uint32, 0, len(detected))
+	for _, d := range detected {
+		ids = append(ids, d.DeviceID)
+	}
+	// the default ids of address switched devices, all below the serial ones
+	want := []uint32{0, 0, 0x140, 0x240, 0x176}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %#x, want %#x", ids, want)
+	}
+}
+
+func TestWriteDetected(t *testing.T) {
+	detected := []Detected{
+		{Bus: "/dev/i2c-1", Address: 0x40, Device: devIna226, Chip: "INA226"},
+		{Bus: "/dev/i2c-3", Address: 0x40, Device: devIna226, Chip: "INA226", DeviceID: 0x140},
+	}
+	var buffer bytes.Buffer
+	if err := WriteDetected(&buffer, detected); err != nil {
+		t.Fatal(err)
+	}
+	want := `# INA226 on /dev/i2c-1
+type = i2c
+bus = /dev/i2c-1
+address = 0x40
+device = ina226
+
+# INA226 on /dev/i2c-3
+type = i2c
+bus = /dev/i2c-3
+address = 0x40
+device = ina226
+deviceid = 320
+`
+	if buffer.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buffer.String(), want)
+	}
+}
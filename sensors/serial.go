@@ -1,18 +1,47 @@
 package sensors
 
 import (
+	"../Error"
 	"../nmea"
 	"./config"
-	"bufio"
 	"errors"
 	"github.com/tarm/serial"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	serialByIDDir string = "/dev/serial/by-id"
+
+	// dropped line that does not even look like a sentence
+	droppedUnparseable string = "unparseable"
+
+	// a read that times out returns io.EOF, so does the port of an unplugged
+	// USB adapter, but at once and over and over again
+	maxFastEOFs int = 3
+)
+
+type serialOpenFunc func(deviceConfig *serial.Config) (io.ReadCloser, error)
+
 type SerialConnection struct {
-	engine *Engine
-	config *config.SerialConfig
-	port   *serial.Port
-	stop   bool
+	engine  *Engine
+	config  *config.SerialConfig
+	open    serialOpenFunc
+	port    io.ReadCloser
+	reader  *lineReader
+	path    string
+	dropped map[string]uint64
+	connStats
+
+	// lock guards stopChan and done, the port and the reader belong to the
+	// read routine alone
+	lock     sync.Mutex
+	stopChan chan bool
+	done     chan bool
 }
 
 func (e *Engine) newSerialConnection(cfg config.Config) (*SerialConnection, error) {
@@ -22,80 +51,296 @@ func (e *Engine) newSerialConnection(cfg config.Config) (*SerialConnection, erro
 	}
 
 	return &SerialConnection{
-		engine: e,
-		config: configuration,
-		port:   nil,
-		stop:   false,
+		engine:    e,
+		config:    configuration,
+		open:      openSerialPort,
+		port:      nil,
+		reader:    newLineReader(),
+		path:      configuration.DeviceConfig().Name,
+		dropped:   map[string]uint64{},
+		connStats: newConnStats(configuration.ExpectedInterval()),
 	}, nil
 }
 
 // Connection interface implementation
-func (sc SerialConnection) DeviceID() int64 {
+func (sc *SerialConnection) DeviceID() int64 {
 	return sc.config.DeviceID()
 }
 
-func (sc SerialConnection) Type() string {
+func (sc *SerialConnection) Type() string {
 	return sc.config.Type()
 }
 
-func (sc SerialConnection) Stop() {
-	if !sc.stop {
-		sc.engine.error(errors.New(
-			"stopping serial sensors on " +
-				sc.config.DeviceConfig().Name))
+// Status adds the raw byte count and dropped sentences of the serial reader
+func (sc *SerialConnection) Status() Status {
+	status := sc.status(sc.DeviceID(), sc.Type())
+	status.ExpectedInterval = sc.config.ExpectedInterval()
+	status.Bytes = sc.reader.stats().Bytes
+	status.Dropped = sc.Dropped()
+	return status
+}
+
+// Stop tells the read routine to close the port and return, which it does
+// within the read timeout
+func (sc *SerialConnection) Stop() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.stopRoutine()
+}
+
+func (sc *SerialConnection) stopRoutine() {
+	if sc.stopChan == nil {
+		return
+	}
+	sc.engine.error(errors.New(
+		"stopping serial sensors on " +
+			sc.config.DeviceConfig().Name))
+	close(sc.stopChan)
+	sc.stopChan = nil
+}
+
+// connect starts the read routine, which opens the port itself so that a
+// device that is not plugged in yet is picked up once it appears. A previous
+// routine is stopped and waited for, so only one reads from the port.
+func (sc *SerialConnection) connect() error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.stopRoutine()
+	if sc.done != nil {
+		<-sc.done
+	}
+
+	sc.stopChan = make(chan bool)
+	sc.done = make(chan bool)
+	sc.engine.routines.Add(1)
+	go sc.readRoutine(sc.stopChan, sc.done)
+
+	return nil
+}
+
+func (sc *SerialConnection) readRoutine(stopChan chan bool, done chan bool) {
+	defer sc.engine.routines.Done()
+	defer close(done)
+	defer sc.setState(StateStopped)
+	defer sc.closePort()
+
+	if !sc.openPort(stopChan) {
+		return
+	}
 
-		sc.stop = true
-		err := sc.port.Close()
-		if err != nil {
-			sc.engine.error(err)
+	fastEOFs := 0
+	delay := time.Duration(0)
+	for !isClosed(stopChan) {
+		start := time.Now()
+		line, err := sc.readLine()
+		switch {
+		case err == io.EOF:
+			// a timed out read took about the read timeout, a device that is
+			// gone returns at once or its device node disappears
+			if time.Since(start) < sc.config.DeviceConfig().ReadTimeout/2 {
+				fastEOFs++
+			} else {
+				fastEOFs = 0
+			}
+			if _, statErr := os.Stat(sc.path); statErr == nil && fastEOFs < maxFastEOFs {
+				continue
+			}
+			sc.error(errors.New("end of file, reconnecting"), Error.Warning)
+			fastEOFs = 0
+			if !sc.reopenPort(stopChan, &delay) {
+				return
+			}
+		case err != nil:
+			if isClosed(stopChan) {
+				return
+			}
+			sc.error(err, Error.Warning)
+			if !sc.reopenPort(stopChan, &delay) {
+				return
+			}
+		default:
+			fastEOFs = 0
+			delay = 0
+			sc.forward(line)
 		}
-		sc.port = nil
 	}
 }
 
-func (sc SerialConnection) connect() error {
-	if sc.port != nil {
-		sc.Stop()
+// forward sends the line to the engine if it is a sentence that passes the
+// configured filter and can be parsed, otherwise it is counted as dropped
+func (sc *SerialConnection) forward(line string) {
+	if !strings.HasPrefix(line, "$") && !strings.HasPrefix(line, "!") {
+		sc.drop(droppedUnparseable)
+		return
 	}
 
-	port, err := serial.OpenPort(sc.config.DeviceConfig())
+	sentenceType := nmea.GetType(line)
+	if !sc.config.Forwards(sentenceType) {
+		sc.drop(sentenceType)
+		return
+	}
+
+	data, err := nmea.NewData(line, sc.DeviceID())
 	if err != nil {
-		return err
+		sc.error(err)
+		sc.drop(sentenceType)
+		return
 	}
-	sc.port = port
-	sc.stop = false
-	go sc.readRoutine()
+	sc.countSentence()
+	sc.engine.publish(data)
+}
 
-	return nil
+func (sc *SerialConnection) drop(sentenceType string) {
+	sc.statsMutex.Lock()
+	sc.dropped[sentenceType]++
+	sc.statsMutex.Unlock()
 }
 
-func (sc *SerialConnection) readRoutine() {
-	defer sc.Stop()
+// Dropped returns how many sentences of each type were not forwarded, either
+// because of the filter or because they could not be parsed
+func (sc *SerialConnection) Dropped() map[string]uint64 {
+	sc.statsMutex.Lock()
+	defer sc.statsMutex.Unlock()
+	dropped := make(map[string]uint64, len(sc.dropped))
+	for sentenceType, count := range sc.dropped {
+		dropped[sentenceType] = count
+	}
+	return dropped
+}
 
-	var err error
-	for !sc.stop && err == nil {
-		var line string
-		line, err = sc.readLine()
-		if err != nil {
-			sc.engine.error(err)
-		} else if nmea.GetType(line) == "$GPRMC" || nmea.GetType(line) == "$--RMC" {
-			data, err := nmea.NewData(line, sc.DeviceID())
-			if err != nil {
-				sc.engine.error(err)
-			} else {
-				sc.engine.nmeaChan <- data
+// openPort tries to open the port until it succeeds or the connection is
+// stopped. The delay between attempts starts at the configured minimum and
+// doubles up to the maximum.
+func (sc *SerialConnection) openPort(stopChan chan bool) bool {
+	sc.setState(StateConnecting)
+	delay := sc.config.ReconnectMin()
+
+	for attempt := 1; !isClosed(stopChan); attempt++ {
+		if _, err := os.Stat(sc.path); err == nil {
+			sc.path = stablePath(sc.path)
+			deviceConfig := *sc.config.DeviceConfig()
+			deviceConfig.Name = sc.path
+
+			port, err := sc.open(&deviceConfig)
+			if err == nil {
+				sc.port = port
+				sc.reader.reset(port)
+				sc.setState(StateRunning)
+				return true
 			}
+			sc.error(err)
+		} else if attempt == 1 {
+			sc.error(errors.New("device not present, waiting for it to appear"), Error.Warning)
 		}
+
+		select {
+		case <-stopChan:
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > sc.config.ReconnectMax() {
+			delay = sc.config.ReconnectMax()
+		}
+	}
+	return false
+}
+
+// reopenPort closes the port and opens it again. The first attempt is made
+// at once, if the port fails again before it delivered a line the delay
+// before the next one doubles from the configured minimum up to the maximum.
+func (sc *SerialConnection) reopenPort(stopChan chan bool, delay *time.Duration) bool {
+	sc.closePort()
+	if *delay > 0 {
+		sc.setState(StateConnecting)
+		select {
+		case <-stopChan:
+			return false
+		case <-time.After(*delay):
+		}
+	}
+	if *delay *= 2; *delay < sc.config.ReconnectMin() {
+		*delay = sc.config.ReconnectMin()
+	} else if *delay > sc.config.ReconnectMax() {
+		*delay = sc.config.ReconnectMax()
+	}
+	return sc.openPort(stopChan)
+}
+
+func (sc *SerialConnection) closePort() {
+	if sc.port == nil {
+		return
+	}
+	err := sc.port.Close()
+	if err != nil {
+		sc.error(err)
+	}
+	sc.port = nil
+}
+
+func openSerialPort(deviceConfig *serial.Config) (io.ReadCloser, error) {
+	port, err := serial.OpenPort(deviceConfig)
+	if err != nil {
+		return nil, err
 	}
+	return port, nil
+}
+
+func isClosed(stopChan chan bool) bool {
+	select {
+	case <-stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sc *SerialConnection) setState(state State) {
+	previous := sc.swapState(state)
+	if previous == state {
+		return
+	}
+	sc.engine.errorChan <- Error.New(Error.Info,
+		sc.path+": "+previous.String()+" -> "+state.String(),
+		ErrFlag, ErrSerialFlag)
+}
+
+func (sc *SerialConnection) error(err error, lvl ...Error.Level) {
+	errLvl := Error.Debug
+	if len(lvl) > 0 {
+		errLvl = lvl[0]
+	}
+	sc.countError(err, errLvl)
+	sc.engine.errorChan <- Error.Err(errLvl, err, ErrFlag, ErrSerialFlag, sc.path+":")
 }
 
 func (sc *SerialConnection) readLine() (string, error) {
-	scanner := bufio.NewScanner(sc.port)
-	for scanner.Scan() {
-		if scanner.Err() != nil {
-			return "", scanner.Err()
+	return sc.reader.readLine()
+}
+
+// ReadStats returns throughput and discard counters of the serial line reader
+func (sc *SerialConnection) ReadStats() ReadStats {
+	return sc.reader.stats()
+}
+
+// stablePath returns the /dev/serial/by-id link that points to the same
+// device as path, so a USB device that comes back under a different ttyUSB
+// number is still found. Without such a link path is returned unchanged.
+func stablePath(path string) string {
+	if strings.HasPrefix(path, serialByIDDir) {
+		return path
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	links, err := filepath.Glob(filepath.Join(serialByIDDir, "*"))
+	if err != nil {
+		return path
+	}
+	for _, link := range links {
+		if resolved, err := filepath.EvalSymlinks(link); err == nil && resolved == target {
+			return link
 		}
-		return scanner.Text(), nil
 	}
-	return "", errors.New("unexpectedly reached end of serialReadLine")
+	return path
 }
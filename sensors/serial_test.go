@@ -0,0 +1,169 @@
+package sensors
+
+import (
+	"github.com/tarm/serial"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"./config"
+)
+
+func TestSerialForward(t *testing.T) {
+	const (
+		rmc   = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W,A*6A"
+		gnrmc = "$GNRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W,A*74"
+		gga   = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+		gngga = "$GNGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*59"
+		vdm   = "!AIVDM,1,1,,B,177KQJ5000G?tO`K>RA1wUbN0TKH,0*5C"
+	)
+	tests := []struct {
+		name      string
+		configMap map[string]string
+		lines     []string
+		forwarded int
+		dropped   map[string]uint64
+	}{
+		{name: "everything by default", configMap: map[string]string{},
+			lines: []string{rmc, gga, vdm}, forwarded: 3, dropped: map[string]uint64{}},
+		{name: "allow formatter", configMap: map[string]string{config.ParamAllow: "RMC"},
+			lines: []string{rmc, gnrmc, gga, vdm}, forwarded: 2,
+			dropped: map[string]uint64{"$GPGGA": 1, "!AIVDM": 1}},
+		{name: "allow talker and formatter", configMap: map[string]string{config.ParamAllow: "gprmc, $GPGGA"},
+			lines: []string{rmc, gnrmc, gga, gngga}, forwarded: 2,
+			dropped: map[string]uint64{"$GNRMC": 1, "$GNGGA": 1}},
+		{name: "deny", configMap: map[string]string{config.ParamDeny: "GGA,!AIVDM"},
+			lines: []string{rmc, gga, gngga, vdm}, forwarded: 1,
+			dropped: map[string]uint64{"$GPGGA": 1, "$GNGGA": 1, "!AIVDM": 1}},
+		{name: "deny after allow", configMap: map[string]string{config.ParamAllow: "GGA", config.ParamDeny: "GPGGA"},
+			lines: []string{rmc, gga, gngga}, forwarded: 1,
+			dropped: map[string]uint64{"$GPRMC": 1, "$GPGGA": 1}},
+		{name: "not a sentence", configMap: map[string]string{},
+			lines: []string{"GPRMC,123519", "", "\x03garbage"}, forwarded: 0,
+			dropped: map[string]uint64{droppedUnparseable: 3}},
+		{name: "parse error", configMap: map[string]string{},
+			lines: []string{"$GPRMC,081836,V,,,,,,,130998,,,N*62", rmc}, forwarded: 1,
+			dropped: map[string]uint64{"$GPRMC": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nmeaChan := make(chan *nmea.Data, len(test.lines))
+			errorChan := make(chan *Error.Error, len(test.lines))
+			cfg, err := config.NewSerial(test.configMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc, err := NewEngine(nmeaChan, errorChan).newSerialConnection(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, line := range test.lines {
+				sc.forward(line)
+			}
+			if len(nmeaChan) != test.forwarded {
+				t.Errorf("%d sentences forwarded, want %d", len(nmeaChan), test.forwarded)
+			}
+			if dropped := sc.Dropped(); !reflect.DeepEqual(dropped, test.dropped) {
+				t.Errorf("dropped %v, want %v", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+// fakePort answers every read with io.EOF after delay, like a read timeout,
+// or at once like the port of an unplugged USB adapter
+type fakePort struct {
+	delay time.Duration
+	mutex sync.Mutex
+	opens []time.Time
+}
+
+func (fp *fakePort) open(deviceConfig *serial.Config) (io.ReadCloser, error) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.opens = append(fp.opens, time.Now())
+	return fp, nil
+}
+
+func (fp *fakePort) Read(p []byte) (int, error) {
+	time.Sleep(fp.delay)
+	return 0, io.EOF
+}
+
+func (fp *fakePort) Close() error { return nil }
+
+func (fp *fakePort) openTimes() []time.Time {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	return append([]time.Time{}, fp.opens...)
+}
+
+func TestSerialEOF(t *testing.T) {
+	tests := []struct {
+		name      string
+		readDelay time.Duration
+		unplug    bool
+		opens     int
+		state     State
+	}{
+		{name: "read timeouts", readDelay: 15 * time.Millisecond, opens: 1, state: StateRunning},
+		{name: "eof at once", opens: 4, state: StateConnecting},
+		{name: "device removed", readDelay: 15 * time.Millisecond, unplug: true, opens: 1, state: StateConnecting},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ttyUSB0")
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := config.NewSerial(map[string]string{
+				config.ParamPath:         path,
+				config.ParamReconnectMin: "10ms",
+				config.ParamReconnectMax: "40ms",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			errorChan := make(chan *Error.Error, 1024)
+			sc, err := NewEngine(make(chan *nmea.Data), errorChan).newSerialConnection(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc.config.DeviceConfig().ReadTimeout = 20 * time.Millisecond
+			port := &fakePort{delay: test.readDelay}
+			sc.open = port.open
+
+			sc.connect()
+			if test.unplug {
+				time.Sleep(30 * time.Millisecond)
+				os.Remove(path)
+			}
+			time.Sleep(150 * time.Millisecond)
+			state := sc.Status().State
+			sc.Stop()
+			<-sc.done
+
+			opens := port.openTimes()
+			if test.opens == 1 && len(opens) != 1 || len(opens) < test.opens {
+				t.Errorf("port opened %d times, want %d", len(opens), test.opens)
+			}
+			if state != test.state {
+				t.Errorf("state %s, want %s", state, test.state)
+			}
+			// the first reopen is immediate, then the delay doubles
+			for i := 2; i < len(opens) && i < 4; i++ {
+				if gap := opens[i].Sub(opens[i-1]); gap < 10*time.Millisecond<<uint(i-2) {
+					t.Errorf("reopened after %v", gap)
+				}
+			}
+		})
+	}
+}
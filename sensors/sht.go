@@ -0,0 +1,118 @@
+package sensors
+
+import (
+	"../nmea"
+	"errors"
+	"time"
+)
+
+const (
+	// SHT3x single shot, high repeatability, no clock stretching
+	sht3xCmdMeasure   uint16 = 0x2400
+	sht3xCmdSoftReset uint16 = 0x30a2
+	sht3xMeasureTime         = 16 * time.Millisecond
+
+	// SHT4x measurement with high precision
+	sht4xCmdMeasure   byte = 0xfd
+	sht4xCmdSoftReset byte = 0x94
+	sht4xMeasureTime       = 10 * time.Millisecond
+
+	dataTypeSht3x string = "SHT3X"
+	dataTypeSht4x string = "SHT4X"
+)
+
+func readSht3x(conn *I2CConnection) error {
+	dev := conn.dev()
+	err := dev.Tx(sht3xCommand(sht3xCmdSoftReset), nil)
+	if err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	conn.poll(dataTypeSht3x, conn.interval(), func() (nmea.DataMap, error) {
+		err := dev.Tx(sht3xCommand(sht3xCmdMeasure), nil)
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(sht3xMeasureTime)
+
+		temp, humi, err := readShtWords(conn)
+		if err != nil {
+			return nil, err
+		}
+		return nmea.DataMap{
+			"temperature": -45.0 + 175.0*float64(temp)/65535.0,
+			"humidity":    100.0 * float64(humi) / 65535.0,
+		}, nil
+	})
+	return nil
+}
+
+func readSht4x(conn *I2CConnection) error {
+	dev := conn.dev()
+	if err := dev.Tx([]byte{sht4xCmdSoftReset}, nil); err != nil {
+		return err
+	}
+	time.Sleep(time.Millisecond)
+
+	conn.poll(dataTypeSht4x, conn.interval(), func() (nmea.DataMap, error) {
+		if err := dev.Tx([]byte{sht4xCmdMeasure}, nil); err != nil {
+			return nil, err
+		}
+		time.Sleep(sht4xMeasureTime)
+
+		temp, humi, err := readShtWords(conn)
+		if err != nil {
+			return nil, err
+		}
+		// the SHT4x humidity range exceeds 0 to 100 %, the data sheet
+		// recommends cropping
+		humidity := -6.0 + 125.0*float64(humi)/65535.0
+		if humidity < 0 {
+			humidity = 0
+		} else if humidity > 100 {
+			humidity = 100
+		}
+		return nmea.DataMap{
+			"temperature": -45.0 + 175.0*float64(temp)/65535.0,
+			"humidity":    humidity,
+		}, nil
+	})
+	return nil
+}
+
+// SHT3x commands are 16 bit, most significant byte first
+func sht3xCommand(cmd uint16) []byte {
+	return []byte{byte(cmd >> 8), byte(cmd)}
+}
+
+// readShtWords reads the temperature and humidity words that both families
+// answer with, each followed by its CRC
+func readShtWords(conn *I2CConnection) (uint16, uint16, error) {
+	buffer := make([]byte, 6)
+	if err := conn.dev().Tx(nil, buffer); err != nil {
+		return 0, 0, err
+	}
+	if crc8(buffer[0:2], 0xff) != buffer[2] || crc8(buffer[3:5], 0xff) != buffer[5] {
+		return 0, 0, errors.New("crc mismatch in " + conn.config.DeviceType() + " reading")
+	}
+	temp := uint16(buffer[0])<<8 | uint16(buffer[1])
+	humi := uint16(buffer[3])<<8 | uint16(buffer[4])
+	return temp, humi, nil
+}
+
+// crc8 with polynomial x^8 + x^5 + x^4 + 1 as used by Sensirion and TE sensors
+func crc8(data []byte, init byte) byte {
+	crc := init
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
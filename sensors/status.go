@@ -0,0 +1,122 @@
+package sensors
+
+import (
+	"../Error"
+	"sync"
+	"time"
+)
+
+const (
+	// a running connection without data for this long is reported as stalled
+	// if the device does not configure an expected interval
+	defaultStallTimeout = 10 * time.Second
+)
+
+// Status is a snapshot of a connection for health checks and dashboards
+type Status struct {
+	DeviceID      int64
+	Type          string
+	State         State
+	StateSince    time.Time
+	LastData      time.Time
+	Sentences     uint64
+	Errors        uint64
+	LastError     string
+	LastErrorTime time.Time
+	// expected time between two sentences, 0 disables the watchdog
+	ExpectedInterval time.Duration
+
+	// serial connections only: bytes received and dropped sentences per type
+	Bytes   uint64
+	Dropped map[string]uint64
+}
+
+// connStats is embedded by the connections and shared between their read
+// routine and whoever asks for a status
+type connStats struct {
+	statsMutex    sync.Mutex
+	stallTimeout  time.Duration
+	state         State
+	stateSince    time.Time
+	lastData      time.Time
+	sentences     uint64
+	errors        uint64
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (cs *connStats) State() State {
+	cs.statsMutex.Lock()
+	defer cs.statsMutex.Unlock()
+	return cs.state
+}
+
+// swapState sets the new state and returns the previous one
+func (cs *connStats) swapState(state State) State {
+	cs.statsMutex.Lock()
+	defer cs.statsMutex.Unlock()
+	previous := cs.state
+	if previous != state {
+		cs.state = state
+		cs.stateSince = time.Now()
+	}
+	return previous
+}
+
+func (cs *connStats) countSentence() {
+	cs.statsMutex.Lock()
+	cs.lastData = time.Now()
+	cs.sentences++
+	cs.statsMutex.Unlock()
+}
+
+// countError only counts errors from Warning upwards, below that the
+// connections report progress and single malformed sentences
+func (cs *connStats) countError(err error, lvl Error.Level) {
+	if lvl < Error.Warning {
+		return
+	}
+	cs.statsMutex.Lock()
+	cs.errors++
+	cs.lastError = err.Error()
+	cs.lastErrorTime = time.Now()
+	cs.statsMutex.Unlock()
+}
+
+func newConnStats(expectedInterval time.Duration) connStats {
+	return connStats{
+		stallTimeout: expectedInterval * watchdogWarnFactor,
+		state:        StateStopped,
+		stateSince:   time.Now(),
+	}
+}
+
+func (cs *connStats) status(deviceID int64, connType string) Status {
+	cs.statsMutex.Lock()
+	defer cs.statsMutex.Unlock()
+
+	// a connection that just started running had no chance to deliver yet
+	lastActivity := cs.lastData
+	if cs.stateSince.After(lastActivity) {
+		lastActivity = cs.stateSince
+	}
+	stallTimeout := cs.stallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = defaultStallTimeout
+	}
+	state := cs.state
+	if state == StateRunning && time.Since(lastActivity) > stallTimeout {
+		state = StateStalled
+	}
+	return Status{
+		DeviceID:      deviceID,
+		Type:          connType,
+		State:         state,
+		StateSince:    cs.stateSince,
+		LastData:      cs.lastData,
+		Sentences:     cs.sentences,
+		Errors:        cs.errors,
+		LastError:     cs.lastError,
+		LastErrorTime: cs.lastErrorTime,
+	}
+}
@@ -0,0 +1,122 @@
+package sensors
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+	"./config"
+)
+
+// fakeConn is a connection that reports a fixed status and counts how often
+// it was stopped and connected
+type fakeConn struct {
+	status   Status
+	stops    int
+	connects int
+}
+
+func (fc *fakeConn) DeviceID() int64 { return fc.status.DeviceID }
+func (fc *fakeConn) Type() string    { return fc.status.Type }
+func (fc *fakeConn) Status() Status  { return fc.status }
+func (fc *fakeConn) Stop()           { fc.stops++ }
+func (fc *fakeConn) connect() error  { fc.connects++; return nil }
+
+func TestConnStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      State
+		stateSince time.Duration
+		// zero if the connection never delivered
+		lastData     time.Duration
+		stallTimeout time.Duration
+		want         State
+	}{
+		{name: "running", state: StateRunning, stateSince: time.Hour, lastData: time.Second, want: StateRunning},
+		{name: "silent", state: StateRunning, stateSince: time.Hour, lastData: time.Minute, want: StateStalled},
+		{name: "never delivered", state: StateRunning, stateSince: time.Minute, want: StateStalled},
+		{name: "expected interval", state: StateRunning, stateSince: time.Hour, lastData: 5 * time.Second,
+			stallTimeout: 3 * time.Second, want: StateStalled},
+		{name: "just started", state: StateRunning, stateSince: time.Second, lastData: time.Hour, want: StateRunning},
+		{name: "connecting", state: StateConnecting, stateSince: time.Hour, want: StateConnecting},
+		{name: "stopped", state: StateStopped, stateSince: time.Hour, lastData: time.Hour, want: StateStopped},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			cs := &connStats{state: test.state, stateSince: now.Add(-test.stateSince), stallTimeout: test.stallTimeout}
+			if test.lastData > 0 {
+				cs.lastData = now.Add(-test.lastData)
+			}
+			if status := cs.status(7, config.TypeSerial); status.State != test.want {
+				t.Errorf("state %s, want %s", status.State, test.want)
+			}
+		})
+	}
+}
+
+func TestConnStatusCounters(t *testing.T) {
+	cs := &connStats{}
+	if previous := cs.swapState(StateRunning); previous != StateConnecting {
+		t.Errorf("previous state %s", previous)
+	}
+	since := cs.stateSince
+	cs.swapState(StateRunning)
+	cs.countSentence()
+	cs.countSentence()
+	// only errors from Warning upwards count
+	levels := []Error.Level{Error.Debug, Error.Warning, Error.Info, Error.High}
+	for i, level := range levels {
+		cs.countError(errors.New("error "+strconv.Itoa(i)), level)
+	}
+
+	status := cs.status(1, config.TypeI2C)
+	if status.DeviceID != 1 || status.Type != config.TypeI2C || status.State != StateRunning ||
+		!cs.stateSince.Equal(since) {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.Sentences != 2 || status.LastData.IsZero() {
+		t.Errorf("%d sentences, last at %v", status.Sentences, status.LastData)
+	}
+	if status.Errors != 2 || status.LastError != "error 3" || status.LastErrorTime.IsZero() {
+		t.Errorf("%d errors, last %q at %v", status.Errors, status.LastError, status.LastErrorTime)
+	}
+}
+
+// the engine lists every connection ordered by device id, serial connections
+// add their dropped sentences
+func TestEngineStatus(t *testing.T) {
+	e := NewEngine(make(chan *nmea.Data, 4), make(chan *Error.Error, 4))
+	cfg, err := config.NewSerial(map[string]string{config.ParamAllow: "RMC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := e.newSerialConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.forward("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W,A*6A")
+	sc.forward("$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47")
+	e.connList[0] = sc
+	e.connList[9] = &fakeConn{status: Status{DeviceID: 9, State: StateRunning}}
+	e.connList[3] = &fakeConn{status: Status{DeviceID: 3, State: StateConnecting}}
+
+	list := e.Status()
+	ids := make([]int64, 0, len(list))
+	for _, status := range list {
+		ids = append(ids, status.DeviceID)
+	}
+	if !reflect.DeepEqual(ids, []int64{0, 3, 9}) {
+		t.Fatalf("device ids %v", ids)
+	}
+	if list[0].Sentences != 1 || !reflect.DeepEqual(list[0].Dropped, map[string]uint64{"$GPGGA": 1}) {
+		t.Errorf("serial status %+v", list[0])
+	}
+	if list[1].State != StateConnecting || list[2].State != StateRunning {
+		t.Errorf("states %s and %s", list[1].State, list[2].State)
+	}
+}
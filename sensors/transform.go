@@ -0,0 +1,209 @@
+package sensors
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../nmea"
+	"./config"
+)
+
+const (
+	// field the sea level reduction takes the air temperature from
+	transformTemperatureField string = "temperature"
+	transformRawSuffix        string = "_raw"
+)
+
+// unit converts a value to the base unit of its quantity: base = value*factor + offset
+type unit struct {
+	quantity string
+	factor   float64
+	offset   float64
+}
+
+var units = map[string]unit{
+	"C":     {"temperature", 1, 0},
+	"F":     {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"K":     {"temperature", 1, -nmea.ZeroCelsiusInKelvin},
+	"hPa":   {"pressure", 1, 0},
+	"mbar":  {"pressure", 1, 0},
+	"Pa":    {"pressure", 0.01, 0},
+	"kPa":   {"pressure", 10, 0},
+	"inHg":  {"pressure", 33.8639, 0},
+	"mmHg":  {"pressure", 1.33322, 0},
+	"psi":   {"pressure", 68.9476, 0},
+	"m/s":   {"speed", 1, 0},
+	"kn":    {"speed", 1852.0 / 3600.0, 0},
+	"km/h":  {"speed", 1 / 3.6, 0},
+	"mph":   {"speed", 0.44704, 0},
+	"m":     {"length", 1, 0},
+	"ft":    {"length", 0.3048, 0},
+	"fm":    {"length", 1.8288, 0},
+	"km":    {"length", 1000, 0},
+	"nmi":   {"length", 1852, 0},
+	"l":     {"volume", 1, 0},
+	"m3":    {"volume", 1000, 0},
+	"gal":   {"volume", 3.785411784, 0},
+	"deg":   {"angle", 1, 0},
+	"rad":   {"angle", 180 / math.Pi, 0},
+	"A":     {"current", 1, 0},
+	"mA":    {"current", 0.001, 0},
+	"V":     {"voltage", 1, 0},
+	"mV":    {"voltage", 0.001, 0},
+	"Ah":    {"charge", 1, 0},
+	"mAh":   {"charge", 0.001, 0},
+	"%":     {"ratio", 1, 0},
+	"ratio": {"ratio", 100, 0},
+}
+
+type unitConversion struct {
+	from unit
+	to   unit
+}
+
+func (uc unitConversion) convert(value float64) float64 {
+	return (value*uc.from.factor + uc.from.offset - uc.to.offset) / uc.to.factor
+}
+
+// transform corrects the readings of a device before they leave the engine
+type transform struct {
+	offsets  map[string]float64
+	scales   map[string]float64
+	seaLevel map[string]float64
+	units    map[string]unitConversion
+	keepRaw  bool
+	fields   []string
+}
+
+// newTransform reads the corrections from a device configuration, it returns
+// nil if there are none
+func newTransform(configMap map[string]string) (*transform, error) {
+	t := &transform{
+		offsets:  map[string]float64{},
+		scales:   map[string]float64{},
+		seaLevel: map[string]float64{},
+		units:    map[string]unitConversion{},
+	}
+	invalid := func(key string, value string) error {
+		return errors.New(config.ErrFlag + ": invalid value for " + key + ": " + value)
+	}
+
+	fields := map[string]bool{}
+	for key, value := range configMap {
+		var target map[string]float64
+		var field string
+		switch {
+		case key == config.ParamKeepRaw:
+			keepRaw, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, invalid(key, value)
+			}
+			t.keepRaw = keepRaw
+			continue
+		case strings.HasPrefix(key, config.ParamUnitPrefix):
+			field = strings.TrimPrefix(key, config.ParamUnitPrefix)
+			names := strings.Split(value, ":")
+			if len(names) != 2 {
+				return nil, invalid(key, value)
+			}
+			from, fromOk := units[strings.TrimSpace(names[0])]
+			to, toOk := units[strings.TrimSpace(names[1])]
+			if !fromOk || !toOk || from.quantity != to.quantity {
+				return nil, invalid(key, value)
+			}
+			t.units[field] = unitConversion{from: from, to: to}
+		case strings.HasPrefix(key, config.ParamOffsetPrefix):
+			field, target = strings.TrimPrefix(key, config.ParamOffsetPrefix), t.offsets
+		case strings.HasPrefix(key, config.ParamScalePrefix):
+			field, target = strings.TrimPrefix(key, config.ParamScalePrefix), t.scales
+		case strings.HasPrefix(key, config.ParamSeaLevelPrefix):
+			field, target = strings.TrimPrefix(key, config.ParamSeaLevelPrefix), t.seaLevel
+		default:
+			continue
+		}
+		if field == "" || field == "deviceid" {
+			return nil, invalid(key, value)
+		}
+		if target != nil {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, invalid(key, value)
+			}
+			target[field] = number
+		}
+		fields[field] = true
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	for field := range fields {
+		t.fields = append(t.fields, field)
+	}
+	sort.Strings(t.fields)
+	return t, nil
+}
+
+// apply corrects the fields in place: scale and offset first, so the sea
+// level reduction sees the corrected temperature, units last
+func (t *transform) apply(data nmea.DataMap) {
+	if t.keepRaw {
+		for _, field := range t.fields {
+			if value, ok := data[field]; ok {
+				data[field+transformRawSuffix] = value
+			}
+		}
+	}
+
+	for _, field := range t.fields {
+		value, ok := data[field]
+		if !ok {
+			continue
+		}
+		if scale, ok := t.scales[field]; ok {
+			value *= scale
+		}
+		data[field] = value + t.offsets[field]
+	}
+
+	for field, height := range t.seaLevel {
+		if pressure, ok := data[field]; ok {
+			temperature, hasTemperature := data[transformTemperatureField]
+			data[field] = seaLevelPressure(pressure, height, temperature, hasTemperature)
+		}
+	}
+
+	for field, conversion := range t.units {
+		if value, ok := data[field]; ok {
+			data[field] = conversion.convert(value)
+		}
+	}
+}
+
+// seaLevelPressure reduces the pressure measured at height metres to sea
+// level, with the air temperature in degrees Celsius if it is known and the
+// standard atmosphere otherwise. The result has the unit of the input.
+func seaLevelPressure(pressure float64, height float64, temperature float64, hasTemperature bool) float64 {
+	if !hasTemperature {
+		return pressure * math.Pow(1-2.25577e-5*height, -5.25588)
+	}
+	lapse := 0.0065 * height
+	return pressure * math.Pow(1-lapse/(temperature+lapse+nmea.ZeroCelsiusInKelvin), -5.257)
+}
+
+// publish is the single way readings leave the engine, it applies the
+// corrections configured for the device
+func (e *Engine) publish(data *nmea.Data) {
+	if data.Type != nmea.TypeOutage {
+		e.connMutex.Lock()
+		t := e.transforms[data.DeviceID()]
+		e.connMutex.Unlock()
+		if t != nil {
+			t.apply(data.Data)
+		}
+	}
+	e.nmeaChan <- data
+}
@@ -0,0 +1,121 @@
+package sensors
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"../nmea"
+	"./config"
+)
+
+func TestNewTransform(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap map[string]string
+		none      bool
+		err       string
+	}{
+		{name: "nothing to correct", configMap: map[string]string{config.ParamName: "saloon"}, none: true},
+		{name: "keep raw alone", configMap: map[string]string{config.ParamKeepRaw: "true"}, none: true},
+		{name: "offset", configMap: map[string]string{config.ParamOffsetPrefix + "temperature": "-0.5"}},
+		{name: "invalid offset", configMap: map[string]string{config.ParamOffsetPrefix + "temperature": "cold"},
+			err: "invalid value for offset.temperature"},
+		{name: "no field", configMap: map[string]string{config.ParamScalePrefix: "2"}, err: "invalid value for scale."},
+		{name: "device id", configMap: map[string]string{config.ParamOffsetPrefix + "deviceid": "1"}, err: "invalid value"},
+		{name: "invalid keep raw", configMap: map[string]string{config.ParamKeepRaw: "maybe"}, err: "invalid value for keep_raw"},
+		{name: "unknown unit", configMap: map[string]string{config.ParamUnitPrefix + "temperature": "C:R"}, err: "invalid value"},
+		{name: "other quantity", configMap: map[string]string{config.ParamUnitPrefix + "temperature": "C:hPa"}, err: "invalid value"},
+		{name: "one unit", configMap: map[string]string{config.ParamUnitPrefix + "temperature": "F"}, err: "invalid value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := newTransform(test.configMap)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (tr == nil) != test.none {
+				t.Errorf("got transform %+v", tr)
+			}
+		})
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap map[string]string
+		data      nmea.DataMap
+		want      nmea.DataMap
+	}{
+		{name: "offset and scale",
+			configMap: map[string]string{
+				config.ParamOffsetPrefix + "temperature": "-0.5",
+				config.ParamScalePrefix + "humidity":     "1.02",
+				config.ParamOffsetPrefix + "voltage":     "0.1",
+			},
+			data: nmea.DataMap{"temperature": 20, "humidity": 50, "pressure": 1000},
+			want: nmea.DataMap{"temperature": 19.5, "humidity": 51, "pressure": 1000}},
+		{name: "scale before offset",
+			configMap: map[string]string{
+				config.ParamScalePrefix + "tank":  "2",
+				config.ParamOffsetPrefix + "tank": "-10",
+			},
+			data: nmea.DataMap{"tank": 30},
+			want: nmea.DataMap{"tank": 50}},
+		{name: "keep raw",
+			configMap: map[string]string{
+				config.ParamOffsetPrefix + "temperature": "-0.5",
+				config.ParamKeepRaw:                      "true",
+			},
+			data: nmea.DataMap{"temperature": 20, "humidity": 50},
+			want: nmea.DataMap{"temperature": 19.5, "temperature" + transformRawSuffix: 20, "humidity": 50}},
+		{name: "sea level with corrected temperature",
+			configMap: map[string]string{
+				config.ParamOffsetPrefix + "temperature": "-5",
+				config.ParamSeaLevelPrefix + "pressure":  "100",
+			},
+			data: nmea.DataMap{"temperature": 20, "pressure": 1000},
+			want: nmea.DataMap{"temperature": 15, "pressure": 1011.9156580738882}},
+		{name: "sea level without temperature",
+			configMap: map[string]string{config.ParamSeaLevelPrefix + "pressure": "100"},
+			data:      nmea.DataMap{"pressure": 1000},
+			want:      nmea.DataMap{"pressure": 1011.940170278793}},
+		{name: "units last",
+			configMap: map[string]string{
+				config.ParamOffsetPrefix + "temperature": "-0.5",
+				config.ParamUnitPrefix + "temperature":   "C:F",
+				config.ParamUnitPrefix + "speed":         "m/s:kn",
+				config.ParamUnitPrefix + "pressure":      "Pa:hPa",
+			},
+			data: nmea.DataMap{"temperature": 20.5, "speed": 1852.0 / 3600.0, "pressure": 101325},
+			want: nmea.DataMap{"temperature": 68, "speed": 1, "pressure": 1013.25}},
+		{name: "kelvin",
+			configMap: map[string]string{config.ParamUnitPrefix + "temperature": "K:C"},
+			data:      nmea.DataMap{"temperature": 293.15},
+			want:      nmea.DataMap{"temperature": 20}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := newTransform(test.configMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr.apply(test.data)
+			if len(test.data) != len(test.want) {
+				t.Errorf("got %v, want %v", test.data, test.want)
+			}
+			for field, want := range test.want {
+				if got, ok := test.data[field]; !ok || math.Abs(got-want) > 1e-6 {
+					t.Errorf("%s is %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+}
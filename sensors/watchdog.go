@@ -0,0 +1,122 @@
+package sensors
+
+import (
+	"../Error"
+	"../nmea"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	watchdogTick = time.Second
+	// multiples of the expected interval after which a silent device is
+	// reported as Warning, and as High together with a reconnect attempt
+	watchdogWarnFactor = 3
+	watchdogHighFactor = 10
+)
+
+// watch is the watchdog's view of a single device
+type watch struct {
+	outageStart   time.Time
+	alarmed       bool
+	lastReconnect time.Time
+}
+
+func (e *Engine) watchdogRoutine() {
+	defer close(e.watchdogDone)
+	ticker := time.NewTicker(watchdogTick)
+	defer ticker.Stop()
+	watches := map[int64]*watch{}
+
+	for {
+		select {
+		case <-ticker.C:
+			e.connMutex.Lock()
+			connList := make([]Connection, 0, len(e.connList))
+			for _, conn := range e.connList {
+				connList = append(connList, conn)
+			}
+			e.connMutex.Unlock()
+
+			for _, conn := range connList {
+				e.watchConnection(conn, watches)
+			}
+		case <-e.watchdogStop:
+			// outages that are still open end with the shutdown
+			now := time.Now()
+			for deviceID, w := range watches {
+				if !w.outageStart.IsZero() {
+					e.publish(nmea.NewOutage(deviceID, w.outageStart, now))
+				}
+			}
+			return
+		}
+	}
+}
+
+func (e *Engine) watchConnection(conn Connection, watches map[int64]*watch) {
+	status := conn.Status()
+	if status.ExpectedInterval <= 0 || status.State == StateStopped {
+		return
+	}
+	w, ok := watches[status.DeviceID]
+	if !ok {
+		w = &watch{}
+		watches[status.DeviceID] = w
+	}
+	device := status.Type + " device " + strconv.FormatInt(status.DeviceID, 10)
+
+	if !w.outageStart.IsZero() {
+		// data arrived after the outage began, the device is back
+		if status.LastData.After(w.outageStart) {
+			e.publish(nmea.NewOutage(status.DeviceID, w.outageStart, status.LastData))
+			e.errorChan <- Error.New(Error.Info,
+				device+" is delivering again after "+
+					status.LastData.Sub(w.outageStart).Round(time.Second).String(),
+				ErrFlag)
+			*w = watch{}
+			return
+		}
+		e.escalate(conn, status, w, device)
+		return
+	}
+
+	// a connection that just (re)started had no chance to deliver yet
+	lastActivity := status.LastData
+	if status.StateSince.After(lastActivity) {
+		lastActivity = status.StateSince
+	}
+	if time.Since(lastActivity) > status.ExpectedInterval*watchdogWarnFactor {
+		w.outageStart = lastActivity
+		e.errorChan <- Error.New(Error.Warning,
+			"no data from "+device+" since "+lastActivity.Format(time.RFC3339),
+			ErrFlag)
+	}
+}
+
+// escalate reports a device that stays silent as High and tries to reconnect
+// it, at most once per high threshold
+func (e *Engine) escalate(conn Connection, status Status, w *watch, device string) {
+	threshold := status.ExpectedInterval * watchdogHighFactor
+	if time.Since(w.outageStart) < threshold {
+		return
+	}
+	if !w.alarmed {
+		w.alarmed = true
+		e.errorChan <- Error.New(Error.High,
+			device+" is silent for more than "+threshold.String(),
+			ErrFlag)
+	}
+
+	// serial connections in this state are already reconnecting themselves
+	if status.State == StateConnecting || time.Since(w.lastReconnect) < threshold {
+		return
+	}
+	w.lastReconnect = time.Now()
+	e.error(errors.New("watchdog reconnects "+device), Error.Info)
+	conn.Stop()
+	if err := conn.connect(); err != nil {
+		e.error(err, Error.Low)
+	}
+}
@@ -0,0 +1,119 @@
+package sensors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"../Error"
+	"../nmea"
+)
+
+// levels drains the error channel and returns the levels sent to it
+func levels(errorChan chan *Error.Error) []Error.Level {
+	list := make([]Error.Level, 0)
+	for {
+		select {
+		case err := <-errorChan:
+			list = append(list, err.Lvl)
+		default:
+			return list
+		}
+	}
+}
+
+func TestWatchConnection(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      State
+		expected   time.Duration
+		stateSince time.Duration
+		silence    time.Duration
+		// levels of the first and of the second tick
+		first      []Error.Level
+		second     []Error.Level
+		reconnects int
+	}{
+		{name: "delivering", state: StateRunning, expected: time.Second, stateSince: time.Hour,
+			silence: 2 * time.Second, first: []Error.Level{}, second: []Error.Level{}},
+		{name: "warn", state: StateRunning, expected: time.Second, stateSince: time.Hour,
+			silence: 4 * time.Second, first: []Error.Level{Error.Warning}, second: []Error.Level{}},
+		{name: "high and reconnect", state: StateRunning, expected: time.Second, stateSince: time.Hour,
+			silence: 11 * time.Second, first: []Error.Level{Error.Warning},
+			second: []Error.Level{Error.High, Error.Info}, reconnects: 1},
+		{name: "reconnecting already", state: StateConnecting, expected: time.Second, stateSince: time.Hour,
+			silence: 11 * time.Second, first: []Error.Level{Error.Warning}, second: []Error.Level{Error.High}},
+		{name: "just restarted", state: StateRunning, expected: time.Second, stateSince: time.Second,
+			silence: time.Hour, first: []Error.Level{}, second: []Error.Level{}},
+		{name: "no expected interval", state: StateRunning, stateSince: time.Hour,
+			silence: time.Hour, first: []Error.Level{}, second: []Error.Level{}},
+		{name: "stopped", state: StateStopped, expected: time.Second, stateSince: time.Hour,
+			silence: time.Hour, first: []Error.Level{}, second: []Error.Level{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errorChan := make(chan *Error.Error, 8)
+			nmeaChan := make(chan *nmea.Data, 8)
+			e := &Engine{errorChan: errorChan, nmeaChan: nmeaChan}
+			now := time.Now()
+			conn := &fakeConn{status: Status{
+				DeviceID:         5,
+				State:            test.state,
+				StateSince:       now.Add(-test.stateSince),
+				LastData:         now.Add(-test.silence),
+				ExpectedInterval: test.expected,
+			}}
+			watches := map[int64]*watch{}
+
+			e.watchConnection(conn, watches)
+			if got := levels(errorChan); !reflect.DeepEqual(got, test.first) {
+				t.Errorf("first tick sent %v, want %v", got, test.first)
+			}
+			e.watchConnection(conn, watches)
+			if got := levels(errorChan); !reflect.DeepEqual(got, test.second) {
+				t.Errorf("second tick sent %v, want %v", got, test.second)
+			}
+			if conn.stops != test.reconnects || conn.connects != test.reconnects {
+				t.Errorf("%d stops and %d connects, want %d reconnects", conn.stops, conn.connects, test.reconnects)
+			}
+			if len(nmeaChan) != 0 {
+				t.Errorf("outage published while the device is silent")
+			}
+		})
+	}
+}
+
+// a device that delivers again ends its outage with a record of it
+func TestWatchConnectionOutage(t *testing.T) {
+	errorChan := make(chan *Error.Error, 8)
+	nmeaChan := make(chan *nmea.Data, 8)
+	e := &Engine{errorChan: errorChan, nmeaChan: nmeaChan}
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	conn := &fakeConn{status: Status{
+		DeviceID:         5,
+		State:            StateRunning,
+		StateSince:       start.Add(-time.Hour),
+		LastData:         start,
+		ExpectedInterval: time.Second,
+	}}
+	watches := map[int64]*watch{}
+
+	e.watchConnection(conn, watches)
+	back := start.Add(50 * time.Second)
+	conn.status.LastData = back
+	e.watchConnection(conn, watches)
+	if got := levels(errorChan); !reflect.DeepEqual(got, []Error.Level{Error.Warning, Error.Info}) {
+		t.Errorf("sent %v", got)
+	}
+	if len(nmeaChan) != 1 {
+		t.Fatalf("%d outages published, want 1", len(nmeaChan))
+	}
+	outage := <-nmeaChan
+	want := nmea.DataMap{"deviceid": 5, "start": float64(start.Unix()), "end": float64(back.Unix()), "duration": 50}
+	if outage.Type != nmea.TypeOutage || !reflect.DeepEqual(outage.Data, want) {
+		t.Errorf("outage %s %v, want %v", outage.Type, outage.Data, want)
+	}
+	if *watches[5] != (watch{}) {
+		t.Errorf("watch not reset after the device came back: %+v", *watches[5])
+	}
+}
@@ -0,0 +1,222 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"../database"
+	"../nmea"
+	"../storage"
+	"./sqlite"
+)
+
+const (
+	conformanceType       string = "CONFORMANCE"
+	conformanceOtherType  string = "CONFORMANCEOTHER"
+	conformanceConcurrent int    = 8
+	conformanceInterval   int64  = 60
+
+	// the mongo backend is only checked if this names a server, e.g.
+	// mongodb://localhost:27017, a scratch database is created and dropped
+	mongoURIVariable string = "NMEALOGGER_TEST_MONGO_URI"
+)
+
+func TestSQLiteConformance(t *testing.T) {
+	store, err := sqlite.Open(filepath.Join(t.TempDir(), "conformance.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testConformance(t, store)
+}
+
+func TestMongoConformance(t *testing.T) {
+	uri := os.Getenv(mongoURIVariable)
+	if uri == "" {
+		t.Skip(mongoURIVariable + " not set")
+	}
+	name := "nmealogger_conformance_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	config, err := nmea2mongo.NewConfig(map[string]string{
+		nmea2mongo.ParamURI:      uri,
+		nmea2mongo.ParamDatabase: name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := nmea2mongo.OpenMongo(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	defer dropMongoDatabase(t, uri, name)
+	testConformance(t, store)
+}
+
+func dropMongoDatabase(t *testing.T, uri string, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer client.Disconnect(ctx)
+	if err = client.Database(name).Drop(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+// testConformance checks the behaviour every Storage implementation has to
+// show, s has to be empty
+func testConformance(t *testing.T, s storage.Storage) {
+	if err := s.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	types, err := s.ListTypes()
+	if err != nil || len(types) > 0 {
+		t.Fatalf("storage is not empty: %v, error %v", types, err)
+	}
+
+	if _, _, ok, err := s.Bounds(conformanceType, 0); err != nil || ok {
+		t.Errorf("bounds of a missing type: ok %v, error %v", ok, err)
+	}
+
+	records := []*nmea.Data{
+		conformanceRecord(100, 1, 1),
+		conformanceRecord(100, 2, 2),
+		conformanceRecord(101, 1, 3),
+		conformanceRecord(160, 1, 4),
+	}
+	if err = s.WriteRecords(conformanceType, records); err != nil {
+		t.Errorf("write records: %v", err)
+	}
+	// a second record of the same device and second is skipped
+	if err = s.WriteRecords(conformanceType, []*nmea.Data{conformanceRecord(100, 1, 9)}); err != nil {
+		t.Errorf("write duplicate record: %v", err)
+	}
+	if err = s.WriteRecords(conformanceOtherType, []*nmea.Data{conformanceRecord(100, 1, 5)}); err != nil {
+		t.Errorf("write records of another type: %v", err)
+	}
+
+	all, err := s.QueryRange(conformanceType, 0, 0, 1000)
+	if err != nil {
+		t.Errorf("query records: %v", err)
+	} else if len(all) != len(records) {
+		t.Errorf("query records: got %d, want %d", len(all), len(records))
+	} else {
+		for i, data := range all {
+			if i > 0 && data.Timestamp < all[i-1].Timestamp {
+				t.Errorf("query records: not ordered by timestamp")
+			}
+			if data.Type != conformanceType {
+				t.Errorf("query records: type %q, want %q", data.Type, conformanceType)
+			}
+			if data.Timestamp == 100 && data.DeviceID() == 1 && data.Data["value"] != 1 {
+				t.Errorf("duplicate record replaced the first one")
+			}
+		}
+	}
+	if window, err := s.QueryRange(conformanceType, 0, 100, 160); err != nil || len(window) != 3 {
+		t.Errorf("query range end is exclusive: got %d records, error %v", len(window), err)
+	}
+
+	first, last, ok, err := s.Bounds(conformanceType, 0)
+	if err != nil || !ok || first != 100 || last != 160 {
+		t.Errorf("bounds of records: %d to %d, ok %v, error %v", first, last, ok, err)
+	}
+
+	aggregates := []*nmea.Data{conformanceRecord(1, 2, 2), conformanceRecord(1, 1, 3)}
+	if err = s.WriteAggregates(conformanceType, conformanceInterval, aggregates); err != nil {
+		t.Errorf("write aggregates: %v", err)
+	}
+	stored, err := s.QueryRange(conformanceType, conformanceInterval, 1, 2)
+	if err != nil || len(stored) != 2 {
+		t.Errorf("query aggregates: got %d, error %v", len(stored), err)
+	} else if stored[0].DeviceID() != 1 || stored[1].DeviceID() != 2 || stored[0].Data["value"] != 3 {
+		t.Errorf("query aggregates: not ordered by device id or wrong values")
+	}
+	if err = s.WriteAggregates(conformanceType, conformanceInterval, []*nmea.Data{conformanceRecord(1, 1, 7)}); err != nil {
+		t.Errorf("write existing aggregates: %v", err)
+	}
+	stored, err = s.QueryRange(conformanceType, conformanceInterval, 1, 2)
+	if err != nil || len(stored) != 1 {
+		t.Errorf("replaced aggregates: got %d, error %v", len(stored), err)
+	} else if stored[0].Data["value"] != 7 || stored[0].DeviceID() != 1 {
+		t.Errorf("existing aggregates were not replaced")
+	}
+	if raw, err := s.QueryRange(conformanceType, 0, 1, 2); err != nil || len(raw) != 0 {
+		t.Errorf("aggregates show up as records: got %d, error %v", len(raw), err)
+	}
+
+	if _, ok, err := s.Watermark(conformanceType, conformanceInterval); err != nil || ok {
+		t.Errorf("watermark before it was set: ok %v, error %v", ok, err)
+	}
+	for _, timestamp := range []int64{180, 120} {
+		if err = s.SetWatermark(conformanceType, conformanceInterval, timestamp); err != nil {
+			t.Errorf("set watermark: %v", err)
+		}
+	}
+	if err = s.SetWatermark(conformanceOtherType, conformanceInterval, 60); err != nil {
+		t.Errorf("set watermark of another type: %v", err)
+	}
+	if watermark, ok, err := s.Watermark(conformanceType, conformanceInterval); err != nil || !ok || watermark != 120 {
+		t.Errorf("watermark: %d, ok %v, error %v", watermark, ok, err)
+	}
+	if _, ok, err := s.Watermark(conformanceType, 0); err != nil || ok {
+		t.Errorf("watermark of another interval: ok %v, error %v", ok, err)
+	}
+
+	types, err = s.ListTypes()
+	if err != nil || len(types) != 2 {
+		t.Errorf("list types: %v, error %v", types, err)
+	}
+
+	if err = s.DropAggregates(); err != nil {
+		t.Errorf("drop aggregates: %v", err)
+	}
+	if _, _, ok, err = s.Bounds(conformanceType, conformanceInterval); err != nil || ok {
+		t.Errorf("aggregates left after dropping: ok %v, error %v", ok, err)
+	}
+	if _, ok, err = s.Watermark(conformanceType, conformanceInterval); err != nil || ok {
+		t.Errorf("watermark left after dropping aggregates: ok %v, error %v", ok, err)
+	}
+	if all, err = s.QueryRange(conformanceType, 0, 0, 1000); err != nil || len(all) != len(records) {
+		t.Errorf("records lost by dropping aggregates: got %d, error %v", len(all), err)
+	}
+
+	// writes of a new second at the same time all end up in its document,
+	// the first device writes twice and only one of its records is kept
+	var wg sync.WaitGroup
+	for i := 0; i <= conformanceConcurrent; i++ {
+		deviceID := int64(i)
+		if deviceID == 0 {
+			deviceID = 1
+		}
+		wg.Add(1)
+		go func(record *nmea.Data) {
+			defer wg.Done()
+			if err := s.WriteRecords(conformanceType, []*nmea.Data{record}); err != nil {
+				t.Errorf("write records of the same second at once: %v", err)
+			}
+		}(conformanceRecord(500, deviceID, float64(i)))
+	}
+	wg.Wait()
+	if concurrent, err := s.QueryRange(conformanceType, 0, 500, 501); err != nil || len(concurrent) != conformanceConcurrent {
+		t.Errorf("records of the same second written at once: got %d, want %d, error %v",
+			len(concurrent), conformanceConcurrent, err)
+	}
+}
+
+func conformanceRecord(timestamp int64, deviceID int64, value float64) *nmea.Data {
+	data := nmea.NewSensorData(conformanceType, deviceID, nmea.DataMap{"value": value})
+	data.Timestamp = timestamp
+	return data
+}
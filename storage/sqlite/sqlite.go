@@ -0,0 +1,236 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	_ "github.com/mattn/go-sqlite3"
+
+	"../../nmea"
+	"../../storage"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+	type      TEXT    NOT NULL,
+	timestamp INTEGER NOT NULL,
+	deviceid  INTEGER NOT NULL,
+	data      TEXT    NOT NULL,
+	PRIMARY KEY (type, timestamp, deviceid)
+);
+CREATE TABLE IF NOT EXISTS aggregates (
+	type      TEXT    NOT NULL,
+	interval  INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	deviceid  INTEGER NOT NULL,
+	data      TEXT    NOT NULL,
+	PRIMARY KEY (type, interval, timestamp, deviceid)
+);
+CREATE TABLE IF NOT EXISTS watermarks (
+	type      TEXT    NOT NULL,
+	interval  INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	PRIMARY KEY (type, interval)
+);`
+
+// Storage keeps records and aggregates in a SQLite database file, so no
+// database server is needed on board. Field maps are stored as json.
+type Storage struct {
+	db *sql.DB
+}
+
+// Open opens or creates the database file at path
+func Open(path string) (*Storage, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has a single writer, concurrent flushes queue up here
+	db.SetMaxOpenConns(1)
+
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Storage{db: db}, nil
+}
+
+// migrate drops aggregates of all devices mixed together, written before
+// aggregates had a device id, along with their watermarks. The average
+// routine computes them again from the records.
+func migrate(db *sql.DB) error {
+	var columns int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('aggregates')`).Scan(&columns)
+	if err != nil || columns == 0 {
+		return err
+	}
+	var deviceColumns int
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('aggregates') WHERE name = 'deviceid'`).Scan(&deviceColumns)
+	if err != nil || deviceColumns > 0 {
+		return err
+	}
+	_, err = db.Exec(`DROP TABLE aggregates; DROP TABLE IF EXISTS watermarks`)
+	return err
+}
+
+func (s *Storage) WriteRecords(dataType string, records []*nmea.Data) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO records (type, timestamp, deviceid, data) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	refused := &storage.RefusedError{Total: len(records)}
+	for _, data := range records {
+		fields, err := json.Marshal(data.Data)
+		if err == nil {
+			_, err = stmt.Exec(dataType, data.Timestamp, data.DeviceID(), string(fields))
+		}
+		if err != nil {
+			refused.Refused++
+			refused.Err = err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if refused.Refused > 0 {
+		return refused
+	}
+	return nil
+}
+
+func (s *Storage) WriteAggregates(dataType string, interval int64, aggregates []*nmea.Data) error {
+	if len(aggregates) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM aggregates WHERE type = ? AND interval = ? AND timestamp = ?`,
+		dataType, interval, aggregates[0].Timestamp)
+	for _, aggregate := range aggregates {
+		if err != nil {
+			break
+		}
+		var fields []byte
+		if fields, err = json.Marshal(aggregate.Data); err == nil {
+			_, err = tx.Exec(`INSERT OR REPLACE INTO aggregates (type, interval, timestamp, deviceid, data) VALUES (?, ?, ?, ?, ?)`,
+				dataType, interval, aggregate.Timestamp, aggregate.DeviceID(), string(fields))
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Storage) QueryRange(dataType string, interval int64, start int64, end int64) ([]*nmea.Data, error) {
+	var rows *sql.Rows
+	var err error
+	if interval == 0 {
+		rows, err = s.db.Query(`SELECT timestamp, deviceid, data FROM records
+			WHERE type = ? AND timestamp >= ? AND timestamp < ?
+			ORDER BY timestamp, deviceid`, dataType, start, end)
+	} else {
+		rows, err = s.db.Query(`SELECT timestamp, deviceid, data FROM aggregates
+			WHERE type = ? AND interval = ? AND timestamp >= ? AND timestamp < ?
+			ORDER BY timestamp, deviceid`, dataType, interval, start, end)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*nmea.Data, 0)
+	for rows.Next() {
+		var fields string
+		var deviceID int64
+		data := &nmea.Data{Type: dataType}
+		if err = rows.Scan(&data.Timestamp, &deviceID, &fields); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(fields), &data.Data); err != nil {
+			return nil, err
+		}
+		data.Data["deviceid"] = float64(deviceID)
+		list = append(list, data)
+	}
+	return list, rows.Err()
+}
+
+func (s *Storage) Bounds(dataType string, interval int64) (int64, int64, bool, error) {
+	var first, last sql.NullInt64
+	var err error
+	if interval == 0 {
+		err = s.db.QueryRow(`SELECT MIN(timestamp), MAX(timestamp) FROM records WHERE type = ?`,
+			dataType).Scan(&first, &last)
+	} else {
+		err = s.db.QueryRow(`SELECT MIN(timestamp), MAX(timestamp) FROM aggregates WHERE type = ? AND interval = ?`,
+			dataType, interval).Scan(&first, &last)
+	}
+	if err != nil || !first.Valid {
+		return 0, 0, false, err
+	}
+	return first.Int64, last.Int64, true, nil
+}
+
+func (s *Storage) ListTypes() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT type FROM records ORDER BY type`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make([]string, 0)
+	for rows.Next() {
+		var dataType string
+		if err = rows.Scan(&dataType); err != nil {
+			return nil, err
+		}
+		types = append(types, dataType)
+	}
+	return types, rows.Err()
+}
+
+func (s *Storage) Watermark(dataType string, interval int64) (int64, bool, error) {
+	var timestamp int64
+	err := s.db.QueryRow(`SELECT timestamp FROM watermarks WHERE type = ? AND interval = ?`,
+		dataType, interval).Scan(&timestamp)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return timestamp, true, nil
+}
+
+func (s *Storage) SetWatermark(dataType string, interval int64, timestamp int64) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO watermarks (type, interval, timestamp) VALUES (?, ?, ?)`,
+		dataType, interval, timestamp)
+	return err
+}
+
+func (s *Storage) DropAggregates() error {
+	_, err := s.db.Exec(`DELETE FROM aggregates; DELETE FROM watermarks`)
+	return err
+}
+
+func (s *Storage) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"strconv"
+
+	"../nmea"
+)
+
+// Storage keeps the records of the logger and the aggregates computed from
+// them. Raw records are addressed by type and timestamp in seconds,
+// aggregates additionally by the nominal length of their interval in seconds
+// and carry the start of their period as timestamp.
+type Storage interface {
+	// WriteRecords stores records of one type. A record of a device that
+	// already has one for the same second is skipped. If some records are
+	// refused the others are written and a *RefusedError is returned, any
+	// other error means the storage could not be reached and nothing was
+	// written.
+	WriteRecords(dataType string, records []*nmea.Data) error
+
+	// WriteAggregates stores the aggregates of one period, one per device,
+	// which all carry the same timestamp. They replace all aggregates the
+	// period had.
+	WriteAggregates(dataType string, interval int64, aggregates []*nmea.Data) error
+
+	// QueryRange returns the entries with start <= timestamp < end ordered
+	// by timestamp and device id, raw records for interval 0 and aggregates
+	// otherwise. Every entry carries its device id.
+	QueryRange(dataType string, interval int64, start int64, end int64) ([]*nmea.Data, error)
+
+	// Bounds returns the first and last timestamp of raw records for interval
+	// 0 or of aggregates otherwise, ok is false if there are none
+	Bounds(dataType string, interval int64) (first int64, last int64, ok bool, err error)
+
+	// ListTypes returns the types of which raw records are stored
+	ListTypes() ([]string, error)
+
+	// Watermark returns the timestamp up to which the aggregates of a type
+	// and interval are complete, ok is false if none was set
+	Watermark(dataType string, interval int64) (timestamp int64, ok bool, err error)
+
+	// SetWatermark stores the watermark of a type and interval
+	SetWatermark(dataType string, interval int64, timestamp int64) error
+
+	// DropAggregates removes all aggregates and watermarks so they can be
+	// recalculated
+	DropAggregates() error
+
+	Ping() error
+	Close() error
+}
+
+// RefusedError reports records a storage did not accept
+type RefusedError struct {
+	Refused int
+	Total   int
+	// the reason of the last refusal
+	Err error
+}
+
+func (e *RefusedError) Error() string {
+	text := strconv.Itoa(e.Refused) + " of " + strconv.Itoa(e.Total) + " records refused"
+	if e.Err != nil {
+		text += ": " + e.Err.Error()
+	}
+	return text
+}